@@ -0,0 +1,99 @@
+package directory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	_ Directory = (*Client)(nil)
+	_ Directory = (*Memory)(nil)
+)
+
+// Directory looks up users by username. Resolve returns the IDs of the
+// usernames that exist, keyed by lower-cased username; unknown usernames are
+// left out rather than reported as errors.
+type Directory interface {
+	Resolve(ctx context.Context, usernames []string) (map[string]int, error)
+}
+
+// Client resolves usernames against the user service with
+// GET {BaseURL}/users/lookup?username=a&username=b, which answers with the
+// users it found as [{"id": 1, "username": "a"}].
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client
+}
+
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		HTTP:    &http.Client{Timeout: 2 * time.Second},
+	}
+}
+
+func (d *Client) Resolve(ctx context.Context, usernames []string) (map[string]int, error) {
+	resolved := map[string]int{}
+	if len(usernames) == 0 {
+		return resolved, nil
+	}
+	query := url.Values{"username": usernames}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.BaseURL+"/users/lookup?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := d.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("user lookup failed: %s", res.Status)
+	}
+	var users []struct {
+		ID       int    `json:"id"`
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&users); err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		resolved[strings.ToLower(user.Username)] = user.ID
+	}
+	return resolved, nil
+}
+
+// Memory is a fixed directory for tests and for running without the user
+// service.
+type Memory struct {
+	mu    sync.RWMutex
+	users map[string]int
+}
+
+func NewMemory() *Memory {
+	return &Memory{users: make(map[string]int)}
+}
+
+func (m *Memory) Add(username string, userID int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[strings.ToLower(username)] = userID
+}
+
+func (m *Memory) Resolve(ctx context.Context, usernames []string) (map[string]int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	resolved := map[string]int{}
+	for _, username := range usernames {
+		if id, ok := m.users[strings.ToLower(username)]; ok {
+			resolved[strings.ToLower(username)] = id
+		}
+	}
+	return resolved, nil
+}
@@ -0,0 +1,67 @@
+package entities
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	Hashtag = "hashtag"
+	Mention = "mention"
+)
+
+// A sigil only starts an entity at the beginning of the text or after a
+// character that could not be part of a word, so e-mail addresses and
+// "#a#b" are not split into entities.
+var entityPattern = regexp.MustCompile(`(?:^|[^\pL\pN_#@])([#@])([\pL\pN_]+)`)
+
+// Entity is a hashtag or mention found in a post. Name is lower-cased and
+// has no sigil. Start and End are the character (not byte) offsets of the
+// entity in the content, sigil included, so clients can link the text.
+type Entity struct {
+	Type  string
+	Name  string
+	Start int
+	End   int
+}
+
+// Parse returns the entities of content in the order they appear.
+func Parse(content string) []Entity {
+	var found []Entity
+	for _, match := range entityPattern.FindAllStringSubmatchIndex(content, -1) {
+		kind := Hashtag
+		if content[match[2]:match[3]] == "@" {
+			kind = Mention
+		}
+		start := utf8.RuneCountInString(content[:match[2]])
+		name := content[match[4]:match[5]]
+		found = append(found, Entity{
+			Type:  kind,
+			Name:  strings.ToLower(name),
+			Start: start,
+			End:   start + 1 + utf8.RuneCountInString(name),
+		})
+	}
+	return found
+}
+
+// Hashtags and Mentions return the distinct names of one kind of entity.
+func Hashtags(content string) []string {
+	return names(content, Hashtag)
+}
+func Mentions(content string) []string {
+	return names(content, Mention)
+}
+
+func names(content string, kind string) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, entity := range Parse(content) {
+		if entity.Type == kind && !seen[entity.Name] {
+			seen[entity.Name] = true
+			names = append(names, entity.Name)
+		}
+	}
+	return names
+}
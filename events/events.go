@@ -0,0 +1,193 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Event types, named <entity>.<what happened>.
+const (
+	TypePostCreated    = "post.created"
+	TypePostEdited     = "post.edited"
+	TypePostDeleted    = "post.deleted"
+	TypePostRestored   = "post.restored"
+	TypePostPurged     = "post.purged"
+	TypeMediaAdded     = "media.added"
+	TypePostLiked      = "post.liked"
+	TypePostUnliked    = "post.unliked"
+	TypeCommentAdded   = "comment.added"
+	TypeCommentEdited  = "comment.edited"
+	TypeCommentDeleted = "comment.deleted"
+	TypeCommentLiked   = "comment.liked"
+	TypeCommentUnliked = "comment.unliked"
+)
+
+// Event is the envelope every payload travels in. Version is the schema
+// version of Payload for its Type: adding optional fields keeps the version,
+// anything a consumer could misread bumps it.
+type Event struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Version    int             `json:"version"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// Payload is implemented by each typed event below.
+type Payload interface {
+	EventType() string
+	SchemaVersion() int
+}
+
+// EventPublisher hands events on to whoever listens for them. Publishing
+// happens after the change it describes has been stored.
+type EventPublisher interface {
+	Publish(ctx context.Context, events ...Event) error
+}
+
+func New(payload Payload, occurredAt time.Time) (Event, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{
+		ID:         gocql.TimeUUID().String(),
+		Type:       payload.EventType(),
+		Version:    payload.SchemaVersion(),
+		OccurredAt: occurredAt.UTC(),
+		Payload:    body,
+	}, nil
+}
+
+// Decode unmarshals the payload of e into payload, which should match e.Type.
+func (e Event) Decode(payload Payload) error {
+	return json.Unmarshal(e.Payload, payload)
+}
+
+type PostCreated struct {
+	PostID    string    `json:"post_id"`
+	AuthorID  int       `json:"author_id"`
+	Content   string    `json:"content"`
+	Hashtags  []string  `json:"hashtags"`
+	Mentioned []int     `json:"mentioned_user_ids"`
+	Media     []string  `json:"media"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type PostEdited struct {
+	PostID    string    `json:"post_id"`
+	AuthorID  int       `json:"author_id"`
+	Content   string    `json:"content"`
+	Mentioned []int     `json:"mentioned_user_ids"`
+	EditedAt  time.Time `json:"edited_at"`
+}
+
+type PostDeleted struct {
+	PostID    string    `json:"post_id"`
+	AuthorID  int       `json:"author_id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+type PostRestored struct {
+	PostID   string `json:"post_id"`
+	AuthorID int    `json:"author_id"`
+}
+
+// PostPurged is sent when a trashed post is removed for good and can no longer
+// be restored.
+type PostPurged struct {
+	PostID   string    `json:"post_id"`
+	AuthorID int       `json:"author_id"`
+	PurgedAt time.Time `json:"purged_at"`
+}
+
+// MediaAdded lists the files attached to a post after it was created.
+type MediaAdded struct {
+	PostID   string   `json:"post_id"`
+	AuthorID int      `json:"author_id"`
+	Media    []string `json:"media"`
+}
+
+// PostLiked and PostUnliked carry the author so that notifications need no
+// lookup; it is zero if the post could not be read.
+type PostLiked struct {
+	PostID   string `json:"post_id"`
+	AuthorID int    `json:"author_id"`
+	UserID   int    `json:"user_id"`
+}
+
+type PostUnliked struct {
+	PostID   string `json:"post_id"`
+	AuthorID int    `json:"author_id"`
+	UserID   int    `json:"user_id"`
+}
+
+// CommentAdded is also sent for replies, where ParentID is another comment.
+type CommentAdded struct {
+	CommentID string    `json:"comment_id"`
+	ParentID  string    `json:"parent_id"`
+	AuthorID  int       `json:"author_id"`
+	Content   string    `json:"content"`
+	Mentioned []int     `json:"mentioned_user_ids"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CommentEdited struct {
+	CommentID string    `json:"comment_id"`
+	ParentID  string    `json:"parent_id"`
+	AuthorID  int       `json:"author_id"`
+	Content   string    `json:"content"`
+	Mentioned []int     `json:"mentioned_user_ids"`
+	EditedAt  time.Time `json:"edited_at"`
+}
+
+// CommentDeleted lists the replies removed along with the comment.
+type CommentDeleted struct {
+	CommentID string   `json:"comment_id"`
+	ParentID  string   `json:"parent_id"`
+	AuthorID  int      `json:"author_id"`
+	Replies   []string `json:"reply_ids"`
+}
+
+type CommentLiked struct {
+	CommentID string `json:"comment_id"`
+	AuthorID  int    `json:"author_id"`
+	UserID    int    `json:"user_id"`
+}
+
+type CommentUnliked struct {
+	CommentID string `json:"comment_id"`
+	AuthorID  int    `json:"author_id"`
+	UserID    int    `json:"user_id"`
+}
+
+func (PostCreated) EventType() string    { return TypePostCreated }
+func (PostEdited) EventType() string     { return TypePostEdited }
+func (PostDeleted) EventType() string    { return TypePostDeleted }
+func (PostRestored) EventType() string   { return TypePostRestored }
+func (PostPurged) EventType() string     { return TypePostPurged }
+func (MediaAdded) EventType() string     { return TypeMediaAdded }
+func (PostLiked) EventType() string      { return TypePostLiked }
+func (PostUnliked) EventType() string    { return TypePostUnliked }
+func (CommentAdded) EventType() string   { return TypeCommentAdded }
+func (CommentEdited) EventType() string  { return TypeCommentEdited }
+func (CommentDeleted) EventType() string { return TypeCommentDeleted }
+func (CommentLiked) EventType() string   { return TypeCommentLiked }
+func (CommentUnliked) EventType() string { return TypeCommentUnliked }
+
+func (PostCreated) SchemaVersion() int    { return 1 }
+func (PostEdited) SchemaVersion() int     { return 1 }
+func (PostDeleted) SchemaVersion() int    { return 1 }
+func (PostRestored) SchemaVersion() int   { return 1 }
+func (PostPurged) SchemaVersion() int     { return 1 }
+func (MediaAdded) SchemaVersion() int     { return 1 }
+func (PostLiked) SchemaVersion() int      { return 1 }
+func (PostUnliked) SchemaVersion() int    { return 1 }
+func (CommentAdded) SchemaVersion() int   { return 1 }
+func (CommentEdited) SchemaVersion() int  { return 1 }
+func (CommentDeleted) SchemaVersion() int { return 1 }
+func (CommentLiked) SchemaVersion() int   { return 1 }
+func (CommentUnliked) SchemaVersion() int { return 1 }
@@ -0,0 +1,105 @@
+package events
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	_ EventPublisher = (*RedisStreams)(nil)
+	_ EventPublisher = (*Memory)(nil)
+)
+
+// RedisStreams appends events to a Redis stream, one entry per event with the
+// envelope's fields as the entry's fields. The stream is trimmed to roughly
+// MaxLen entries; consumers are expected to keep up through consumer groups.
+type RedisStreams struct {
+	Client *redis.Client
+	Stream string
+	MaxLen int64
+}
+
+func NewRedisStreams(client *redis.Client, stream string) *RedisStreams {
+	return &RedisStreams{Client: client, Stream: stream, MaxLen: 100000}
+}
+
+func (r *RedisStreams) Publish(ctx context.Context, events ...Event) error {
+	pipe := r.Client.Pipeline()
+	for _, event := range events {
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: r.Stream,
+			MaxLen: r.MaxLen,
+			Approx: true,
+			Values: map[string]interface{}{
+				"id":          event.ID,
+				"type":        event.Type,
+				"version":     strconv.Itoa(event.Version),
+				"occurred_at": event.OccurredAt.Format(time.RFC3339Nano),
+				"payload":     string(event.Payload),
+			},
+		})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// FromStream rebuilds an event from the fields of a stream entry written by
+// RedisStreams.
+func FromStream(values map[string]interface{}) (Event, error) {
+	field := func(name string) string {
+		value, _ := values[name].(string)
+		return value
+	}
+	version, err := strconv.Atoi(field("version"))
+	if err != nil {
+		return Event{}, err
+	}
+	occurredAt, err := time.Parse(time.RFC3339Nano, field("occurred_at"))
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{
+		ID:         field("id"),
+		Type:       field("type"),
+		Version:    version,
+		OccurredAt: occurredAt,
+		Payload:    []byte(field("payload")),
+	}, nil
+}
+
+// Memory keeps the last MaxLen published events in order, for tests and for
+// running without Redis.
+type Memory struct {
+	MaxLen int
+	mu     sync.Mutex
+	events []Event
+}
+
+func NewMemory() *Memory {
+	return &Memory{MaxLen: 10000}
+}
+
+func (m *Memory) Publish(ctx context.Context, events ...Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, events...)
+	// Trimming only once twice MaxLen have piled up keeps Publish amortised O(1).
+	if m.MaxLen > 0 && len(m.events) >= 2*m.MaxLen {
+		m.events = append([]Event(nil), m.events[len(m.events)-m.MaxLen:]...)
+	}
+	return nil
+}
+
+func (m *Memory) Events() []Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.events
+	if m.MaxLen > 0 && len(kept) > m.MaxLen {
+		kept = kept[len(kept)-m.MaxLen:]
+	}
+	return append([]Event(nil), kept...)
+}
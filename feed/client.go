@@ -0,0 +1,150 @@
+package feed
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	requestsTotal = expvar.NewInt("feed_requests_total")
+	failedTotal   = expvar.NewInt("feed_requests_failed_total")
+	openedTotal   = expvar.NewInt("feed_circuit_opened_total")
+)
+
+// StatusError is returned when the feed handler answers with a non-2xx
+// status. Body holds the start of the response body.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("feed handler returned %s", e.Status)
+	}
+	return fmt.Sprintf("feed handler returned %s: %s", e.Status, e.Body)
+}
+
+// Temporary reports whether the same request may succeed later: server
+// errors and 429s are, other client errors are not.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Client talks to the feed handler. Each request gets Timeout and is tried
+// up to Retries more times after a temporary failure, waiting a jittered,
+// doubling backoff in between. Breaker refuses requests with ErrCircuitOpen
+// while the feed handler keeps failing.
+type Client struct {
+	BaseURL    string
+	HTTP       *http.Client
+	Timeout    time.Duration
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Breaker    *Breaker
+}
+
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTP:       &http.Client{},
+		Timeout:    5 * time.Second,
+		Retries:    2,
+		Backoff:    100 * time.Millisecond,
+		MaxBackoff: 2 * time.Second,
+		Breaker:    NewBreaker(5, 30*time.Second),
+	}
+}
+
+// FanoutPost asks the feed handler to add post to its author's followers'
+// feeds with POST {BaseURL}/post.
+func (f *Client) FanoutPost(ctx context.Context, post interface{}) error {
+	payload, err := json.Marshal(post)
+	if err != nil {
+		return err
+	}
+	return f.post(ctx, "/post", payload)
+}
+
+func (f *Client) post(ctx context.Context, path string, payload []byte) error {
+	var err error
+	for attempt := 0; attempt <= f.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(f.backoff(attempt)):
+			}
+		}
+		if err = f.Breaker.Allow(); err != nil {
+			return err
+		}
+		err = f.do(ctx, path, payload)
+		if ctx.Err() != nil {
+			f.Breaker.Cancel()
+			return ctx.Err()
+		}
+		if err == nil || !temporary(err) {
+			f.Breaker.Success()
+			return err
+		}
+		failedTotal.Add(1)
+		f.Breaker.Failure()
+	}
+	return err
+}
+
+func (f *Client) do(ctx context.Context, path string, payload []byte) error {
+	requestsTotal.Add(1)
+	ctx, cancel := context.WithTimeout(ctx, f.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.BaseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := f.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return &StatusError{StatusCode: res.StatusCode, Status: res.Status, Body: strings.TrimSpace(string(body))}
+	}
+	io.Copy(io.Discard, res.Body)
+	return nil
+}
+
+// temporary treats every error other than a permanent StatusError as worth
+// retrying, timeouts and refused connections included.
+func temporary(err error) bool {
+	if status, ok := err.(*StatusError); ok {
+		return status.Temporary()
+	}
+	return true
+}
+
+func (f *Client) backoff(attempt int) time.Duration {
+	wait := f.Backoff
+	for i := 1; i < attempt && wait < f.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > f.MaxBackoff {
+		wait = f.MaxBackoff
+	}
+	if wait <= 1 {
+		return wait
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)))
+}
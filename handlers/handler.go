@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/directory"
+	"github.com/cal1co/movielogv2-postservice/entities"
+	"github.com/cal1co/movielogv2-postservice/events"
+	"github.com/cal1co/movielogv2-postservice/feed"
+	"github.com/cal1co/movielogv2-postservice/outbox"
+	cacheoperations "github.com/cal1co/movielogv2-postservice/rediscache"
+	"github.com/cal1co/movielogv2-postservice/search"
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/gocql/gocql"
+)
+
+// Handler holds what the HTTP handlers need to serve requests.
+type Handler struct {
+	Posts    store.PostStore
+	Comments store.CommentStore
+	Likes    store.LikeStore
+	Media    store.MediaStore
+	Trash    store.TrashStore
+	Tags     store.HashtagStore
+	Mentions store.MentionStore
+	// Outbox carries a new post's fanout, indexing and event.
+	Outbox store.OutboxStore
+	// Users resolves @mentions; without it mentions are left as plain text.
+	Users directory.Directory
+	// Feed receives fanout from the outbox.
+	Feed *feed.Client
+	// Events is told about every change once it is stored.
+	Events events.EventPublisher
+	// Search, when set, is kept up to date as posts change.
+	Search search.SearchBackend
+	// EditWindow limits how long after creation posts and comments can be
+	// edited; zero allows edits at any time.
+	EditWindow time.Duration
+	// TrashRetention is how long deleted posts can be restored.
+	TrashRetention time.Duration
+	// Trending lists the windows hashtags count towards.
+	Trending []cacheoperations.TrendingWindow
+}
+
+func NewHandler(s store.Store) *Handler {
+	return &Handler{
+		Posts:          s,
+		Comments:       s,
+		Likes:          s,
+		Media:          s,
+		Trash:          s,
+		Tags:           s,
+		Mentions:       s,
+		Outbox:         s,
+		Feed:           feed.NewClient("http://yuzu-feed-handler:8080"),
+		TrashRetention: 30 * 24 * time.Hour,
+		Trending:       cacheoperations.DefaultTrendingWindows(),
+	}
+}
+
+func (h *Handler) indexPost(doc search.Document) {
+	if h.Search != nil {
+		h.Search.IndexPost(doc)
+	}
+}
+
+func (h *Handler) unindexPost(id string) {
+	if h.Search != nil {
+		h.Search.DeletePost(id)
+	}
+}
+
+// recordHashtags counts the hashtags of new content towards trending. A
+// failure only costs the tags a little trending score, so it is just logged.
+func (h *Handler) recordHashtags(ctx context.Context, content string, at time.Time, cache cacheoperations.CounterCache) {
+	tags := entities.Hashtags(content)
+	if err := cacheoperations.RecordHashtags(tags, at, h.Trending, cache, ctx); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// resolveMentions finds the @mentions in content that name real users. If the
+// directory cannot be reached the content is saved without mentions rather
+// than failing the write.
+func (h *Handler) resolveMentions(ctx context.Context, content string) []store.Mention {
+	var found []entities.Entity
+	var names []string
+	for _, entity := range entities.Parse(content) {
+		if entity.Type == entities.Mention {
+			found = append(found, entity)
+			names = append(names, entity.Name)
+		}
+	}
+	if h.Users == nil || len(found) == 0 {
+		return nil
+	}
+	users, err := h.Users.Resolve(ctx, names)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	var mentions []store.Mention
+	for _, entity := range found {
+		if id, ok := users[entity.Name]; ok {
+			mentions = append(mentions, store.Mention{Username: entity.Name, UserID: id, Start: entity.Start, End: entity.End})
+		}
+	}
+	return mentions
+}
+
+// publish announces a stored change. The change has already happened, so a
+// failure to publish is logged rather than failing the request.
+func (h *Handler) publish(ctx context.Context, payload events.Payload) {
+	if h.Events == nil {
+		return
+	}
+	event, err := events.New(payload, time.Now())
+	if err == nil {
+		err = h.Events.Publish(ctx, event)
+	}
+	if err != nil {
+		fmt.Println("Error publishing", payload.EventType(), err)
+	}
+}
+
+// indexJob names the post to index. Jobs queued before it replaced a full
+// search.Document still decode, since the document has the same post_id.
+type indexJob struct {
+	PostID string `json:"post_id"`
+}
+
+// indexStoredPost indexes the post as it is stored now, so that a late retry
+// or a replayed job never brings back an edited, deleted or trashed version.
+func (h *Handler) indexStoredPost(ctx context.Context, postID string) error {
+	if h.Search == nil {
+		return nil
+	}
+	id, err := gocql.ParseUUID(postID)
+	if err != nil {
+		return err
+	}
+	record, err := h.Posts.GetPost(ctx, id)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	doc, err := search.LoadDocument(ctx, h.Media, h.Likes, h.Comments, record)
+	if err != nil {
+		return err
+	}
+	return h.Search.IndexPostNow(ctx, doc)
+}
+
+// Deliveries returns how the outbox relay carries out each kind of job this
+// handler queues.
+func (h *Handler) Deliveries() map[string]outbox.Deliver {
+	return map[string]outbox.Deliver{
+		outbox.KindFanout: func(ctx context.Context, payload []byte) error {
+			var post Post
+			if err := json.Unmarshal(payload, &post); err != nil {
+				return err
+			}
+			return h.Feed.FanoutPost(ctx, post)
+		},
+		outbox.KindIndex: func(ctx context.Context, payload []byte) error {
+			var job indexJob
+			if err := json.Unmarshal(payload, &job); err != nil {
+				return err
+			}
+			return h.indexStoredPost(ctx, job.PostID)
+		},
+		outbox.KindEvent: func(ctx context.Context, payload []byte) error {
+			var event events.Event
+			if err := json.Unmarshal(payload, &event); err != nil {
+				return err
+			}
+			if h.Events == nil {
+				return nil
+			}
+			return h.Events.Publish(ctx, event)
+		},
+	}
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+const defaultPageSize = 10
+const timelinePageSize = 15
+const maxPageSize = 50
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// Cursors are opaque to clients: whatever the store or ranking needs to resume,
+// base64 encoded. An empty cursor means the first page, or no next page.
+func encodeCursor(state []byte) string {
+	return base64.RawURLEncoding.EncodeToString(state)
+}
+func decodeCursor(cursor string) ([]byte, error) {
+	state, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	return state, nil
+}
+
+// timelineCursor accepts an RFC 3339 timestamp or a TimeUUID such as a post ID.
+func timelineCursor(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	id, err := gocql.ParseUUID(value)
+	if err != nil || id.Version() != 1 {
+		return time.Time{}, errInvalidCursor
+	}
+	return id.Time(), nil
+}
+
+// positionCursor is the next_cursor of a timeline page that ended with the
+// post or comment created at createdAt with id.
+func positionCursor(createdAt time.Time, id gocql.UUID) string {
+	return encodeCursor([]byte(createdAt.UTC().Format(time.RFC3339Nano) + " " + id.String()))
+}
+
+// postCursor is timelineCursor for timelines of posts and comments, which also
+// accepts a positionCursor. A post or comment id stands for where it is
+// stored, so that paging from it leaves it out and neither skips nor repeats
+// entries created at the same time.
+func postCursor(ctx context.Context, value string, cqlHandler *Handler) (store.TimelineCursor, error) {
+	t, err := timelineCursor(value)
+	if err == errInvalidCursor {
+		return decodePositionCursor(value)
+	}
+	if err != nil || t.IsZero() {
+		return store.TimelineCursor{}, err
+	}
+	id, err := gocql.ParseUUID(value)
+	if err != nil {
+		return store.TimelineCursor{CreatedAt: t}, nil
+	}
+	if post, err := cqlHandler.Posts.GetPost(ctx, id); err == nil {
+		t = post.CreatedAt
+	} else if comment, err := cqlHandler.Comments.GetComment(ctx, id); err == nil {
+		t = comment.CreatedAt
+	}
+	return store.TimelineCursor{CreatedAt: t, PostID: id}, nil
+}
+func decodePositionCursor(value string) (store.TimelineCursor, error) {
+	state, err := decodeCursor(value)
+	if err != nil {
+		return store.TimelineCursor{}, err
+	}
+	createdAt, id, ok := strings.Cut(string(state), " ")
+	if !ok {
+		return store.TimelineCursor{}, errInvalidCursor
+	}
+	cursor := store.TimelineCursor{}
+	if cursor.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+		return store.TimelineCursor{}, errInvalidCursor
+	}
+	if cursor.PostID, err = gocql.ParseUUID(id); err != nil {
+		return store.TimelineCursor{}, errInvalidCursor
+	}
+	return cursor, nil
+}
+
+// limitParam and pageParams read ?limit= and ?cursor= and answer 400 themselves
+// when they are invalid.
+func limitParam(c *gin.Context, fallback int) (int, bool) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(fallback)))
+	if err != nil || limit <= 0 || limit > maxPageSize {
+		c.JSON(http.StatusBadRequest, fmt.Sprintf("Sorry, limit must be between 1 and %d", maxPageSize))
+		return 0, false
+	}
+	return limit, true
+}
+func pageParams(c *gin.Context) ([]byte, int, bool) {
+	limit, ok := limitParam(c, defaultPageSize)
+	if !ok {
+		return nil, 0, false
+	}
+	cursor, err := decodeCursor(c.Query("cursor"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, "Sorry, the cursor is invalid")
+		return nil, 0, false
+	}
+	return cursor, limit, true
+}
@@ -1,30 +1,36 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/cal1co/movielogv2-postservice/events"
+	"github.com/cal1co/movielogv2-postservice/outbox"
 	cacheoperations "github.com/cal1co/movielogv2-postservice/rediscache"
-	"github.com/elastic/go-elasticsearch/v8"
-	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/cal1co/movielogv2-postservice/search"
+	"github.com/cal1co/movielogv2-postservice/store"
 	"github.com/gin-gonic/gin"
 	"github.com/gocql/gocql"
-	"github.com/redis/go-redis/v9"
 )
 
 type Post struct {
-	ID          gocql.UUID `json:"post_id"`
-	UserID      int        `json:"user_id"`
-	PostContent string     `json:"post_content"`
-	CreatedAt   time.Time  `json:"created_at"`
-	Likes       int        `json:"like_count"`
-	Comments    int        `json:"comments_count"`
+	ID          gocql.UUID  `json:"post_id"`
+	UserID      int         `json:"user_id"`
+	PostContent string      `json:"post_content"`
+	CreatedAt   time.Time   `json:"created_at"`
+	EditedAt    *time.Time  `json:"edited_at"`
+	DeletedAt   *time.Time  `json:"deleted_at,omitempty"`
+	ParentID    *gocql.UUID `json:"parent_id,omitempty"`
+	Mentions    []Mention   `json:"mentions"`
+	Likes       int         `json:"like_count"`
+	Comments    int         `json:"comments_count"`
 	Liked       bool
 	Media       []string `json:"media"`
 }
@@ -38,10 +44,21 @@ type Comment struct {
 	ParentID    gocql.UUID `json:"parent_id"`
 	PostContent string     `json:"comment_content"`
 	CreatedAt   time.Time  `json:"created_at"`
+	EditedAt    *time.Time `json:"edited_at"`
+	Mentions    []Mention  `json:"mentions"`
 	Likes       int        `json:"like_count"`
 	Comments    int        `json:"comments_count"`
 	Liked       bool       `json:"liked"`
 }
+
+// Mention links the characters from start up to end of the content to the
+// mentioned user.
+type Mention struct {
+	Username string `json:"username"`
+	UserID   int    `json:"user_id"`
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+}
 type PostInteraction struct {
 	PostId   gocql.UUID
 	Likes    int
@@ -59,20 +76,57 @@ func ThrowUserIDExtractError(c *gin.Context) {
 	c.JSON(http.StatusNotFound, "Couldn't extract uid")
 	c.AbortWithStatus(http.StatusBadRequest)
 }
-func CheckLikedByUser(uid string, postId string, cqlHandler *Handler) bool {
-
-	var likeCount int
-	if err := cqlHandler.Session.Query(`SELECT COUNT(*) FROM user_likes WHERE post_id=? AND user_id=?`, postId, uid).Scan(&likeCount); err != nil {
+func CheckLikedByUser(uid string, postId string, cqlHandler *Handler, cache cacheoperations.CounterCache) bool {
+	userID, err := strconv.Atoi(uid)
+	if err != nil {
 		fmt.Println("Error checking user likes:", err)
 		return false
 	}
-	if likeCount > 0 {
-		return true
-	} else {
-		return false
+	return cacheoperations.LikedByUser(postId, userID, cache, context.Background(), cqlHandler.Likes)
+}
+func postFromRecord(record store.Post) Post {
+	return Post{
+		ID:          record.ID,
+		UserID:      record.UserID,
+		PostContent: record.Content,
+		CreatedAt:   record.CreatedAt,
+		EditedAt:    editedAt(record.EditedAt),
+		DeletedAt:   editedAt(record.DeletedAt),
+		Mentions:    mentionsFromRecord(record.Mentions),
+	}
+}
+func commentFromRecord(record store.Comment) Comment {
+	return Comment{
+		ID:          record.ID,
+		UserID:      record.UserID,
+		ParentID:    record.ParentID,
+		PostContent: record.Content,
+		CreatedAt:   record.CreatedAt,
+		EditedAt:    editedAt(record.EditedAt),
+		Mentions:    mentionsFromRecord(record.Mentions),
+	}
+}
+func mentionsFromRecord(records []store.Mention) []Mention {
+	mentions := []Mention{}
+	for _, record := range records {
+		mentions = append(mentions, Mention(record))
+	}
+	return mentions
+}
+func documentFromPost(record store.Post, post Post) search.Document {
+	doc := search.NewDocument(record)
+	doc.Media = post.Media
+	doc.Likes = post.Likes
+	doc.Comments = post.Comments
+	return doc
+}
+func editedAt(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
 	}
+	return &t
 }
-func HandlePost(c *gin.Context, cqlHandler *Handler) {
+func HandlePost(c *gin.Context, cqlHandler *Handler, cache cacheoperations.CounterCache) {
 	userID, exists := c.Get("user_id")
 	if !exists {
 		ThrowUserIDExtractError(c)
@@ -91,43 +145,63 @@ func HandlePost(c *gin.Context, cqlHandler *Handler) {
 	post.Likes = 0
 	post.Comments = 0
 	post.CreatedAt = time.Now()
-	handleMediaPost(post, cqlHandler, c)
-
-	if err := cqlHandler.Session.Query(`INSERT INTO posts (post_id, user_id, post_content, created_at) VALUES (?, ?, ?, ?)`, post.ID, post.UserID, post.PostContent, time.Now()).Exec(); err != nil {
-		fmt.Println(err)
-		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, count not post with details %v, %d, %s", post.ID, post.UserID, post.PostContent))
-		c.AbortWithStatus(http.StatusInternalServerError)
+	if err := handleMediaPost(post, cqlHandler, c); err != nil {
 		return
 	}
 
-	err := fanoutPost(post)
+	record := store.Post{ID: post.ID, UserID: post.UserID, Content: post.PostContent, CreatedAt: post.CreatedAt}
+	record.Mentions = cqlHandler.resolveMentions(c.Request.Context(), post.PostContent)
+	post.Mentions = mentionsFromRecord(record.Mentions)
+	jobs, err := postCreatedJobs(post, record)
+	if err == nil {
+		err = cqlHandler.Posts.CreatePost(c.Request.Context(), record, jobs...)
+	}
 	if err != nil {
 		fmt.Println(err)
-		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, count not post with details %v, %d, %s", post.ID, post.UserID, post.PostContent))
-		c.AbortWithStatus(http.StatusInternalServerError)
+		c.JSON(http.StatusInternalServerError, fmt.Sprintf("Sorry, count not post with details %v, %d, %s", post.ID, post.UserID, post.PostContent))
+		c.Abort()
 		return
 	}
+	cqlHandler.recordHashtags(c.Request.Context(), post.PostContent, post.CreatedAt, cache)
 	c.JSON(http.StatusCreated, post)
 }
 
-func fanoutPost(post Post) error {
-	endpoint := "http://yuzu-feed-handler:8080/post"
-	payload, err := json.Marshal(post)
+// postCreatedJobs are the side effects of a new post, queued in the outbox
+// with it: the feed fanout, the search index and the post.created event.
+func postCreatedJobs(post Post, record store.Post) ([]store.OutboxJob, error) {
+	doc := search.NewDocument(record)
+	doc.Media = post.Media
+	event, err := events.New(events.PostCreated{
+		PostID:    post.ID.String(),
+		AuthorID:  post.UserID,
+		Content:   post.PostContent,
+		Hashtags:  doc.Hashtags,
+		Mentioned: store.MentionedUsers(record.Mentions),
+		Media:     post.Media,
+		CreatedAt: post.CreatedAt,
+	}, post.CreatedAt)
 	if err != nil {
-		fmt.Println(err)
-		return fmt.Errorf("error adding post to user feeds - json error")
+		return nil, err
 	}
-	res, err := http.Post(endpoint, "application/json", bytes.NewBuffer(payload))
-	if err != nil {
-		fmt.Println(err)
-		return fmt.Errorf("error adding post to user feeds - post error")
+	var jobs []store.OutboxJob
+	for _, side := range []struct {
+		kind    string
+		payload interface{}
+	}{
+		{outbox.KindFanout, post},
+		{outbox.KindIndex, indexJob{PostID: post.ID.String()}},
+		{outbox.KindEvent, event},
+	} {
+		job, err := outbox.NewJob(side.kind, side.payload, post.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
 	}
-	defer res.Body.Close()
-
-	fmt.Println("Response status code:", res.StatusCode)
-	return nil
+	return jobs, nil
 }
-func HandleComment(c *gin.Context, cqlHandler *Handler, redisClient *redis.Client, isComment bool) {
+
+func HandleComment(c *gin.Context, cqlHandler *Handler, cache cacheoperations.CounterCache, isComment bool) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	var comment Comment
@@ -148,34 +222,62 @@ func HandleComment(c *gin.Context, cqlHandler *Handler, redisClient *redis.Clien
 	parentId, err := gocql.ParseUUID(c.Param("id"))
 	if err != nil {
 		fmt.Println(err)
+		c.JSON(http.StatusNotFound, "Error commenting")
+		return
 	}
 	comment.ParentID = parentId
 
 	var parent string
 	if isComment {
-		if err := cqlHandler.Session.Query(`select parent_post_id from post_comments where comment_id=?`, parentId).Scan(&parent); err != nil {
+		parentComment, err := cqlHandler.Comments.GetComment(ctx, parentId)
+		if err == store.ErrNotFound {
+			c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, comment with id '%s' could not be found", parentId))
+			return
+		}
+		if err != nil {
 			fmt.Println("error checking likes", err)
 			c.JSON(http.StatusInternalServerError, "Sorry, could not check if user has liked post.")
 			return
 		}
+		parent = parentComment.ParentID.String()
 	} else {
+		if _, err := cqlHandler.Posts.GetPost(ctx, parentId); err == store.ErrNotFound {
+			c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, post with id '%s' could not be found", parentId))
+			return
+		} else if err != nil {
+			fmt.Println(err)
+			c.JSON(http.StatusInternalServerError, "Error commenting")
+			return
+		}
 		parent = "null"
 	}
 
-	if err := cqlHandler.Session.Query(`INSERT INTO post_comments (comment_id, user_id, parent_post_id, comment_content, created_at) VALUES (?, ?, ?, ?, ?)`, comment.ID, comment.UserID, comment.ParentID, comment.PostContent, time.Now()).Exec(); err != nil {
+	comment.CreatedAt = time.Now()
+	record := store.Comment{ID: comment.ID, UserID: comment.UserID, ParentID: comment.ParentID, Content: comment.PostContent, CreatedAt: comment.CreatedAt}
+	record.Mentions = cqlHandler.resolveMentions(ctx, comment.PostContent)
+	if err := cqlHandler.Comments.CreateComment(ctx, record); err != nil {
 		fmt.Println(err)
-		c.JSON(http.StatusNotFound, "Error commenting")
+		c.JSON(http.StatusInternalServerError, "Error commenting")
 		return
 	}
 	comment.Likes = 0
 	comment.Comments = 0
+	cqlHandler.recordHashtags(ctx, comment.PostContent, comment.CreatedAt, cache)
+	cqlHandler.publish(ctx, events.CommentAdded{
+		CommentID: comment.ID.String(),
+		ParentID:  comment.ParentID.String(),
+		AuthorID:  comment.UserID,
+		Content:   comment.PostContent,
+		Mentioned: store.MentionedUsers(record.Mentions),
+		CreatedAt: comment.CreatedAt,
+	})
 
-	cacheoperations.Comment(comment.ParentID.String(), redisClient, ctx, c, cqlHandler.Session, parent)
-	comment_count := cacheoperations.GetPostComments(comment.ParentID.String(), redisClient, ctx, cqlHandler.Session)
+	comment_count := cacheoperations.Comment(comment.ParentID.String(), cache, ctx, cqlHandler.Comments, isComment, parent)
+	cacheoperations.AddCommentRankings(comment.ParentID.String(), comment.ID.String(), comment.CreatedAt, cache, ctx)
 
 	c.JSON(http.StatusCreated, comment_count)
 }
-func HandleUnlike(c *gin.Context, comment bool, cqlHandler *Handler, redisClient *redis.Client) {
+func HandleUnlike(c *gin.Context, comment bool, cqlHandler *Handler, cache cacheoperations.CounterCache) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	post_id := c.Param("id")
@@ -185,40 +287,62 @@ func HandleUnlike(c *gin.Context, comment bool, cqlHandler *Handler, redisClient
 		return
 	}
 	uid := int(userID.(float64))
-	var parent string
-	if comment {
-		if err := cqlHandler.Session.Query(`select parent_post_id from post_comments where comment_id=?`, post_id).Scan(&parent); err != nil {
-			fmt.Println("error checking likes", err)
-			c.JSON(http.StatusInternalServerError, "Sorry, could not check if user has liked post.")
-			return
-		}
-	} else {
-		parent = ""
-	}
-
-	var likeCount int
-	if err := cqlHandler.Session.Query(`SELECT COUNT(*) FROM user_likes WHERE post_id=? AND user_id=?`, post_id, uid).Scan(&likeCount); err != nil {
-		fmt.Println("Error checking user likes:", err)
-		c.JSON(http.StatusInternalServerError, "Sorry, could not check if user has liked post.")
+	postID, err := gocql.ParseUUID(post_id)
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, could not unlike post with id %s", post_id))
 		return
 	}
-	if likeCount == 0 {
-		c.JSON(http.StatusBadRequest, "Sorry, you have not liked this post yet.")
+	parent, err := likeParent(ctx, comment, "", postID, cqlHandler)
+	if err != nil {
+		fmt.Println("error checking likes", err)
+		c.JSON(http.StatusInternalServerError, "Sorry, could not check if user has liked post.")
 		return
 	}
 
-	likes := cacheoperations.Unlike(post_id, redisClient, ctx, c, cqlHandler.Session, comment, parent)
-
-	if err := cqlHandler.Session.Query(`DELETE FROM user_likes WHERE user_id=? AND post_id=?`, uid, post_id).Exec(); err != nil {
+	changed, err := cqlHandler.Likes.RemoveLike(ctx, uid, postID)
+	if err != nil {
 		fmt.Println(err)
 		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, could not unlike post with id %s", post_id))
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	if !changed {
+		c.JSON(http.StatusBadRequest, "Sorry, you have not liked this post yet.")
+		return
+	}
 
+	likes := cacheoperations.Unlike(post_id, uid, cache, ctx, cqlHandler.Likes, comment, parent)
+	author := authorOf(ctx, comment, postID, cqlHandler)
+	if comment {
+		cqlHandler.publish(ctx, events.CommentUnliked{CommentID: post_id, AuthorID: author, UserID: uid})
+	} else {
+		cqlHandler.publish(ctx, events.PostUnliked{PostID: post_id, AuthorID: author, UserID: uid})
+	}
 	c.JSON(http.StatusOK, likes)
 }
-func HandleLike(c *gin.Context, comment bool, cqlHandler *Handler, redisClient *redis.Client) {
+func likeParent(ctx context.Context, comment bool, fallback string, id gocql.UUID, cqlHandler *Handler) (string, error) {
+	if !comment {
+		return fallback, nil
+	}
+	parent, err := cqlHandler.Comments.GetComment(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return parent.ParentID.String(), nil
+}
+
+// authorOf looks up who wrote a post or comment for an event about it, or 0
+// if it cannot be read.
+func authorOf(ctx context.Context, comment bool, id gocql.UUID, cqlHandler *Handler) int {
+	post, err := findPost(ctx, comment, id.String(), cqlHandler)
+	if err != nil {
+		fmt.Println(err)
+		return 0
+	}
+	return post.UserID
+}
+func HandleLike(c *gin.Context, comment bool, cqlHandler *Handler, cache cacheoperations.CounterCache) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	post_id := c.Param("id")
@@ -228,115 +352,113 @@ func HandleLike(c *gin.Context, comment bool, cqlHandler *Handler, redisClient *
 		return
 	}
 	uid := int(userID.(float64))
-	var parent string
-	if comment {
-		if err := cqlHandler.Session.Query(`select parent_post_id from post_comments where comment_id=?`, post_id).Scan(&parent); err != nil {
-			fmt.Println("error checking likes", err)
-			c.JSON(http.StatusInternalServerError, "Sorry, could not check if user has liked post.")
-			return
-		}
-	} else {
-		parent = "null"
+	postID, err := gocql.ParseUUID(post_id)
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, could not like post with id %s", post_id))
+		return
 	}
-
-	var likeCount int
-	if err := cqlHandler.Session.Query(`SELECT COUNT(*) FROM user_likes WHERE post_id=? AND user_id=?`, post_id, uid).Scan(&likeCount); err != nil {
-		fmt.Println("Error checking user likes:", err)
-		c.JSON(http.StatusInternalServerError, "Sorry, could not check if user has liked post.")
+	parent, err := likeParent(ctx, comment, "null", postID, cqlHandler)
+	if err == nil && !comment {
+		_, err = cqlHandler.Posts.GetPost(ctx, postID)
+	}
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, post with id '%s' could not be found", post_id))
 		return
 	}
-	if likeCount > 0 {
-		c.JSON(http.StatusBadRequest, "Sorry, you have already liked this post.")
+	if err != nil {
+		fmt.Println("error checking likes", err)
+		c.JSON(http.StatusInternalServerError, "Sorry, could not check if user has liked post.")
 		return
 	}
 
-	likes := cacheoperations.Like(post_id, redisClient, ctx, c, cqlHandler.Session, comment, parent)
-
-	if err := cqlHandler.Session.Query(`INSERT INTO user_likes (user_id, post_id, created_at) VALUES (?, ?, ?)`, uid, post_id, time.Now()).Exec(); err != nil {
+	changed, err := cqlHandler.Likes.AddLike(ctx, uid, postID, time.Now())
+	if err != nil {
 		fmt.Println(err)
 		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, could not like post with id %s", post_id))
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	if !changed {
+		c.JSON(http.StatusBadRequest, "Sorry, you have already liked this post.")
+		return
+	}
 
-	c.JSON(http.StatusOK, likes)
-}
-func HandlePostGet(c *gin.Context, comment bool, cqlHandler *Handler, redisClient *redis.Client) (Post, error) {
-	post_id := c.Param("id")
-	var query string
+	likes := cacheoperations.Like(post_id, uid, cache, ctx, cqlHandler.Likes, comment, parent)
+	author := authorOf(ctx, comment, postID, cqlHandler)
 	if comment {
-		query = `SELECT comment_id, user_id, comment_content, created_at FROM post_comments WHERE comment_id = ? LIMIT 1`
+		cqlHandler.publish(ctx, events.CommentLiked{CommentID: post_id, AuthorID: author, UserID: uid})
 	} else {
-		query = `SELECT post_id, user_id, post_content, created_at FROM posts WHERE post_id = ? LIMIT 1`
+		cqlHandler.publish(ctx, events.PostLiked{PostID: post_id, AuthorID: author, UserID: uid})
 	}
-	var post Post
-	if err := cqlHandler.Session.Query(query, post_id).Consistency(gocql.One).Scan(&post.ID, &post.UserID, &post.PostContent, &post.CreatedAt); err != nil {
+	c.JSON(http.StatusOK, likes)
+}
+func HandlePostGet(c *gin.Context, comment bool, cqlHandler *Handler, cache cacheoperations.CounterCache) (Post, error) {
+	post_id := c.Param("id")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	post, err := findPost(ctx, comment, post_id, cqlHandler)
+	if err != nil {
 		fmt.Println(err)
 		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, post with id '%s' could not be found", post_id))
 		c.AbortWithStatus(http.StatusNotFound)
 		return post, fmt.Errorf("couldn't find post: %s", post_id)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	like_count := cacheoperations.GetPostLikes(post_id, redisClient, ctx, cqlHandler.Session)
+	like_count := cacheoperations.GetPostLikes(post_id, cache, ctx, cqlHandler.Likes)
 	post.Likes = like_count
-	comment_count := cacheoperations.GetPostComments(post_id, redisClient, ctx, cqlHandler.Session)
+	comment_count := cacheoperations.GetPostComments(post_id, cache, ctx, cqlHandler.Comments)
 	post.Comments = comment_count
 	post.Media = GetPostMedia(post.ID, cqlHandler)
 	c.JSON(http.StatusOK, post)
 	return post, nil
 }
-func GetPost(c *gin.Context, comment bool, cqlHandler *Handler, redisClient *redis.Client, post_id string, uid string) (Post, error) {
-
-	query := `SELECT post_id, user_id, post_content, created_at FROM posts WHERE post_id = ? LIMIT 1`
-	var post Post
-	if err := cqlHandler.Session.Query(query, post_id).Consistency(gocql.One).Scan(&post.ID, &post.UserID, &post.PostContent, &post.CreatedAt); err != nil {
+func findPostRecord(ctx context.Context, post_id string, cqlHandler *Handler) (store.Post, error) {
+	id, err := gocql.ParseUUID(post_id)
+	if err != nil {
+		return store.Post{}, err
+	}
+	return cqlHandler.Posts.GetPost(ctx, id)
+}
+func findPost(ctx context.Context, comment bool, post_id string, cqlHandler *Handler) (Post, error) {
+	id, err := gocql.ParseUUID(post_id)
+	if err != nil {
+		return Post{}, err
+	}
+	if comment {
+		record, err := cqlHandler.Comments.GetComment(ctx, id)
+		if err != nil {
+			return Post{}, err
+		}
+		return Post{ID: record.ID, UserID: record.UserID, PostContent: record.Content, CreatedAt: record.CreatedAt, EditedAt: editedAt(record.EditedAt), Mentions: mentionsFromRecord(record.Mentions)}, nil
+	}
+	record, err := cqlHandler.Posts.GetPost(ctx, id)
+	if err != nil {
+		return Post{}, err
+	}
+	return postFromRecord(record), nil
+}
+func GetPost(c *gin.Context, comment bool, cqlHandler *Handler, cache cacheoperations.CounterCache, post_id string, uid string) (Post, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	post, err := findPost(ctx, false, post_id, cqlHandler)
+	if err != nil {
 		fmt.Println(err)
 		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, post with id '%s' could not be found", post_id))
 		c.AbortWithStatus(http.StatusNotFound)
 		return post, fmt.Errorf("couldn't find post: %s", post_id)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	like_count := cacheoperations.GetPostLikes(post_id, redisClient, ctx, cqlHandler.Session)
+	like_count := cacheoperations.GetPostLikes(post_id, cache, ctx, cqlHandler.Likes)
 	post.Likes = like_count
-	post.Liked = CheckLikedByUser(uid, post.ID.String(), cqlHandler)
-	comment_count := cacheoperations.GetPostComments(post_id, redisClient, ctx, cqlHandler.Session)
+	post.Liked = CheckLikedByUser(uid, post.ID.String(), cqlHandler, cache)
+	comment_count := cacheoperations.GetPostComments(post_id, cache, ctx, cqlHandler.Comments)
 	post.Comments = comment_count
 	post.Media = GetPostMedia(post.ID, cqlHandler)
 	return post, nil
 }
-func GetComment(c *gin.Context, comment bool, session Handler, redisClient *redis.Client) {
-
-}
-func GetUserPosts(c *gin.Context, cqlHandler *Handler, redisClient *redis.Client) {
-	uid := c.Param("id")
-	var posts []PostRes
-	iter := cqlHandler.Session.Query(`SELECT post_id, post_content, created_at, user_id FROM posts WHERE user_id = ? AND created_at < ? LIMIT 12;`, uid, time.Now()).Iter()
-	var post PostRes
-	for iter.Scan(&post.ID, &post.PostContent, &post.CreatedAt, &post.UserID) {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-
-		like_count := cacheoperations.GetPostLikes(post.ID.String(), redisClient, ctx, cqlHandler.Session)
-		comment_count := cacheoperations.GetPostComments(post.ID.String(), redisClient, ctx, cqlHandler.Session)
-		post.Likes = like_count
-		post.Comments = comment_count
-
-		post.Liked = CheckLikedByUser(uid, post.ID.String(), cqlHandler)
-
-		posts = append(posts, post)
-	}
-	if err := iter.Close(); err != nil {
-		fmt.Println(err)
-		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, could not fetch post results for user with id %v", uid))
-		c.AbortWithStatus(http.StatusNotFound)
-	}
+func GetComment(c *gin.Context, comment bool, session Handler, cache cacheoperations.CounterCache) {
 
-	c.JSON(http.StatusOK, posts)
-	return
 }
-func GetPostComments(c *gin.Context, cqlHandler *Handler, redisClient *redis.Client) {
+func GetPostComments(c *gin.Context, cqlHandler *Handler, cache cacheoperations.CounterCache) {
 	post_id := c.Param("id")
 	user_id, exists := c.Get("user_id")
 	if !exists {
@@ -356,34 +478,106 @@ func GetPostComments(c *gin.Context, cqlHandler *Handler, redisClient *redis.Cli
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
-	var comments []Comment
-	iter := cqlHandler.Session.Query(`SELECT comment_id, comment_content, created_at, user_id FROM post_comments WHERE parent_post_id = ? LIMIT 10;`, post_id).Iter()
-	var comment Comment
 	uuid, err := gocql.ParseUUID(post_id)
 	if err != nil {
 		fmt.Println(err)
 		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, could not fetch comments results for post with id %v", post_id))
 		c.AbortWithStatus(http.StatusNotFound)
+		return
 	}
-	for iter.Scan(&comment.ID, &comment.PostContent, &comment.CreatedAt, &comment.UserID) {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		comment.ParentID = uuid
-		comment.Likes = cacheoperations.GetPostLikes(comment.ID.String(), redisClient, ctx, cqlHandler.Session)
-		comment.Comments = cacheoperations.GetPostComments(comment.ID.String(), redisClient, ctx, cqlHandler.Session)
-		comment.Liked = CheckLikedByUser(uid, comment.ID.String(), cqlHandler)
-		comments = append(comments, comment)
+	cursor, limit, ok := pageParams(c)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var records []store.Comment
+	var next []byte
+	if order := c.Query("sort"); order != "" {
+		ranking, ok := commentRankings[order]
+		if !ok {
+			c.JSON(http.StatusBadRequest, fmt.Sprintf("Sorry, cannot sort comments by '%s'", order))
+			return
+		}
+		records, next, err = rankedComments(ctx, post_id, ranking, cursor, limit, cqlHandler, cache)
+	} else {
+		records, next, err = cqlHandler.Comments.PageComments(ctx, uuid, cursor, limit)
+	}
+	if err == errInvalidCursor {
+		c.JSON(http.StatusBadRequest, "Sorry, the cursor is invalid")
+		return
 	}
-	if err := iter.Close(); err != nil {
+	if err != nil {
 		fmt.Println(err)
 		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, could not fetch comments results for post with id %v", post_id))
 		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	comments := []Comment{}
+	for _, record := range records {
+		comment := commentFromRecord(record)
+		comment.Likes = cacheoperations.GetPostLikes(comment.ID.String(), cache, ctx, cqlHandler.Likes)
+		comment.Comments = cacheoperations.GetPostComments(comment.ID.String(), cache, ctx, cqlHandler.Comments)
+		comment.Liked = CheckLikedByUser(uid, comment.ID.String(), cqlHandler, cache)
+		comments = append(comments, comment)
 	}
 
-	c.JSON(http.StatusOK, comments)
-	return
+	c.JSON(http.StatusOK, CommentPage{Comments: comments, NextCursor: encodeCursor(next)})
+}
+
+type CommentPage struct {
+	Comments   []Comment `json:"comments"`
+	NextCursor string    `json:"next_cursor"`
+}
+
+type commentRanking func(string, cacheoperations.CounterCache, context.Context, int, int) ([]string, error)
+
+var commentRankings = map[string]commentRanking{
+	"top":          cacheoperations.GetRankingByLikes,
+	"newest":       cacheoperations.GetRankingByDateLatest,
+	"oldest":       cacheoperations.GetRankingByDateEarliest,
+	"most_replied": cacheoperations.GetRankingByComments,
+}
+
+// rankedComments pages through a ranking; its cursor is the offset of the next page.
+func rankedComments(ctx context.Context, post_id string, ranking commentRanking, cursor []byte, limit int, cqlHandler *Handler, cache cacheoperations.CounterCache) ([]store.Comment, []byte, error) {
+	offset := 0
+	if len(cursor) > 0 {
+		var err error
+		if offset, err = strconv.Atoi(string(cursor)); err != nil || offset < 0 {
+			return nil, nil, errInvalidCursor
+		}
+	}
+	if err := cacheoperations.LoadCommentRankings(post_id, cache, ctx, cqlHandler.Comments, cqlHandler.Likes); err != nil {
+		return nil, nil, err
+	}
+	ids, err := ranking(post_id, cache, ctx, offset, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	var records []store.Comment
+	for _, id := range ids {
+		commentID, err := gocql.ParseUUID(id)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		record, err := cqlHandler.Comments.GetComment(ctx, commentID)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		records = append(records, record)
+	}
+	var next []byte
+	if len(ids) == limit {
+		next = []byte(strconv.Itoa(offset + limit))
+	}
+	return records, next, nil
 }
-func HandleFeedPosts(c *gin.Context, cqlHandler *Handler, redisClient *redis.Client) {
+func HandleFeedPosts(c *gin.Context, cqlHandler *Handler, cache cacheoperations.CounterCache) {
 	uid := c.Param("id")
 	var postList []gocql.UUID
 	if err := c.BindJSON(&postList); err != nil {
@@ -393,7 +587,7 @@ func HandleFeedPosts(c *gin.Context, cqlHandler *Handler, redisClient *redis.Cli
 	}
 	var posts []Post
 	for i := 0; i < len(postList); i++ {
-		post, err := GetPost(c, false, cqlHandler, redisClient, postList[i].String(), uid)
+		post, err := GetPost(c, false, cqlHandler, cache, postList[i].String(), uid)
 		if err != nil {
 			fmt.Println(err)
 		}
@@ -402,14 +596,7 @@ func HandleFeedPosts(c *gin.Context, cqlHandler *Handler, redisClient *redis.Cli
 	c.JSON(http.StatusOK, posts)
 }
 
-type CommentBatchDelete struct {
-	comment_id string
-	user_id    string
-	created_at time.Time
-	parent     string
-}
-
-func HandlePostDelete(c *gin.Context, cqlHandler *Handler, redisClient *redis.Client, es *elasticsearch.Client) {
+func HandlePostDelete(c *gin.Context, cqlHandler *Handler, cache cacheoperations.CounterCache) {
 	userID, exists := c.Get("user_id")
 	if !exists {
 		ThrowUserIDExtractError(c)
@@ -418,195 +605,491 @@ func HandlePostDelete(c *gin.Context, cqlHandler *Handler, redisClient *redis.Cl
 	uid := int(userID.(float64))
 	postId := c.Param("id")
 
-	var parentCreateTime time.Time
-	var commentList []CommentBatchDelete
-
-	iter := cqlHandler.Session.Query(`SELECT created_at FROM posts WHERE user_id=? and post_id=?`, uid, postId).Iter()
-	for iter.Scan(&parentCreateTime) {
-		fmt.Println("post with id:", parentCreateTime)
-		commentList = getAllCommentDependents(postId, cqlHandler)
-	}
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	b := cqlHandler.Session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
-	b.Entries = append(b.Entries, gocql.BatchEntry{
-		Stmt:       "DELETE FROM posts WHERE post_id=? AND user_id=? and created_at=?;",
-		Args:       []interface{}{postId, uid, parentCreateTime},
-		Idempotent: true,
-	})
-	b.Entries = append(b.Entries, gocql.BatchEntry{
-		Stmt:       "DELETE FROM post_interactions WHERE post_id=?;",
-		Args:       []interface{}{postId},
-		Idempotent: true,
-	})
-	for i := 0; i < len(commentList); i++ {
-		b.Entries = append(b.Entries, gocql.BatchEntry{
-			Stmt:       "DELETE FROM post_comments WHERE comment_id=? AND user_id=? and parent_post_id=?;",
-			Args:       []interface{}{commentList[i].comment_id, commentList[i].user_id, commentList[i].parent},
-			Idempotent: true,
-		})
-		b.Entries = append(b.Entries, gocql.BatchEntry{
-			Stmt:       "DELETE FROM post_interactions WHERE post_id=?;",
-			Args:       []interface{}{commentList[i].comment_id},
-			Idempotent: true,
-		})
-	}
-	err := cqlHandler.Session.ExecuteBatch(b)
+	id, err := gocql.ParseUUID(postId)
 	if err != nil {
 		fmt.Println(err)
 		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
+	post, err := cqlHandler.Posts.GetPost(ctx, id)
+	if err != nil || post.UserID != uid {
+		fmt.Println(err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	commentList := getAllCommentDependents(ctx, id, cqlHandler)
+	deletedAt := time.Now()
+	if err := cqlHandler.Trash.TrashPost(ctx, post, commentList, deletedAt); err != nil {
+		fmt.Println(err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	cqlHandler.publish(ctx, events.PostDeleted{PostID: postId, AuthorID: uid, DeletedAt: deletedAt})
+	if err := cacheoperations.ClearPostCache(postId, cache, ctx); err != nil {
+		fmt.Println(err)
+	}
+	for _, comment := range commentList {
+		if err := cacheoperations.ClearPostCache(comment.ID.String(), cache, ctx); err != nil {
+			fmt.Println(err)
+		}
+	}
 
-	req := esapi.DeleteRequest{
-		Index:      "posts",
-		DocumentID: postId,
+	cqlHandler.unindexPost(postId)
+	c.JSON(http.StatusOK, fmt.Sprintf("Deleted post with id %s", postId))
+}
+func HandleCommentDelete(c *gin.Context, cqlHandler *Handler, cache cacheoperations.CounterCache) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		ThrowUserIDExtractError(c)
+		return
 	}
+	uid := int(userID.(float64))
+	commentId := c.Param("id")
 
-	res, err := req.Do(context.Background(), es)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	id, err := gocql.ParseUUID(commentId)
 	if err != nil {
-		fmt.Printf("Error deleting document: %s\n", err)
+		fmt.Println(err)
+		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
-
-	if res.IsError() {
-		fmt.Printf("Error deleting document: %s\n", res.Status())
+	comment, err := cqlHandler.Comments.GetComment(ctx, id)
+	if err != nil || comment.UserID != uid {
+		fmt.Println(err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	replies := getAllCommentDependents(ctx, id, cqlHandler)
+	deletedComment, err := cqlHandler.Comments.DeleteComment(ctx, comment, replies)
+	if err != nil || !deletedComment {
+		fmt.Println(err)
+		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
+	deleted := events.CommentDeleted{CommentID: commentId, ParentID: comment.ParentID.String(), AuthorID: uid, Replies: []string{}}
+	for _, reply := range replies {
+		deleted.Replies = append(deleted.Replies, reply.ID.String())
+	}
+	cqlHandler.publish(ctx, deleted)
 
-	c.JSON(http.StatusOK, fmt.Sprintf("Deleted post with id %s", postId))
+	parentId := comment.ParentID.String()
+	parent, err := cqlHandler.Comments.GetComment(ctx, comment.ParentID)
+	onComment := err == nil
+	cacheoperations.DeleteComment(parentId, cache, ctx, cqlHandler.Comments, onComment, parent.ParentID.String())
+	if err := cacheoperations.RemoveCommentRankings(parentId, commentId, cache, ctx); err != nil {
+		fmt.Println(err)
+	}
+	for _, deleted := range append(replies, comment) {
+		if err := cacheoperations.ClearPostCache(deleted.ID.String(), cache, ctx); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	c.JSON(http.StatusOK, fmt.Sprintf("Deleted comment with id %s", commentId))
 }
-func getAllCommentDependents(post_id string, cqlHandler *Handler) []CommentBatchDelete {
-	var comments []CommentBatchDelete
-	var comment CommentBatchDelete
+func getAllCommentDependents(ctx context.Context, post_id gocql.UUID, cqlHandler *Handler) []store.Comment {
+	var comments []store.Comment
 
-	iter := cqlHandler.Session.Query(`select comment_id, created_at, user_id, parent_post_id from post_comments where parent_post_id=?`, post_id).Iter()
-	for iter.Scan(&comment.comment_id, &comment.created_at, &comment.user_id, &comment.parent) {
-		comments = append(comments, comment)
-		comments = append(comments, getAllCommentDependents(comment.comment_id, cqlHandler)...)
-	}
-	if err := iter.Close(); err != nil {
+	replies, err := cqlHandler.Comments.ListComments(ctx, post_id, 0)
+	if err != nil {
 		fmt.Println(err)
 	}
+	for _, comment := range replies {
+		comments = append(comments, comment)
+		comments = append(comments, getAllCommentDependents(ctx, comment.ID, cqlHandler)...)
+	}
 	return comments
 }
 
-type Search struct {
-	Query string
+// SearchRequest pages either with from/size or, for deep pages, with the
+// next_cursor of the previous page passed back as search_after.
+type SearchRequest struct {
+	search.Request
+	SearchAfter string `json:"search_after"`
+}
+type SearchResult struct {
+	Post
+	Highlights []string `json:"highlights"`
+}
+type SearchPage struct {
+	Results    []SearchResult `json:"results"`
+	Total      int            `json:"total"`
+	NextCursor string         `json:"next_cursor"`
 }
 
-func HandleSearch(c *gin.Context, es *elasticsearch.Client) {
-
-	var search Search
-	if err := c.BindJSON(&search); err != nil {
+func HandleSearch(c *gin.Context, cqlHandler *Handler, cache cacheoperations.CounterCache) {
+	var req SearchRequest
+	if err := c.BindJSON(&req); err != nil {
 		fmt.Println(err)
 		throwError("ERROR WITH JSON UNMARSHAL", c)
 		return
 	}
-
-	fmt.Printf("%s\n", search)
-	query := map[string]interface{}{
-		"query": map[string]interface{}{
-			"match": map[string]interface{}{
-				"post_content": map[string]interface{}{
-					"query":     search.Query,
-					"fuzziness": "AUTO",
-				},
-			},
-		},
-		"highlight": map[string]interface{}{
-			"fields": map[string]interface{}{
-				"post_content": struct{}{},
-			},
-		},
-	}
-
-	queryJSON, err := json.Marshal(query)
-	if err != nil {
-		fmt.Printf("Error marshaling query: %s\n", err)
+	if !search.ValidSort(req.Sort) {
+		c.JSON(http.StatusBadRequest, "Sorry, sort must be one of relevance, recency or likes")
 		return
 	}
-	fmt.Println(queryJSON)
-
-	req := esapi.SearchRequest{
-		Index: []string{"posts"},
-		Body:  bytes.NewReader(queryJSON),
+	if req.Size == 0 {
+		req.Size = defaultPageSize
 	}
-
-	res, err := req.Do(context.Background(), es)
-	if err != nil {
-		fmt.Printf("Error performing search request: %s\n", err)
+	if req.Size < 0 || req.Size > maxPageSize || req.From < 0 {
+		c.JSON(http.StatusBadRequest, fmt.Sprintf("Sorry, size must be between 1 and %d", maxPageSize))
 		return
 	}
-
-	if res.IsError() {
-		fmt.Printf("Error executing search: %s\n", res.Status())
-		return
+	if req.SearchAfter != "" {
+		state, err := decodeCursor(req.SearchAfter)
+		if err == nil {
+			err = json.Unmarshal(state, &req.After)
+		}
+		if err != nil || len(req.After) == 0 || req.From != 0 {
+			c.JSON(http.StatusBadRequest, "Sorry, the cursor is invalid")
+			return
+		}
 	}
 
-	var result map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
-		fmt.Printf("Error parsing search response: %s\n", err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results, err := cqlHandler.Search.Search(ctx, req.Request)
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, "Sorry, search is unavailable right now")
+		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
-
-	hits, found := result["hits"].(map[string]interface{})["hits"].([]interface{})
-	if !found || len(hits) == 0 {
-		fmt.Println("No results found.")
+	page := SearchPage{Results: []SearchResult{}, Total: results.Total}
+	for _, hit := range results.Hits {
+		id, err := gocql.ParseUUID(hit.PostID)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		post := Post{
+			ID:          id,
+			UserID:      hit.UserID,
+			PostContent: hit.PostContent,
+			CreatedAt:   hit.CreatedAt,
+			EditedAt:    hit.EditedAt,
+			Media:       hit.Media,
+		}
+		post.Likes = cacheoperations.GetPostLikes(hit.PostID, cache, ctx, cqlHandler.Likes)
+		post.Comments = cacheoperations.GetPostComments(hit.PostID, cache, ctx, cqlHandler.Comments)
+		page.Results = append(page.Results, SearchResult{Post: post, Highlights: hit.Highlights})
+	}
+	if len(results.Hits) == req.Size {
+		last, err := json.Marshal(results.Hits[len(results.Hits)-1].Sort)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			page.NextCursor = encodeCursor(last)
+		}
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+const suggestPageSize = 5
+const maxSuggestions = 10
+const maxSuggestPrefix = 50
+
+// Suggestions are cached for a few seconds only: long enough to absorb
+// everyone typing the same popular prefix, short enough that new tags show up
+// almost immediately.
+const suggestCacheTTL = 30 * time.Second
+
+// HandleSuggest completes ?q= for the search bar. ?limit= is capped at
+// maxSuggestions.
+func HandleSuggest(c *gin.Context, cqlHandler *Handler, cache cacheoperations.CounterCache) {
+	prefix := strings.ToLower(strings.TrimSpace(c.Query("q")))
+	if utf8.RuneCountInString(prefix) > maxSuggestPrefix {
+		c.JSON(http.StatusBadRequest, fmt.Sprintf("Sorry, q must be at most %d characters", maxSuggestPrefix))
+		return
+	}
+	limit, ok := limitParam(c, suggestPageSize)
+	if !ok {
 		return
 	}
-	// var output []string
-	for _, hit := range hits {
-		source := hit.(map[string]interface{})["highlight"]
-		// source := hit.(map[string]interface{})["_source"]
-		fmt.Println(source)
-		// output = append(output, source)
+	if limit > maxSuggestions {
+		limit = maxSuggestions
 	}
-	c.JSON(http.StatusCreated, hits)
-	res.Body.Close()
+	if prefix == "" || prefix == "#" || prefix == "@" {
+		c.JSON(http.StatusOK, []search.Suggestion{})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	key := fmt.Sprintf("suggest:%d:%s", limit, prefix)
+	if cached, err := cache.GetBytes(ctx, key); err == nil {
+		c.Data(http.StatusOK, "application/json; charset=utf-8", cached)
+		return
+	}
+	suggestions, err := cqlHandler.Search.Suggest(ctx, prefix, limit)
+	if err == search.ErrNoSuggestField {
+		fmt.Println(err)
+		c.JSON(http.StatusServiceUnavailable, "Sorry, suggestions are unavailable until the search index is rebuilt")
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, "Sorry, suggestions are unavailable right now")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(suggestions)
+	if err != nil {
+		fmt.Println(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := cache.SetBytes(ctx, key, body, suggestCacheTTL); err != nil {
+		fmt.Println(err)
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
 }
 
-func HandleGetUserPosts(c *gin.Context, cqlHandler *Handler, redisClient *redis.Client) {
-	fmt.Println("called")
-	uid := c.Param("id")
-	query := `SELECT post_id, user_id, post_content, created_at FROM posts WHERE user_id = ? LIMIT 15`
-	iter := cqlHandler.Session.Query(query, uid).Iter()
-	var posts []Post
-	var post Post
-	for iter.Scan(&post.ID, &post.UserID, &post.PostContent, &post.CreatedAt) {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
+// HandleGetTagPosts serves the posts and comments tagged with :tag, newest
+// first. Comments carry the parent_id they reply to. ?before= takes the
+// next_cursor of the previous page, or a timestamp or post id.
+func HandleGetTagPosts(c *gin.Context, cqlHandler *Handler, cache cacheoperations.CounterCache) {
+	tag := strings.ToLower(strings.TrimPrefix(c.Param("tag"), "#"))
+	if tag == "" {
+		c.JSON(http.StatusBadRequest, "Sorry, the hashtag is empty")
+		return
+	}
+	limit, ok := limitParam(c, timelinePageSize)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	before, err := postCursor(ctx, c.Query("before"), cqlHandler)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, "Sorry, before must be a timestamp or post id")
+		return
+	}
+	records, err := cqlHandler.Tags.ListTaggedPosts(ctx, tag, before, limit)
+	var posts []PostRes
+	if err == nil {
+		posts, err = loadTaggedPosts(ctx, c, records, cqlHandler, cache)
+	}
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, could not fetch posts tagged #%s", tag))
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	page := TimelinePage{Posts: posts}
+	if len(records) == limit {
+		last := records[len(records)-1]
+		page.NextCursor = positionCursor(last.CreatedAt, last.PostID)
+	}
+	c.JSON(http.StatusOK, page)
+}
 
-		like_count := cacheoperations.GetPostLikes(post.ID.String(), redisClient, ctx, cqlHandler.Session)
-		comment_count := cacheoperations.GetPostComments(post.ID.String(), redisClient, ctx, cqlHandler.Session)
-		post.Likes = like_count
-		post.Comments = comment_count
+// HandleGetMentions serves the posts and comments mentioning the current
+// user, newest first, paged like HandleGetTagPosts.
+func HandleGetMentions(c *gin.Context, cqlHandler *Handler, cache cacheoperations.CounterCache) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		ThrowUserIDExtractError(c)
+		return
+	}
+	uid := int(userID.(float64))
+	limit, ok := limitParam(c, timelinePageSize)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	before, err := postCursor(ctx, c.Query("before"), cqlHandler)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, "Sorry, before must be a timestamp or post id")
+		return
+	}
+	records, err := cqlHandler.Mentions.ListMentions(ctx, uid, before, limit)
+	var posts []PostRes
+	if err == nil {
+		posts, err = loadTaggedPosts(ctx, c, records, cqlHandler, cache)
+	}
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, "Sorry, could not fetch your mentions")
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	page := TimelinePage{Posts: posts}
+	if len(records) == limit {
+		last := records[len(records)-1]
+		page.NextCursor = positionCursor(last.CreatedAt, last.PostID)
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// viewerID returns the id of the user making the request, or "" when it is
+// anonymous, for setting Liked.
+func viewerID(c *gin.Context) string {
+	if userID, exists := c.Get("user_id"); exists {
+		return strconv.Itoa(int(userID.(float64)))
+	}
+	return ""
+}
 
-		post.Liked = CheckLikedByUser(uid, post.ID.String(), cqlHandler)
+// loadTaggedPosts looks up the posts and comments behind hashtag or mention
+// entries, skipping any that are in the trash since they keep their entries
+// until they are purged.
+func loadTaggedPosts(ctx context.Context, c *gin.Context, records []store.TaggedPost, cqlHandler *Handler, cache cacheoperations.CounterCache) ([]PostRes, error) {
+	uid := viewerID(c)
+	posts := []PostRes{}
+	for _, record := range records {
+		comment := record.ParentID != gocql.UUID{}
+		post, err := findPost(ctx, comment, record.PostID.String(), cqlHandler)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if comment {
+			parentID := record.ParentID
+			post.ParentID = &parentID
+		}
+		post.Likes = cacheoperations.GetPostLikes(post.ID.String(), cache, ctx, cqlHandler.Likes)
+		post.Comments = cacheoperations.GetPostComments(post.ID.String(), cache, ctx, cqlHandler.Comments)
 		post.Media = GetPostMedia(post.ID, cqlHandler)
-		posts = append(posts, post)
+		res := PostRes{Post: post}
+		if uid != "" {
+			res.Liked = CheckLikedByUser(uid, post.ID.String(), cqlHandler, cache)
+		}
+		posts = append(posts, res)
 	}
+	return posts, nil
+}
+
+type TrendingTag struct {
+	Hashtag string  `json:"hashtag"`
+	Score   float64 `json:"score"`
+}
 
-	if err := iter.Close(); err != nil {
+// HandleTrendingTags ranks hashtags by recent use over ?window=, one of the
+// configured trending windows, defaulting to the first.
+func HandleTrendingTags(c *gin.Context, cqlHandler *Handler, cache cacheoperations.CounterCache) {
+	if len(cqlHandler.Trending) == 0 {
+		c.JSON(http.StatusOK, []TrendingTag{})
+		return
+	}
+	window := cqlHandler.Trending[0]
+	if name := c.Query("window"); name != "" {
+		found := false
+		for _, w := range cqlHandler.Trending {
+			if w.Name == name {
+				window, found = w, true
+			}
+		}
+		if !found {
+			c.JSON(http.StatusBadRequest, fmt.Sprintf("Sorry, there is no trending window '%s'", name))
+			return
+		}
+	}
+	limit, ok := limitParam(c, defaultPageSize)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ranked, err := cacheoperations.TrendingHashtags(window, time.Now(), limit, cache, ctx)
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, "Sorry, trending hashtags are unavailable right now")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	tags := []TrendingTag{}
+	for _, member := range ranked {
+		tags = append(tags, TrendingTag{Hashtag: member.Member, Score: member.Score})
+	}
+	c.JSON(http.StatusOK, tags)
+}
+
+type TimelinePage struct {
+	Posts      []PostRes `json:"posts"`
+	NextCursor string    `json:"next_cursor"`
+}
+
+// HandleGetUserPosts serves a user's posts newest first. ?before= pages towards
+// older posts and ?after= towards newer ones, and next_cursor continues in the
+// same direction until it comes back empty.
+func HandleGetUserPosts(c *gin.Context, cqlHandler *Handler, cache cacheoperations.CounterCache) {
+	uid := c.Param("id")
+	userID, err := strconv.Atoi(uid)
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, could not fetch post results for user with id %v", uid))
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	limit, ok := limitParam(c, timelinePageSize)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	before, err := postCursor(ctx, c.Query("before"), cqlHandler)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, "Sorry, before must be a timestamp or post id")
+		return
+	}
+	after, err := postCursor(ctx, c.Query("after"), cqlHandler)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, "Sorry, after must be a timestamp or post id")
+		return
+	}
+	records, err := cqlHandler.Posts.ListUserPosts(ctx, userID, before, after, limit)
+	if err != nil {
 		fmt.Println(err)
 		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, could not fetch post results for user with id %v", uid))
 		c.AbortWithStatus(http.StatusNotFound)
+		return
 	}
+	viewer := viewerID(c)
+	posts := []PostRes{}
+	for _, record := range records {
+		var post PostRes
+		post.Post = postFromRecord(record)
 
-	c.JSON(http.StatusOK, posts)
-	return
+		like_count := cacheoperations.GetPostLikes(post.ID.String(), cache, ctx, cqlHandler.Likes)
+		comment_count := cacheoperations.GetPostComments(post.ID.String(), cache, ctx, cqlHandler.Comments)
+		post.Likes = like_count
+		post.Comments = comment_count
+
+		if viewer != "" {
+			post.Liked = CheckLikedByUser(viewer, post.ID.String(), cqlHandler, cache)
+		}
+		post.Media = GetPostMedia(post.ID, cqlHandler)
+		posts = append(posts, post)
+	}
+
+	page := TimelinePage{Posts: posts}
+	if len(records) == limit {
+		last := records[len(records)-1]
+		if !after.IsZero() {
+			last = records[0]
+		}
+		page.NextCursor = positionCursor(last.CreatedAt, last.ID)
+	}
+	c.JSON(http.StatusOK, page)
 }
 
-func handleMediaPost(post Post, cqlHandler *Handler, c *gin.Context) {
+func handleMediaPost(post Post, cqlHandler *Handler, c *gin.Context) error {
 	for i := 0; i < len(post.Media); i++ {
-		media_id := gocql.TimeUUID()
-		if err := cqlHandler.Session.Query(`INSERT INTO post_media (post_id, media_id, order_number, media_reference) VALUES (?, ?, ?, ?)`, post.ID, media_id, i+1, fmt.Sprintf("%s:%d", post.ID, i+1)).Exec(); err != nil {
+		if err := cqlHandler.Media.AddMedia(c.Request.Context(), post.ID, i+1, fmt.Sprintf("%s:%d", post.ID, i+1)); err != nil {
 			fmt.Println(err)
-			c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, count not post with details %v, %d, %s", post.ID, post.UserID, post.PostContent))
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
+			c.JSON(http.StatusInternalServerError, fmt.Sprintf("Sorry, count not post with details %v, %d, %s", post.ID, post.UserID, post.PostContent))
+			c.Abort()
+			return err
 		}
 	}
+	return nil
 }
 
 type PostMedia struct {
@@ -621,25 +1104,305 @@ func HandleAddMediaToPost(c *gin.Context, cqlHandler *Handler) {
 		throwError("error unmarshling payload", c)
 		return
 	}
+	if post_media.ID == nil {
+		throwError("error unmarshling payload", c)
+		return
+	}
 	for i := 0; i < len(post_media.FileNames); i++ {
-		if err := cqlHandler.Session.Query(`INSERT INTO post_media (post_id, media_id, media_reference, order_number) VALUES (?, ?, ?, ?)`, post_media.ID, gocql.TimeUUID(), post_media.FileNames[i], i).Exec(); err != nil {
+		if err := cqlHandler.Media.AddMedia(c.Request.Context(), *post_media.ID, i, post_media.FileNames[i]); err != nil {
 			fmt.Println(err)
 			c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, count not add post media to post with id %s", post_media.ID))
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
 	}
+	ctx := c.Request.Context()
+	author := authorOf(ctx, false, *post_media.ID, cqlHandler)
+	cqlHandler.publish(ctx, events.MediaAdded{PostID: post_media.ID.String(), AuthorID: author, Media: post_media.FileNames})
 	c.JSON(http.StatusCreated, post_media.FileNames)
 }
 
 func GetPostMedia(id gocql.UUID, cqlHandler *Handler) []string {
-	fmt.Println("ID", id)
-	query := `SELECT media_reference FROM post_media WHERE post_id = ?`
-	iter := cqlHandler.Session.Query(query, id).Iter()
-	var mediaReferences []string
-	var mediaStr string
-	for iter.Scan(&mediaStr) {
-		mediaReferences = append(mediaReferences, mediaStr)
+	mediaReferences, err := cqlHandler.Media.ListMedia(context.Background(), id)
+	if err != nil {
+		fmt.Println(err)
 	}
 	return mediaReferences
 }
+
+type Revision struct {
+	Content    string    `json:"content"`
+	WrittenAt  time.Time `json:"written_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+func editable(c *gin.Context, cqlHandler *Handler, owner int, createdAt time.Time) bool {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		ThrowUserIDExtractError(c)
+		return false
+	}
+	if int(userID.(float64)) != owner {
+		c.AbortWithStatus(http.StatusNotFound)
+		return false
+	}
+	if cqlHandler.EditWindow > 0 && time.Since(createdAt) > cqlHandler.EditWindow {
+		c.JSON(http.StatusForbidden, "Sorry, this can no longer be edited")
+		return false
+	}
+	return true
+}
+
+func HandlePostEdit(c *gin.Context, cqlHandler *Handler, cache cacheoperations.CounterCache) {
+	var edit Post
+	if err := c.BindJSON(&edit); err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, "Error editing post")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	post_id := c.Param("id")
+	record, err := findPostRecord(ctx, post_id, cqlHandler)
+	if err != nil {
+		fmt.Println(err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if !editable(c, cqlHandler, record.UserID, record.CreatedAt) {
+		return
+	}
+	now := time.Now()
+	mentions := cqlHandler.resolveMentions(ctx, edit.PostContent)
+	if err := cqlHandler.Posts.EditPost(ctx, record, edit.PostContent, mentions, now); err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, "Error editing post")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	record.Content = edit.PostContent
+	record.Mentions = mentions
+	record.EditedAt = now
+	cqlHandler.publish(ctx, events.PostEdited{PostID: post_id, AuthorID: record.UserID, Content: record.Content, Mentioned: store.MentionedUsers(mentions), EditedAt: now})
+	post := postFromRecord(record)
+	post.Likes = cacheoperations.GetPostLikes(post_id, cache, ctx, cqlHandler.Likes)
+	post.Comments = cacheoperations.GetPostComments(post_id, cache, ctx, cqlHandler.Comments)
+	post.Media = GetPostMedia(post.ID, cqlHandler)
+	cqlHandler.indexPost(documentFromPost(record, post))
+	c.JSON(http.StatusOK, post)
+}
+
+func HandleCommentEdit(c *gin.Context, cqlHandler *Handler, cache cacheoperations.CounterCache) {
+	var edit Comment
+	if err := c.BindJSON(&edit); err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, "Error editing comment")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	comment_id := c.Param("id")
+	id, err := gocql.ParseUUID(comment_id)
+	if err != nil {
+		fmt.Println(err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	record, err := cqlHandler.Comments.GetComment(ctx, id)
+	if err != nil {
+		fmt.Println(err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if !editable(c, cqlHandler, record.UserID, record.CreatedAt) {
+		return
+	}
+	now := time.Now()
+	mentions := cqlHandler.resolveMentions(ctx, edit.PostContent)
+	if err := cqlHandler.Comments.EditComment(ctx, record, edit.PostContent, mentions, now); err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, "Error editing comment")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	record.Content = edit.PostContent
+	record.Mentions = mentions
+	record.EditedAt = now
+	cqlHandler.publish(ctx, events.CommentEdited{CommentID: comment_id, ParentID: record.ParentID.String(), AuthorID: record.UserID, Content: record.Content, Mentioned: store.MentionedUsers(mentions), EditedAt: now})
+	comment := commentFromRecord(record)
+	comment.Likes = cacheoperations.GetPostLikes(comment_id, cache, ctx, cqlHandler.Likes)
+	comment.Comments = cacheoperations.GetPostComments(comment_id, cache, ctx, cqlHandler.Comments)
+	c.JSON(http.StatusOK, comment)
+}
+
+func HandleGetRevisions(c *gin.Context, cqlHandler *Handler) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	post_id := c.Param("id")
+	post, err := findPostRecord(ctx, post_id, cqlHandler)
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, post with id '%s' could not be found", post_id))
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	records, err := cqlHandler.Posts.ListRevisions(ctx, post.ID)
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, could not fetch revisions for post with id %s", post_id))
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	revisions := []Revision{}
+	for _, record := range records {
+		revisions = append(revisions, Revision{Content: record.Content, WrittenAt: record.WrittenAt, ReplacedAt: record.ReplacedAt})
+	}
+	c.JSON(http.StatusOK, revisions)
+}
+
+func HandleGetTrash(c *gin.Context, cqlHandler *Handler) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		ThrowUserIDExtractError(c)
+		return
+	}
+	uid := int(userID.(float64))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	records, err := cqlHandler.Trash.ListTrash(ctx, uid)
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, "Sorry, could not fetch trash")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	posts := []Post{}
+	for _, record := range records {
+		if time.Since(record.DeletedAt) > cqlHandler.TrashRetention {
+			continue
+		}
+		post := postFromRecord(record)
+		post.Media = GetPostMedia(post.ID, cqlHandler)
+		posts = append(posts, post)
+	}
+	c.JSON(http.StatusOK, posts)
+}
+
+func HandleRestorePost(c *gin.Context, cqlHandler *Handler) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		ThrowUserIDExtractError(c)
+		return
+	}
+	uid := int(userID.(float64))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	post_id := c.Param("id")
+	id, err := gocql.ParseUUID(post_id)
+	if err != nil {
+		fmt.Println(err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	record, err := cqlHandler.Trash.GetTrashedPost(ctx, uid, id)
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, post with id '%s' is not in the trash", post_id))
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if time.Since(record.DeletedAt) > cqlHandler.TrashRetention {
+		c.JSON(http.StatusGone, fmt.Sprintf("Sorry, post with id '%s' can no longer be restored", post_id))
+		return
+	}
+	if err := cqlHandler.Trash.RestorePost(ctx, record); err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, could not restore post with id %s", post_id))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	record.DeletedAt = time.Time{}
+	cqlHandler.publish(ctx, events.PostRestored{PostID: post_id, AuthorID: uid})
+	post := postFromRecord(record)
+	post.Media = GetPostMedia(post.ID, cqlHandler)
+	if post.Likes, err = cqlHandler.Likes.LikeCount(ctx, id); err != nil {
+		fmt.Println(err)
+	}
+	if post.Comments, err = cqlHandler.Comments.CommentCount(ctx, id); err != nil {
+		fmt.Println(err)
+	}
+	cqlHandler.indexPost(documentFromPost(record, post))
+	c.JSON(http.StatusOK, post)
+}
+
+type DeadLetter struct {
+	ID        gocql.UUID      `json:"job_id"`
+	Kind      string          `json:"kind"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error"`
+	CreatedAt time.Time       `json:"created_at"`
+	FailedAt  *time.Time      `json:"failed_at,omitempty"`
+}
+
+func deadLetterFromJob(job store.OutboxJob) DeadLetter {
+	return DeadLetter{
+		ID:        job.ID,
+		Kind:      job.Kind,
+		Payload:   job.Payload,
+		Attempts:  job.Attempts,
+		LastError: job.LastError,
+		CreatedAt: job.CreatedAt,
+		FailedAt:  editedAt(job.FailedAt),
+	}
+}
+
+// HandleGetDeadLetters lists the outbox jobs that ran out of attempts, most
+// recently failed first.
+func HandleGetDeadLetters(c *gin.Context, cqlHandler *Handler) {
+	limit, ok := limitParam(c, maxPageSize)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	jobs, err := cqlHandler.Outbox.ListDeadLetters(ctx, limit)
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, "Sorry, could not fetch dead letters")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	letters := []DeadLetter{}
+	for _, job := range jobs {
+		letters = append(letters, deadLetterFromJob(job))
+	}
+	c.JSON(http.StatusOK, letters)
+}
+
+// HandleReplayDeadLetter puts a dead letter back in the outbox for the relay
+// to try again from its first attempt.
+func HandleReplayDeadLetter(c *gin.Context, cqlHandler *Handler) {
+	job_id := c.Param("id")
+	id, err := gocql.ParseUUID(job_id)
+	if err != nil {
+		fmt.Println(err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	job, err := cqlHandler.Outbox.ReplayDeadLetter(ctx, id, time.Now())
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, there is no dead letter with id '%s'", job_id))
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusNotFound, fmt.Sprintf("Sorry, could not replay job with id %s", job_id))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, deadLetterFromJob(job))
+}
@@ -0,0 +1,145 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrNotLeader = errors.New("not the leader")
+
+// Elector campaigns for a Redis lease so that only one replica runs a
+// background job at a time. Nothing in the store checks the lease, so a leader
+// that stalls past its TTL may still finish the write it was making after the
+// next leader has started; jobs must tolerate that.
+type Elector struct {
+	Client *redis.Client
+	Key    string
+	ID     string
+	TTL    time.Duration
+}
+
+func NewElector(client *redis.Client, key string, id string) *Elector {
+	return &Elector{
+		Client: client,
+		Key:    key,
+		ID:     id,
+		TTL:    15 * time.Second,
+	}
+}
+
+// Lease is one acquisition of an Elector's key. Its value is unique to the
+// acquisition, so a holder that lost the lease and took it again cannot renew
+// or release the newer one.
+type Lease struct {
+	elector *Elector
+	value   string
+}
+
+// KEYS[1] lease. ARGV[1] lease value, ARGV[2] ttl in ms.
+var renewScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// KEYS[1] lease. ARGV[1] lease value.
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func (e *Elector) Acquire(ctx context.Context) (*Lease, error) {
+	value := fmt.Sprintf("%s:%d", e.ID, time.Now().UnixNano())
+	acquired, err := e.Client.SetNX(ctx, e.Key, value, e.TTL).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !acquired {
+		return nil, ErrNotLeader
+	}
+	return &Lease{elector: e, value: value}, nil
+}
+
+func (l *Lease) Renew(ctx context.Context) error {
+	ok, err := renewScript.Run(ctx, l.elector.Client, []string{l.elector.Key}, l.value, l.elector.TTL.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrNotLeader
+	}
+	return nil
+}
+
+// Validate checks that the lease has not been taken over, so that a leader
+// that lost it stops before its next batch of writes.
+func (l *Lease) Validate(ctx context.Context) error {
+	value, err := l.elector.Client.Get(ctx, l.elector.Key).Result()
+	if err == redis.Nil || (err == nil && value != l.value) {
+		return ErrNotLeader
+	}
+	return err
+}
+
+func (l *Lease) Release(ctx context.Context) error {
+	return releaseScript.Run(ctx, l.elector.Client, []string{l.elector.Key}, l.value).Err()
+}
+
+// Run campaigns until ctx is done and calls job whenever this replica holds the
+// lease. The job's context is cancelled as soon as a renewal fails.
+func (e *Elector) Run(ctx context.Context, job func(ctx context.Context, lease *Lease)) {
+	for {
+		lease, err := e.Acquire(ctx)
+		if err == nil {
+			log.Printf("Acquired %s lease as %s", e.Key, lease.value)
+			e.lead(ctx, lease, job)
+		} else if err != ErrNotLeader {
+			log.Printf("Error acquiring %s lease: %v", e.Key, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.TTL / 3):
+		}
+	}
+}
+
+func (e *Elector) lead(ctx context.Context, lease *Lease, job func(ctx context.Context, lease *Lease)) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		job(jobCtx, lease)
+	}()
+
+	ticker := time.NewTicker(e.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			lease.Release(context.Background())
+			return
+		case <-ctx.Done():
+			cancel()
+			<-done
+			lease.Release(context.Background())
+			return
+		case <-ticker.C:
+			if err := lease.Renew(ctx); err != nil {
+				log.Printf("Lost %s lease as %s: %v", e.Key, lease.value, err)
+				cancel()
+				<-done
+				return
+			}
+		}
+	}
+}
@@ -2,16 +2,31 @@ package main
 
 import (
 	"context"
+	"expvar"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/cal1co/movielogv2-postservice/directory"
+	"github.com/cal1co/movielogv2-postservice/events"
+	"github.com/cal1co/movielogv2-postservice/feed"
 	handlers "github.com/cal1co/movielogv2-postservice/handlers"
+	"github.com/cal1co/movielogv2-postservice/leader"
 	middleware "github.com/cal1co/movielogv2-postservice/middleware"
+	"github.com/cal1co/movielogv2-postservice/outbox"
+	"github.com/cal1co/movielogv2-postservice/ratelimit"
+	"github.com/cal1co/movielogv2-postservice/reconcile"
+	cacheoperations "github.com/cal1co/movielogv2-postservice/rediscache"
+	"github.com/cal1co/movielogv2-postservice/search"
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/cal1co/movielogv2-postservice/trash"
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -20,64 +35,196 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
-var session *gocql.Session
+var postStore store.Store
+var cache cacheoperations.CounterCache
 var redisClient *redis.Client
 
-type PostHandler struct {
-	Session *gocql.Session
-}
-
-func init() {
-	cluster := gocql.NewCluster("cassandra")
-	cluster.Keyspace = "user_posts"
-	var err error
-	session, err = cluster.CreateSession()
-	if err != nil {
-		panic(err)
+func newCache() (cacheoperations.CounterCache, *redis.Client) {
+	if os.Getenv("CACHE_BACKEND") == "memory" {
+		return cacheoperations.NewMemoryCache(), nil
 	}
-
-	redisClient = redis.NewClient(&redis.Options{
+	client := redis.NewClient(&redis.Options{
 		Addr:     "yuzu-post-interactions:6379",
 		Password: "",
 		DB:       0,
 	})
+	return cacheoperations.NewRedisCache(client), client
 }
 
-func MigrateLikesToDB() {
-	handleMigration("post:*:likes", ":likes", "UPDATE post_interactions SET likes = ? WHERE post_id = ?")
-	handleMigration("post:*:commentcount", ":commentcount", "UPDATE post_interactions SET comments = ? WHERE post_id = ?")
+// newPublisher sends events to the post-events stream, or keeps the latest
+// ones in memory when running without Redis.
+func newPublisher() events.EventPublisher {
+	if redisClient == nil {
+		return events.NewMemory()
+	}
+	return events.NewRedisStreams(redisClient, "post-events")
 }
 
-func handleMigration(key string, suffix string, query string) {
-	ctx := context.Background()
-	cursor := uint64(0)
-	keys := []string{}
-	for {
-		var err error
-		likesCache, cursor, err := redisClient.Scan(ctx, cursor, key, 100).Result()
-		if err != nil {
-			log.Printf("Error scanning Redis keys: %v", err)
-			return
-		}
-		log.Printf("%s", likesCache)
-		keys = append(keys, likesCache...)
-		if cursor == 0 {
-			break
-		}
+func newLimiter() ratelimit.Limiter {
+	if redisClient == nil {
+		return ratelimit.NewMemory()
 	}
-	for _, key := range keys {
-		postId := strings.TrimPrefix(strings.TrimSuffix(key, suffix), "post:")
-		count, err := redisClient.Get(ctx, key).Result()
-		if err != nil {
-			log.Printf("Error getting count for post %s: %v", postId, err)
+	return ratelimit.NewRedis(redisClient)
+}
+
+// rateLimits are per user, or per IP before login. Creating posts and
+// comments has its own, tighter budgets.
+var rateLimits = map[string]ratelimit.Policy{
+	"POST /post":                {Name: "create-post", Limit: 10, Period: time.Minute},
+	"POST /post/:id/comment":    {Name: "create-comment", Limit: 30, Period: time.Minute},
+	"POST /comment/:id/comment": {Name: "create-comment", Limit: 30, Period: time.Minute},
+}
+
+var defaultRateLimit = ratelimit.Policy{Name: "default", Limit: 120, Period: time.Minute}
+
+// runLeader runs job on this instance only while it holds the named lease,
+// passing the lease check for job to call between batches. Nothing in the
+// store checks the lease, so jobs must tolerate a batch overlapping with the
+// next leader's. Without Redis there is a single instance and no check.
+func runLeader(ctx context.Context, name string, job func(ctx context.Context, checkLease func(context.Context) error)) {
+	if redisClient == nil {
+		job(ctx, nil)
+		return
+	}
+	hostname, _ := os.Hostname()
+	elector := leader.NewElector(redisClient, name, fmt.Sprintf("%s:%d", hostname, os.Getpid()))
+	elector.Run(ctx, func(ctx context.Context, lease *leader.Lease) {
+		job(ctx, lease.Validate)
+	})
+}
+
+func runReconcile(ctx context.Context) {
+	reconciler := reconcile.NewReconciler(postStore, cache)
+	reconciler.Repair = os.Getenv("RECONCILE_REPAIR") == "true"
+	runLeader(ctx, "leader:reconcile", func(ctx context.Context, checkLease func(context.Context) error) {
+		leased := *reconciler
+		leased.CheckLease = checkLease
+		leased.Run(ctx, time.Hour)
+	})
+}
+
+func runPurge(ctx context.Context, retention time.Duration, publisher events.EventPublisher) {
+	purger := trash.NewPurger(postStore, retention)
+	purger.Events = publisher
+	runLeader(ctx, "leader:purge-trash", func(ctx context.Context, checkLease func(context.Context) error) {
+		leased := *purger
+		leased.CheckLease = checkLease
+		leased.Run(ctx, time.Hour)
+	})
+}
+
+func runOutbox(ctx context.Context, deliver map[string]outbox.Deliver) {
+	relay := outbox.NewRelay(postStore, deliver)
+	runLeader(ctx, "leader:outbox-relay", func(ctx context.Context, checkLease func(context.Context) error) {
+		leased := *relay
+		leased.CheckLease = checkLease
+		leased.Run(ctx, time.Second)
+	})
+}
+
+// adminUserIDs parses ADMIN_USER_IDS, a comma separated list of user ids.
+func adminUserIDs() []int {
+	var ids []int
+	for _, value := range strings.Split(os.Getenv("ADMIN_USER_IDS"), ",") {
+		if value = strings.TrimSpace(value); value == "" {
 			continue
 		}
-		err = session.Query(query, count, postId).Exec()
+		id, err := strconv.Atoi(value)
 		if err != nil {
-			log.Printf("Error updating count for post %s: %v", postId, err)
-			continue
+			log.Fatalf("Invalid ADMIN_USER_IDS entry %q", value)
 		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// serveDebug serves the expvar metrics on their own listener, which should
+// only be reachable from inside the cluster. DEBUG_ADDR overrides the address.
+func serveDebug() {
+	address := os.Getenv("DEBUG_ADDR")
+	if address == "" {
+		address = "127.0.0.1:6060"
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Printf("Error serving debug vars: %v", err)
+	}
+}
+
+func newStore() (store.Store, func()) {
+	if os.Getenv("STORAGE_BACKEND") == "memory" {
+		return store.NewMemory(), func() {}
+	}
+	cluster := gocql.NewCluster("cassandra")
+	cluster.Keyspace = "user_posts"
+	session, err := cluster.CreateSession()
+	if err != nil {
+		panic(err)
+	}
+	return store.NewCassandra(session), session.Close
+}
+
+func newElasticsearch() (*elasticsearch.Client, error) {
+	cert, _ := ioutil.ReadFile(os.Getenv("ELASTIC_CERT_PATH"))
+	cfg := elasticsearch.Config{
+		Username: os.Getenv("ELASTIC_USERNAME"),
+		Password: os.Getenv("ELASTIC_PASSWORD"),
+		CACert:   cert,
+	}
+	if address := os.Getenv("ELASTIC_ADDRESS"); address != "" {
+		cfg.Addresses = strings.Split(address, ",")
+	}
+	return elasticsearch.NewClient(cfg)
+}
+
+// newSearch picks the search backend from SEARCH_BACKEND. "local" keeps an
+// in-memory index filled from the store, for running without Elasticsearch.
+func newSearch(ctx context.Context) (search.SearchBackend, error) {
+	if os.Getenv("SEARCH_BACKEND") == "local" {
+		local := search.NewLocal()
+		go func() {
+			if err := local.Fill(ctx, postStore); err != nil {
+				log.Printf("Error filling the local search index: %v", err)
+			}
+		}()
+		return local, nil
+	}
+	es, err := newElasticsearch()
+	if err != nil {
+		return nil, err
 	}
+	backend := search.NewElasticsearch(es, "posts")
+	if err := backend.EnsureIndex(ctx); err != nil {
+		log.Printf("Error creating the search index: %v", err)
+	}
+	go backend.Indexer.Run(ctx)
+	return backend, nil
+}
+
+// reindex rebuilds the posts index from the store. Run it again with the same
+// checkpoint after an interruption to pick up where it stopped.
+func reindex(args []string) {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	checkpoint := flags.String("checkpoint", "reindex.checkpoint", "file that records reindex progress")
+	pageSize := flags.Int("page-size", 500, "posts read and indexed per batch")
+	flags.Parse(args)
+
+	postStore, closeStore := newStore()
+	defer closeStore()
+	es, err := newElasticsearch()
+	if err != nil {
+		log.Fatalf("Error creating the client: %s", err)
+	}
+	reindexer := search.NewReindexer(postStore, es, "posts", *checkpoint)
+	reindexer.PageSize = *pageSize
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	index, err := reindexer.Reindex(ctx)
+	if err != nil {
+		log.Fatalf("Reindex failed, rerun to resume: %v", err)
+	}
+	log.Printf("Reindex complete, posts now points at %s", index)
 }
 
 func loadEnv() {
@@ -88,112 +235,196 @@ func loadEnv() {
 }
 
 func main() {
-	defer session.Close()
+	loadEnv()
 
-	go func() {
-		for {
-			MigrateLikesToDB()
-			time.Sleep(time.Minute * 5)
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		reindex(os.Args[2:])
+		return
+	}
+
+	var closeStore func()
+	postStore, closeStore = newStore()
+	defer closeStore()
+	cache, redisClient = newCache()
+
+	handler := handlers.NewHandler(postStore)
+	if window, err := time.ParseDuration(os.Getenv("EDIT_WINDOW")); err == nil {
+		handler.EditWindow = window
+	}
+	if retention, err := time.ParseDuration(os.Getenv("TRASH_RETENTION")); err == nil {
+		handler.TrashRetention = retention
+	}
+	if value := os.Getenv("TRENDING_WINDOWS"); value != "" {
+		windows, err := cacheoperations.ParseTrendingWindows(value)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}()
+		handler.Trending = windows
+	}
+	handler.Events = newPublisher()
+	if address := os.Getenv("USER_DIRECTORY_URL"); address != "" {
+		handler.Users = directory.NewClient(address)
+	}
+	if address := os.Getenv("FEED_HANDLER_URL"); address != "" {
+		handler.Feed = feed.NewClient(address)
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("FEED_HANDLER_TIMEOUT")); err == nil {
+		handler.Feed.Timeout = timeout
+	}
 
-	loadEnv()
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	go runReconcile(jobsCtx)
+	go runPurge(jobsCtx, handler.TrashRetention, handler.Events)
 
 	r := gin.Default()
 
 	config := cors.DefaultConfig()
-	config.AllowMethods = []string{"GET", "POST", "DELETE", "OPTIONS"}
-	config.AddAllowHeaders("Authorization")
+	config.AllowMethods = []string{"GET", "POST", "PATCH", "DELETE", "OPTIONS"}
+	config.AddAllowHeaders("Authorization", "Idempotency-Key")
+	config.ExposeHeaders = []string{"RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"}
 	config.AllowOrigins = []string{"http://localhost:5173", "http://localhost:3000"}
 
 	r.Use(cors.New(config))
 
-	cert, _ := ioutil.ReadFile(os.Getenv("ELASTIC_CERT_PATH"))
-	cfg := elasticsearch.Config{
-		Addresses: []string{"ELASTIC_ADDRESS"},
-		Username:  os.Getenv("ELASTIC_USERNAME"),
-		Password:  os.Getenv("ELASTIC_PASSWORD"),
-		CACert:    cert,
-	}
-	es, err := elasticsearch.NewClient(cfg)
+	backend, err := newSearch(jobsCtx)
 	if err != nil {
 		fmt.Printf("Error creating the client: %s\n", err)
 		return
 	}
+	handler.Search = backend
+	go runOutbox(jobsCtx, handler.Deliveries())
 
-	r.Use(middleware.RateLimiterMiddleware())
-
-	handler := &handlers.Handler{
-		Session: session,
-	}
+	r.Use(middleware.RateLimiterMiddleware(newLimiter(), rateLimits, defaultRateLimit))
 
 	authRoutes := r.Group("/")
 	authRoutes.Use(middleware.AuthMiddleware())
-	authRoutes.Use(middleware.ActivityTrackerMiddleware(redisClient))
+	authRoutes.Use(middleware.ActivityTrackerMiddleware(cache))
 	authRoutes.GET("/posts/user/:id", func(c *gin.Context) {
-		handlers.HandleGetUserPosts(c, handler, redisClient)
+		handlers.HandleGetUserPosts(c, handler, cache)
 	})
 
-	authRoutes.POST("/post", func(c *gin.Context) {
-		handlers.HandlePost(c, handler)
+	idempotencyTTL := 24 * time.Hour
+	if ttl, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_TTL")); err == nil {
+		idempotencyTTL = ttl
+	}
+	idempotent := middleware.IdempotencyMiddleware(cache, idempotencyTTL, 30*time.Second)
+
+	authRoutes.POST("/post", idempotent, func(c *gin.Context) {
+		handlers.HandlePost(c, handler, cache)
 	})
 
-	authRoutes.POST("/post/:id/comment", func(c *gin.Context) {
-		handlers.HandleComment(c, handler, redisClient, false)
+	authRoutes.POST("/post/:id/comment", idempotent, func(c *gin.Context) {
+		handlers.HandleComment(c, handler, cache, false)
 	})
 
 	authRoutes.GET("/post/:id/comments", func(c *gin.Context) {
-		handlers.GetPostComments(c, handler, redisClient)
+		handlers.GetPostComments(c, handler, cache)
+	})
+
+	authRoutes.POST("/comment/:id/comment", idempotent, func(c *gin.Context) {
+		handlers.HandleComment(c, handler, cache, true)
 	})
 
-	authRoutes.POST("/comment/:id/comment", func(c *gin.Context) {
-		handlers.HandleComment(c, handler, redisClient, true)
+	authRoutes.GET("/comment/:id/comments", func(c *gin.Context) {
+		handlers.GetPostComments(c, handler, cache)
 	})
 
 	authRoutes.POST("/post/like/:id", func(c *gin.Context) {
-		handlers.HandleLike(c, false, handler, redisClient)
+		handlers.HandleLike(c, false, handler, cache)
 	})
 
 	authRoutes.POST("/post/unlike/:id", func(c *gin.Context) {
-		handlers.HandleUnlike(c, false, handler, redisClient)
+		handlers.HandleUnlike(c, false, handler, cache)
 	})
 
 	authRoutes.POST("/comment/:id/like", func(c *gin.Context) {
-		handlers.HandleLike(c, true, handler, redisClient)
+		handlers.HandleLike(c, true, handler, cache)
 	})
 
 	authRoutes.POST("/comment/:id/unlike", func(c *gin.Context) {
-		handlers.HandleUnlike(c, true, handler, redisClient)
+		handlers.HandleUnlike(c, true, handler, cache)
 	})
 
 	authRoutes.GET("/feed/user/:id", func(c *gin.Context) {
-		handlers.GetUserPosts(c, handler, redisClient)
+		handlers.HandleGetUserPosts(c, handler, cache)
 	})
 
 	authRoutes.GET("/posts/:id", func(c *gin.Context) {
-		handlers.HandlePostGet(c, false, handler, redisClient)
+		handlers.HandlePostGet(c, false, handler, cache)
 	})
 
 	authRoutes.GET("/comments/:id", func(c *gin.Context) {
-		handlers.HandlePostGet(c, true, handler, redisClient)
+		handlers.HandlePostGet(c, true, handler, cache)
 	})
 
 	authRoutes.POST("/posts/search", func(c *gin.Context) {
-		handlers.HandleSearch(c, es)
+		handlers.HandleSearch(c, handler, cache)
+	})
+
+	authRoutes.GET("/posts/suggest", func(c *gin.Context) {
+		handlers.HandleSuggest(c, handler, cache)
+	})
+
+	authRoutes.GET("/tags/trending", func(c *gin.Context) {
+		handlers.HandleTrendingTags(c, handler, cache)
+	})
+
+	authRoutes.GET("/tags/:tag/posts", func(c *gin.Context) {
+		handlers.HandleGetTagPosts(c, handler, cache)
 	})
 
 	authRoutes.DELETE("/posts/:id", func(c *gin.Context) {
-		handlers.HandlePostDelete(c, handler, redisClient, es)
+		handlers.HandlePostDelete(c, handler, cache)
+	})
+
+	authRoutes.PATCH("/posts/:id", func(c *gin.Context) {
+		handlers.HandlePostEdit(c, handler, cache)
+	})
+
+	authRoutes.GET("/posts/:id/revisions", func(c *gin.Context) {
+		handlers.HandleGetRevisions(c, handler)
+	})
+
+	authRoutes.PATCH("/comments/:id", func(c *gin.Context) {
+		handlers.HandleCommentEdit(c, handler, cache)
+	})
+
+	authRoutes.DELETE("/comments/:id", func(c *gin.Context) {
+		handlers.HandleCommentDelete(c, handler, cache)
+	})
+
+	authRoutes.GET("/me/mentions", func(c *gin.Context) {
+		handlers.HandleGetMentions(c, handler, cache)
+	})
+
+	authRoutes.GET("/me/trash", func(c *gin.Context) {
+		handlers.HandleGetTrash(c, handler)
+	})
+
+	authRoutes.POST("/me/trash/:id/restore", func(c *gin.Context) {
+		handlers.HandleRestorePost(c, handler)
 	})
 
 	authRoutes.POST("/post/media", func(c *gin.Context) {
 		handlers.HandleAddMediaToPost(c, handler)
 	})
 
+	adminRoutes := authRoutes.Group("/admin")
+	adminRoutes.Use(middleware.AdminMiddleware(adminUserIDs()))
+	adminRoutes.GET("/outbox/dead-letters", func(c *gin.Context) {
+		handlers.HandleGetDeadLetters(c, handler)
+	})
+
+	adminRoutes.POST("/outbox/dead-letters/:id/replay", func(c *gin.Context) {
+		handlers.HandleReplayDeadLetter(c, handler)
+	})
+
 	r.POST("/posts/feed/:id", func(c *gin.Context) {
-		handlers.HandleFeedPosts(c, handler, redisClient)
+		handlers.HandleFeedPosts(c, handler, cache)
 	})
 
+	go serveDebug()
 	go func() {
 		if err := r.Run(":8080"); err != nil {
 			log.Fatalf("Failed to start server: %v", err)
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	cacheoperations "github.com/cal1co/movielogv2-postservice/rediscache"
+	"github.com/gin-gonic/gin"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// idempotentRequest is what is kept under a user's Idempotency-Key: the
+// request it was first used for and, once that has been answered, the
+// response to replay.
+type idempotentRequest struct {
+	Fingerprint string `json:"fingerprint"`
+	Done        bool   `json:"done"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(data string) (int, error) {
+	w.body.WriteString(data)
+	return w.ResponseWriter.WriteString(data)
+}
+
+// IdempotencyMiddleware makes a request carrying an Idempotency-Key header
+// happen at most once per user and key within ttl. A repeat gets the first
+// response replayed, a repeat while the first is still running gets 409, and
+// reusing a key for a different request gets 422. Server errors are not kept,
+// so the request can be retried with the same key. Claims on keys expire
+// after lockTTL in case an instance dies mid-request. It must run after
+// AuthMiddleware; if the cache is unavailable requests go ahead unprotected.
+func IdempotencyMiddleware(cache cacheoperations.CounterCache, ttl time.Duration, lockTTL time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		userID, exists := c.Get("user_id")
+		if key == "" || !exists {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is too long"})
+			return
+		}
+		var body []byte
+		if c.Request.Body != nil {
+			var err error
+			if body, err = io.ReadAll(c.Request.Body); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "could not read request body"})
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%s %s\n", c.Request.Method, c.Request.URL.Path)
+		hash.Write(body)
+		fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+		ctx := context.Background()
+		cacheKey := fmt.Sprintf("idempotency:%v:%s", userID, key)
+		claim, _ := json.Marshal(idempotentRequest{Fingerprint: fingerprint})
+		claimed, err := cache.SetBytesNX(ctx, cacheKey, claim, lockTTL)
+		if err != nil {
+			log.Printf("Error claiming idempotency key %s: %v", cacheKey, err)
+			c.Next()
+			return
+		}
+		if !claimed {
+			replay(c, cache, cacheKey, fingerprint)
+			return
+		}
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			if err := cache.Del(ctx, cacheKey); err != nil {
+				log.Printf("Error releasing idempotency key %s: %v", cacheKey, err)
+			}
+			return
+		}
+		response, _ := json.Marshal(idempotentRequest{
+			Fingerprint: fingerprint,
+			Done:        true,
+			Status:      c.Writer.Status(),
+			ContentType: c.Writer.Header().Get("Content-Type"),
+			Body:        writer.body.Bytes(),
+		})
+		if err := cache.SetBytes(ctx, cacheKey, response, ttl); err != nil {
+			log.Printf("Error storing idempotent response %s: %v", cacheKey, err)
+		}
+	}
+}
+
+func replay(c *gin.Context, cache cacheoperations.CounterCache, cacheKey string, fingerprint string) {
+	stored, err := cache.GetBytes(context.Background(), cacheKey)
+	var previous idempotentRequest
+	if err == nil {
+		err = json.Unmarshal(stored, &previous)
+	}
+	if err == nil && previous.Fingerprint != fingerprint {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different request"})
+		return
+	}
+	// A claim that vanished since SetBytesNX belonged to a request that just
+	// failed; the client can retry it.
+	if err != nil || !previous.Done {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "a request with this Idempotency-Key is already in progress"})
+		return
+	}
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(previous.Status, previous.ContentType, previous.Body)
+	c.Abort()
+}
@@ -2,30 +2,65 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/cal1co/movielogv2-postservice/ratelimit"
+	cacheoperations "github.com/cal1co/movielogv2-postservice/rediscache"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt"
-	"github.com/redis/go-redis/v9"
-	"golang.org/x/time/rate"
 )
 
-func RateLimiterMiddleware() gin.HandlerFunc {
-	limiter := rate.NewLimiter(1, 20)
-
+// RateLimiterMiddleware limits each user, or each client IP for requests
+// without a valid token, to the policy for the route in policies, keyed by
+// method and route pattern as in "POST /post", or else to fallback. Responses
+// carry RateLimit-* headers and refusals a Retry-After. If the limiter fails
+// the request is let through.
+func RateLimiterMiddleware(limiter ratelimit.Limiter, policies map[string]ratelimit.Policy, fallback ratelimit.Policy) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if limiter.Allow() == false {
+		policy, ok := policies[c.Request.Method+" "+c.FullPath()]
+		if !ok {
+			policy = fallback
+		}
+		result, err := limiter.Allow(context.Background(), rateLimitKey(c), policy)
+		if err != nil {
+			log.Printf("Error checking rate limit: %v", err)
+			c.Next()
+			return
+		}
+		c.Header("RateLimit-Policy", policy.String())
+		c.Header("RateLimit-Limit", strconv.Itoa(policy.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("RateLimit-Reset", seconds(result.Reset))
+		if !result.Allowed {
+			c.Header("Retry-After", seconds(result.RetryAfter))
 			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
 			return
 		}
 		c.Next()
 	}
 }
+
+func rateLimitKey(c *gin.Context) string {
+	if c.GetHeader("Authorization") != "" {
+		if userID, err := authenticate(c); err == nil {
+			return fmt.Sprintf("user:%v", userID)
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
 func verifyToken(tokenString string) (*jwt.Token, error) {
 	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -34,6 +69,29 @@ func verifyToken(tokenString string) (*jwt.Token, error) {
 		return []byte(os.Getenv("SECRET_TOKEN")), nil
 	})
 }
+
+// authenticate returns the id of the user whose token came with the request.
+// The token is only verified once per request: the outcome is kept in the
+// context, the id as user_id, for whichever middleware asks next.
+func authenticate(c *gin.Context) (float64, error) {
+	if userID, exists := c.Get("user_id"); exists {
+		return userID.(float64), nil
+	}
+	if err, failed := c.Get("auth_error"); failed {
+		return 0, err.(error)
+	}
+	token, err := verifyToken(strings.Replace(c.GetHeader("Authorization"), "Bearer ", "", 1))
+	if err == nil {
+		if userID, ok := token.Claims.(jwt.MapClaims)["id"].(float64); ok {
+			c.Set("user_id", userID)
+			return userID, nil
+		}
+		err = errors.New("token has no user id")
+	}
+	c.Set("auth_error", err)
+	return 0, err
+}
+
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
@@ -42,26 +100,33 @@ func AuthMiddleware() gin.HandlerFunc {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			return
 		}
-		tokenString := strings.Replace(authHeader, "Bearer ", "", 1)
-
-		token, err := verifyToken(tokenString)
-		if err != nil {
+		if _, err := authenticate(c); err != nil {
 			log.Printf("error: %s", err)
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid authorization token"})
 			return
 		}
-		userID := token.Claims.(jwt.MapClaims)["id"].(float64)
-		c.Set("user_id", userID)
-		_, exists := c.Get("user_id")
-		if !exists {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid authorization token"})
+		c.Next()
+	}
+}
+
+// AdminMiddleware only lets the given users through; it must run after
+// AuthMiddleware.
+func AdminMiddleware(adminIDs []int) gin.HandlerFunc {
+	admins := map[int]bool{}
+	for _, id := range adminIDs {
+		admins[id] = true
+	}
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !admins[int(userID.(float64))] {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
 			return
 		}
 		c.Next()
 	}
 }
 
-func ActivityTrackerMiddleware(redisClient *redis.Client) gin.HandlerFunc {
+func ActivityTrackerMiddleware(cache cacheoperations.CounterCache) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
 
@@ -74,7 +139,7 @@ func ActivityTrackerMiddleware(redisClient *redis.Client) gin.HandlerFunc {
 		lastActiveKey := fmt.Sprintf("user:%v:lastActive", userId)
 
 		now := time.Now().UTC().Unix()
-		if err := redisClient.Set(ctx, lastActiveKey, now, 0).Err(); err != nil {
+		if err := cache.Set(ctx, lastActiveKey, int(now), 0); err != nil {
 			fmt.Println("Error updating user activity:", err)
 		}
 
@@ -0,0 +1,157 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/gocql/gocql"
+)
+
+var (
+	deliveredTotal    = expvar.NewInt("outbox_delivered_total")
+	retriedTotal      = expvar.NewInt("outbox_retried_total")
+	deadLetteredTotal = expvar.NewInt("outbox_dead_lettered_total")
+)
+
+// Job kinds.
+const (
+	KindFanout = "fanout"
+	KindIndex  = "index"
+	KindEvent  = "event"
+)
+
+// Deliver carries out one kind of job from its JSON payload.
+type Deliver func(ctx context.Context, payload []byte) error
+
+// NewJob builds a job due immediately with payload marshalled as JSON.
+func NewJob(kind string, payload interface{}, now time.Time) (store.OutboxJob, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return store.OutboxJob{}, err
+	}
+	return store.OutboxJob{
+		ID:          gocql.TimeUUID(),
+		Kind:        kind,
+		Payload:     body,
+		NextAttempt: now,
+		CreatedAt:   now,
+	}, nil
+}
+
+// Relay delivers due outbox jobs with the Deliver registered for their kind.
+// A failed job is retried after an exponential, jittered backoff starting at
+// Backoff and capped at MaxBackoff, and moved to the dead letters after
+// MaxAttempts. Delivery is at least once: a job is only removed after it
+// succeeds. When CheckLease is set it is called before every batch.
+type Relay struct {
+	Store       store.OutboxStore
+	Deliver     map[string]Deliver
+	BatchSize   int
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	CheckLease  func(ctx context.Context) error
+}
+
+func NewRelay(s store.OutboxStore, deliver map[string]Deliver) *Relay {
+	return &Relay{
+		Store:       s,
+		Deliver:     deliver,
+		BatchSize:   100,
+		MaxAttempts: 8,
+		Backoff:     time.Second,
+		MaxBackoff:  10 * time.Minute,
+	}
+}
+
+func (r *Relay) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.Relay(ctx); err != nil {
+			log.Printf("Error relaying outbox: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Relay attempts every job that is due and returns how many were delivered.
+// Failed deliveries are rescheduled rather than returned as errors; only
+// failures to read or update the outbox are.
+func (r *Relay) Relay(ctx context.Context) (int, error) {
+	delivered := 0
+	for {
+		if r.CheckLease != nil {
+			if err := r.CheckLease(ctx); err != nil {
+				return delivered, err
+			}
+		}
+		now := time.Now()
+		jobs, err := r.Store.ListDueJobs(ctx, now, r.BatchSize)
+		if err != nil {
+			return delivered, err
+		}
+		for _, job := range jobs {
+			ok, err := r.attempt(ctx, job, now)
+			if err != nil {
+				return delivered, err
+			}
+			if ok {
+				delivered++
+			}
+		}
+		if len(jobs) < r.BatchSize {
+			return delivered, nil
+		}
+	}
+}
+
+func (r *Relay) attempt(ctx context.Context, job store.OutboxJob, now time.Time) (bool, error) {
+	var err error
+	if deliver, ok := r.Deliver[job.Kind]; ok {
+		err = deliver(ctx, job.Payload)
+	} else {
+		err = fmt.Errorf("no delivery for outbox jobs of kind %q", job.Kind)
+	}
+	if err == nil {
+		deliveredTotal.Add(1)
+		return true, r.Store.CompleteJob(ctx, job)
+	}
+
+	job.Attempts++
+	job.LastError = err.Error()
+	if job.Attempts >= r.MaxAttempts {
+		log.Printf("Outbox job %s (%s) failed %d times, dead-lettering: %v", job.ID, job.Kind, job.Attempts, err)
+		job.FailedAt = now
+		deadLetteredTotal.Add(1)
+		return false, r.Store.DeadLetterJob(ctx, job)
+	}
+	retriedTotal.Add(1)
+	return false, r.Store.RetryJob(ctx, job, now.Add(r.backoff(job.Attempts)))
+}
+
+// backoff doubles with every attempt and picks a random point in the upper
+// half, so jobs that failed together do not all retry together.
+func (r *Relay) backoff(attempts int) time.Duration {
+	wait := r.Backoff
+	for i := 1; i < attempts && wait < r.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > r.MaxBackoff {
+		wait = r.MaxBackoff
+	}
+	if wait <= 1 {
+		return wait
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)))
+}
@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	_ Limiter = (*Redis)(nil)
+	_ Limiter = (*Memory)(nil)
+)
+
+// Policy allows Limit requests per Period. Requests may come all at once, after
+// which they are let through again at an even pace of one per Period/Limit.
+// Policies with different names keep separate budgets.
+type Policy struct {
+	Name   string
+	Limit  int
+	Period time.Duration
+}
+
+// String formats p as an RFC RateLimit-Policy value, e.g. 10;w=60.
+func (p Policy) String() string {
+	return fmt.Sprintf("%d;w=%d", p.Limit, int(math.Ceil(p.Period.Seconds())))
+}
+
+// Result is the outcome of one request against a policy. Reset is how long
+// until the full budget is available again; RetryAfter is set when the
+// request was refused.
+type Result struct {
+	Allowed    bool
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Limiter counts a request by key against policy, using the generic cell
+// rate algorithm (GCRA): a theoretical arrival time is kept per key and moves
+// forward by Period/Limit with every request allowed.
+type Limiter interface {
+	Allow(ctx context.Context, key string, policy Policy) (Result, error)
+}
+
+// gcra applies one request to the theoretical arrival time tat, all in
+// milliseconds, and returns the result along with the new tat.
+func gcra(now, tat float64, policy Policy) (Result, float64) {
+	period := float64(policy.Period.Milliseconds())
+	interval := period / float64(policy.Limit)
+	if tat < now {
+		tat = now
+	}
+	next := tat + interval
+	if allowAt := next - period; now < allowAt {
+		return Result{
+			Reset:      milliseconds(tat - now),
+			RetryAfter: milliseconds(allowAt - now),
+		}, tat
+	}
+	return Result{
+		Allowed:   true,
+		Remaining: int((period - (next - now)) / interval),
+		Reset:     milliseconds(next - now),
+	}, next
+}
+
+func milliseconds(ms float64) time.Duration {
+	return time.Duration(math.Ceil(ms)) * time.Millisecond
+}
+
+// Memory keeps arrival times in process, for tests and for running a single
+// instance without Redis. Arrival times that have passed are swept out every
+// sweepEvery calls.
+type Memory struct {
+	mu    sync.Mutex
+	tat   map[string]float64
+	calls int
+}
+
+const sweepEvery = 1024
+
+func NewMemory() *Memory {
+	return &Memory{tat: make(map[string]float64)}
+}
+
+func (m *Memory) Allow(ctx context.Context, key string, policy Policy) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := float64(time.Now().UnixMicro()) / 1000
+	if m.calls++; m.calls%sweepEvery == 0 {
+		for k, tat := range m.tat {
+			if tat < now {
+				delete(m.tat, k)
+			}
+		}
+	}
+	key = policy.Name + ":" + key
+	result, tat := gcra(now, m.tat[key], policy)
+	m.tat[key] = tat
+	return result, nil
+}
@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis keeps arrival times in Redis so that every replica draws on the same
+// budget. The clock is the caller's, so replicas are assumed to be in sync to
+// well within a policy's Period/Limit.
+type Redis struct {
+	Client *redis.Client
+	Prefix string
+}
+
+func NewRedis(client *redis.Client) *Redis {
+	return &Redis{Client: client, Prefix: "ratelimit:"}
+}
+
+// KEYS[1] arrival time. ARGV[1] now in ms, ARGV[2] period in ms, ARGV[3] limit.
+// Mirrors gcra; returns {allowed, remaining, reset ms, retry after ms}.
+var gcraScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local interval = period / tonumber(ARGV[3])
+local tat = tonumber(redis.call('GET', KEYS[1])) or now
+if tat < now then
+	tat = now
+end
+local new_tat = tat + interval
+local allow_at = new_tat - period
+if now < allow_at then
+	return {0, 0, math.ceil(tat - now), math.ceil(allow_at - now)}
+end
+redis.call('SET', KEYS[1], string.format('%.3f', new_tat), 'PX', math.ceil(new_tat - now))
+return {1, math.floor((period - (new_tat - now)) / interval), math.ceil(new_tat - now), 0}
+`)
+
+func (r *Redis) Allow(ctx context.Context, key string, policy Policy) (Result, error) {
+	now := float64(time.Now().UnixMicro()) / 1000
+	values, err := gcraScript.Run(ctx, r.Client, []string{r.Prefix + policy.Name + ":" + key},
+		now, policy.Period.Milliseconds(), policy.Limit).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{
+		Allowed:    values[0] == 1,
+		Remaining:  int(values[1]),
+		Reset:      time.Duration(values[2]) * time.Millisecond,
+		RetryAfter: time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,191 @@
+package reconcile
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"sync/atomic"
+	"time"
+
+	cacheoperations "github.com/cal1co/movielogv2-postservice/rediscache"
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/gocql/gocql"
+)
+
+var (
+	checkedTotal  = expvar.NewInt("reconcile_checked_total")
+	driftTotal    = expvar.NewInt("reconcile_drift_total")
+	repairedTotal = expvar.NewInt("reconcile_repaired_total")
+
+	// passStarted is when the latest complete pass began, in unix
+	// nanoseconds. Counts can have drifted unnoticed since then, which
+	// reconcile_lag_seconds reports; until a pass completes it counts from
+	// startup.
+	passStarted atomic.Int64
+)
+
+func init() {
+	passStarted.Store(time.Now().UnixNano())
+	expvar.Publish("reconcile_lag_seconds", expvar.Func(func() interface{} {
+		return time.Since(time.Unix(0, passStarted.Load())).Seconds()
+	}))
+}
+
+const (
+	LikesCounter    = "likes"
+	CommentsCounter = "comments"
+)
+
+// Drift is a stored counter that disagrees with the rows it counts.
+type Drift struct {
+	PostID  gocql.UUID
+	Counter string
+	Stored  int
+	Actual  int
+}
+
+type Report struct {
+	Checked  int
+	Drift    []Drift
+	Repaired int
+}
+
+// Reconciler recomputes like and comment counts from user_likes and
+// post_comments and compares them with the counter columns. With Repair set it
+// applies the difference as a delta and drops the cached counts. When
+// CheckLease is set it is called before every page of posts; a delta applied
+// twice by overlapping leaders is undone by the next run.
+type Reconciler struct {
+	Store      store.Store
+	Cache      cacheoperations.CounterCache
+	Repair     bool
+	PageSize   int
+	CheckLease func(ctx context.Context) error
+}
+
+func NewReconciler(s store.Store, cache cacheoperations.CounterCache) *Reconciler {
+	return &Reconciler{
+		Store:    s,
+		Cache:    cache,
+		PageSize: 100,
+	}
+}
+
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		report, err := r.Reconcile(ctx)
+		if err != nil {
+			log.Printf("Error reconciling counters: %v", err)
+		}
+		log.Printf("Reconciled %d counters: %d drifted, %d repaired", report.Checked, len(report.Drift), report.Repaired)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconcile walks every post and its comment tree once.
+func (r *Reconciler) Reconcile(ctx context.Context) (Report, error) {
+	var report Report
+	var cursor []byte
+	started := time.Now()
+	for {
+		if r.CheckLease != nil {
+			if err := r.CheckLease(ctx); err != nil {
+				return report, err
+			}
+		}
+		posts, next, err := r.Store.ScanPosts(ctx, cursor, r.PageSize)
+		if err != nil {
+			return report, err
+		}
+		for _, post := range posts {
+			if err := r.reconcileTree(ctx, post.ID, &report); err != nil {
+				return report, err
+			}
+		}
+		if len(next) == 0 {
+			passStarted.Store(started.UnixNano())
+			return report, nil
+		}
+		cursor = next
+	}
+}
+
+func (r *Reconciler) reconcileTree(ctx context.Context, postID gocql.UUID, report *Report) error {
+	if err := r.reconcileCounter(ctx, postID, LikesCounter, report); err != nil {
+		return err
+	}
+	if err := r.reconcileCounter(ctx, postID, CommentsCounter, report); err != nil {
+		return err
+	}
+	comments, err := r.Store.ListComments(ctx, postID, 0)
+	if err != nil {
+		return err
+	}
+	for _, comment := range comments {
+		if err := r.reconcileTree(ctx, comment.ID, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileCounter only reports drift that is seen twice in a row, so a like
+// or comment landing between the two reads is not mistaken for drift.
+func (r *Reconciler) reconcileCounter(ctx context.Context, postID gocql.UUID, counter string, report *Report) error {
+	report.Checked++
+	checkedTotal.Add(1)
+	stored, actual, err := r.measure(ctx, postID, counter)
+	if err != nil || stored == actual {
+		return err
+	}
+	stored2, actual2, err := r.measure(ctx, postID, counter)
+	if err != nil || stored2-actual2 != stored-actual {
+		return err
+	}
+	drift := Drift{PostID: postID, Counter: counter, Stored: stored2, Actual: actual2}
+	report.Drift = append(report.Drift, drift)
+	driftTotal.Add(1)
+	log.Printf("Counter drift on %s %s: stored %d, actual %d", postID, counter, drift.Stored, drift.Actual)
+	if !r.Repair {
+		return nil
+	}
+	if err := r.add(ctx, postID, counter, drift.Actual-drift.Stored); err != nil {
+		return err
+	}
+	if err := cacheoperations.InvalidateCounts(postID.String(), r.Cache, ctx); err != nil {
+		log.Printf("Error invalidating cached counts for %s: %v", postID, err)
+	}
+	report.Repaired++
+	repairedTotal.Add(1)
+	return nil
+}
+
+func (r *Reconciler) measure(ctx context.Context, postID gocql.UUID, counter string) (int, int, error) {
+	if counter == LikesCounter {
+		stored, err := r.Store.LikeCount(ctx, postID)
+		if err != nil {
+			return 0, 0, err
+		}
+		likers, err := r.Store.ListLikers(ctx, postID)
+		return stored, len(likers), err
+	}
+	stored, err := r.Store.CommentCount(ctx, postID)
+	if err != nil {
+		return 0, 0, err
+	}
+	comments, err := r.Store.ListComments(ctx, postID, 0)
+	return stored, len(comments), err
+}
+
+func (r *Reconciler) add(ctx context.Context, postID gocql.UUID, counter string, delta int) error {
+	if counter == LikesCounter {
+		return r.Store.AddLikeCount(ctx, postID, delta)
+	}
+	return r.Store.AddCommentCount(ctx, postID, delta)
+}
@@ -0,0 +1,70 @@
+package cacheoperations
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrCacheMiss = errors.New("cache miss")
+
+var (
+	_ CounterCache = (*RedisCache)(nil)
+	_ CounterCache = (*MemoryCache)(nil)
+)
+
+type RankedMember struct {
+	Member string
+	Score  float64
+}
+
+// CounterUpdate describes an atomic adjustment of a cached counter. A counter
+// that is not cached is left alone and ErrCacheMiss returned, since the store
+// holds the real count. RankingKey, when set, receives the new count as
+// Member's score and is kept for another RankingTTL.
+type CounterUpdate struct {
+	Key        string
+	Delta      int
+	TTL        time.Duration
+	RankingKey string
+	RankingTTL time.Duration
+	Member     string
+}
+
+// MembershipUpdate adds or removes Member from SetKey and applies a +1 or -1
+// adjustment to Counter only when the membership actually changed. Like
+// CounterUpdate it returns ErrCacheMiss unless both the set and the counter are
+// cached. Counter.Delta is ignored.
+type MembershipUpdate struct {
+	SetKey  string
+	Member  string
+	Add     bool
+	Counter CounterUpdate
+}
+
+// CounterCache is the subset of Redis the like and comment counters rely on.
+// It is only ever a read cache in front of the store. GetBytes and SetBytes
+// hold opaque values such as rendered responses; SetBytesNX only sets a value
+// that is not there yet and reports whether it did. ZAdd keeps the sorted set
+// for another ttl, if it is positive.
+type CounterCache interface {
+	Get(ctx context.Context, key string) (int, error)
+	Set(ctx context.Context, key string, value int, ttl time.Duration) error
+	GetBytes(ctx context.Context, key string) ([]byte, error)
+	SetBytes(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	SetBytesNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	SetNX(ctx context.Context, key string, value int, ttl time.Duration) error
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+	Del(ctx context.Context, keys ...string) error
+	Incr(ctx context.Context, key string) (int, error)
+	Decr(ctx context.Context, key string) (int, error)
+	AdjustCounter(ctx context.Context, update CounterUpdate) (int, error)
+	ToggleMember(ctx context.Context, update MembershipUpdate) (changed bool, count int, err error)
+	IsMember(ctx context.Context, key string, member string, ttl time.Duration, seed func() ([]string, error)) (bool, error)
+	ZAdd(ctx context.Context, key string, member string, score float64, ttl time.Duration) error
+	ZIncrBy(ctx context.Context, key string, member string, incr float64) (float64, error)
+	ZScore(ctx context.Context, key string, member string) (float64, error)
+	ZRem(ctx context.Context, key string, members ...string) error
+	ZRange(ctx context.Context, key string, start, stop int64) ([]RankedMember, error)
+	ZRevRange(ctx context.Context, key string, start, stop int64) ([]RankedMember, error)
+}
@@ -6,9 +6,8 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/cal1co/movielogv2-postservice/store"
 	"github.com/gin-gonic/gin"
-	"github.com/gocql/gocql"
-	"github.com/redis/go-redis/v9"
 )
 
 func ThrowCommentError(c *gin.Context, err error) {
@@ -21,91 +20,83 @@ func ThrowDeleteCommentError(c *gin.Context, err error) {
 	c.JSON(http.StatusNotFound, "Error deleting comment post")
 	c.AbortWithStatus(http.StatusBadRequest)
 }
-func GetPostComments(postID string, redisClient *redis.Client, ctx context.Context, session *gocql.Session) int {
+func GetPostComments(postID string, cache CounterCache, ctx context.Context, comments store.CommentStore) int {
 	commentCountKey := fmt.Sprintf("post:%s:commentcount", postID)
-	isCached, err := redisClient.Exists(ctx, commentCountKey).Result()
-	if err != nil {
-		fmt.Println("cache err:", err)
-	}
-	if isCached == 0 {
-		var commentCount int
-		if err := session.Query(`SELECT comments from post_interactions WHERE post_id=?`, postID).Scan(&commentCount); err != nil {
-			fmt.Println(err)
+	commentCount, err := cache.Get(ctx, commentCountKey)
+	if err == ErrCacheMiss {
+		commentCount = loadCount(ctx, postID, comments.CommentCount)
+		if err := cache.SetNX(ctx, commentCountKey, commentCount, time.Hour); err != nil {
+			fmt.Println("cache err:", err)
 		}
-		redisClient.Set(ctx, commentCountKey, commentCount, time.Hour).Err()
-		return commentCount
-	} else {
-		commentCount, err := redisClient.Get(ctx, commentCountKey).Int()
-		if err != nil {
-			fmt.Println(err)
-		}
-		redisClient.Expire(ctx, commentCountKey, time.Hour).Result()
 		return commentCount
 	}
-}
-func Comment(postID string, redisClient *redis.Client, ctx context.Context, c *gin.Context, session *gocql.Session, parentID string) int {
-	commentCountKey := fmt.Sprintf("post:%s:commentcount", postID)
-	GetPostComments(postID, redisClient, ctx, session)
-	err := redisClient.Incr(ctx, commentCountKey).Err()
 	if err != nil {
-		ThrowCommentError(c, err)
+		fmt.Println("cache err:", err)
 	}
-	commentCount, err := redisClient.Get(ctx, commentCountKey).Int()
-	if err != nil {
-		ThrowCommentError(c, err)
+	if err := cache.Expire(ctx, commentCountKey, time.Hour); err != nil {
+		fmt.Println(err)
 	}
-	UpdateCommentRanking(redisClient, ctx, commentCount, postID, parentID, float64(1))
-	// fmt.Println("COMMENT COUNT", commentCount)
 	return commentCount
 }
-func UpdateCommentRanking(redisClient *redis.Client, ctx context.Context, count int, commentID string, postID string, incrAmt float64) {
-	parentPostId := fmt.Sprintf("post:%s:comments", postID)
-	exists, err := redisClient.ZScore(ctx, parentPostId, commentID).Result()
-	if err != nil {
-		fmt.Println(err)
-	}
-	if exists == 0 {
-		redisClient.ZAdd(ctx, parentPostId, redis.Z{
-			Score:  float64(count),
-			Member: commentID,
-		})
-	} else {
-		_, err := redisClient.ZIncrBy(ctx, parentPostId, incrAmt, commentID).Result()
-		if err != nil {
-			fmt.Println(err)
-		}
+func commentUpdate(postID string, delta int, ranked bool, parentID string) CounterUpdate {
+	update := CounterUpdate{
+		Key:   fmt.Sprintf("post:%s:commentcount", postID),
+		Delta: delta,
+		TTL:   time.Hour,
 	}
-	comments, err := redisClient.ZRevRangeWithScores(ctx, parentPostId, 0, -1).Result()
-	if err != nil {
-		fmt.Println(err)
-	}
-	for i, comment := range comments {
-		fmt.Printf("Comment %d: %s - %f comments\n", i+1, comment.Member.(string), comment.Score)
+	if ranked {
+		update.RankingKey = repliesRankingKey(parentID)
+		update.RankingTTL = rankingTTL
+		update.Member = postID
 	}
+	return update
 }
-func DeleteComment(postID string, redisClient *redis.Client, ctx context.Context, c *gin.Context, session *gocql.Session, comment bool, parentID string) int {
-	commentCountKey := fmt.Sprintf("post:%s:commentcount", postID)
-	GetPostComments(postID, redisClient, ctx, session)
-	err := redisClient.Decr(ctx, commentCountKey).Err()
-	if err != nil {
-		ThrowDeleteCommentError(c, err)
+
+// Comment and DeleteComment mirror a comment the store has already counted
+// into the cached count of postID, reloading it from the store on a miss.
+func Comment(postID string, cache CounterCache, ctx context.Context, comments store.CommentStore, comment bool, parentID string) int {
+	return adjustComments(postID, 1, cache, ctx, comments, comment, parentID)
+}
+func DeleteComment(postID string, cache CounterCache, ctx context.Context, comments store.CommentStore, comment bool, parentID string) int {
+	return adjustComments(postID, -1, cache, ctx, comments, comment, parentID)
+}
+func adjustComments(postID string, delta int, cache CounterCache, ctx context.Context, comments store.CommentStore, ranked bool, parentID string) int {
+	update := commentUpdate(postID, delta, ranked, parentID)
+	commentCount, err := cache.AdjustCounter(ctx, update)
+	if err == nil {
+		return commentCount
 	}
-	commentCount, err := redisClient.Get(ctx, commentCountKey).Int()
-	if err != nil {
-		ThrowDeleteCommentError(c, err)
+	if err != ErrCacheMiss {
+		fmt.Println("cache err:", err)
+		if err := cache.Del(ctx, update.Key); err != nil {
+			fmt.Println(err)
+		}
 	}
-	if comment {
-		UpdateCommentRanking(redisClient, ctx, commentCount, postID, parentID, float64(-1))
+	commentCount = GetPostComments(postID, cache, ctx, comments)
+	if ranked {
+		if err := cache.ZAdd(ctx, update.RankingKey, postID, float64(commentCount), rankingTTL); err != nil {
+			fmt.Println(err)
+		}
 	}
 	return commentCount
 }
 
-func GetRankingByComments(redisClient *redis.Client, ctx context.Context, page int) {
-
+// InvalidateCounts drops the cached counts of postID so they are reloaded from
+// the store on the next read.
+func InvalidateCounts(postID string, cache CounterCache, ctx context.Context) error {
+	return cache.Del(ctx, fmt.Sprintf("post:%s:likes", postID), fmt.Sprintf("post:%s:commentcount", postID))
 }
-func GetCommentRankingByDateLatest(redisClient *redis.Client, ctx context.Context, page int) {
 
+// GetRankingByComments returns limit of postID's comment IDs from offset, most replied first.
+func GetRankingByComments(postID string, cache CounterCache, ctx context.Context, offset, limit int) ([]string, error) {
+	return rankedComments(repliesRankingKey(postID), cache, ctx, offset, limit, true)
 }
-func GetCommentRankingByDateEarliest(redisClient *redis.Client, ctx context.Context, page int) {
 
+// GetCommentRankingByDateLatest and GetCommentRankingByDateEarliest page
+// through the replies of a comment, which are ranked under the comment's own ID.
+func GetCommentRankingByDateLatest(commentID string, cache CounterCache, ctx context.Context, offset, limit int) ([]string, error) {
+	return GetRankingByDateLatest(commentID, cache, ctx, offset, limit)
+}
+func GetCommentRankingByDateEarliest(commentID string, cache CounterCache, ctx context.Context, offset, limit int) ([]string, error) {
+	return GetRankingByDateEarliest(commentID, cache, ctx, offset, limit)
 }
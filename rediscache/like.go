@@ -4,11 +4,12 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/cal1co/movielogv2-postservice/store"
 	"github.com/gin-gonic/gin"
 	"github.com/gocql/gocql"
-	"github.com/redis/go-redis/v9"
 )
 
 func ThrowLikeError(c *gin.Context, err error) {
@@ -22,92 +23,120 @@ func ThrowUnlikeError(c *gin.Context, err error) {
 	c.AbortWithStatus(http.StatusBadRequest)
 }
 
-func GetPostLikes(postID string, redisClient *redis.Client, ctx context.Context, session *gocql.Session) int {
+func GetPostLikes(postID string, cache CounterCache, ctx context.Context, likes store.LikeStore) int {
 	likeCountKey := fmt.Sprintf("post:%s:likes", postID)
-	isCached, err := redisClient.Exists(ctx, likeCountKey).Result()
-	if err != nil {
-		fmt.Println(err)
-	}
-	if isCached == 0 {
-		var likeCount int
-		if err := session.Query(`SELECT likes from post_interactions WHERE post_id=?`, postID).Scan(&likeCount); err != nil {
-			fmt.Println(err)
-		}
-		redisClient.Set(ctx, likeCountKey, likeCount, time.Hour).Err()
-		return likeCount
-	} else {
-		likeCount, err := redisClient.Get(ctx, likeCountKey).Int()
-		if err != nil {
+	likeCount, err := cache.Get(ctx, likeCountKey)
+	if err == ErrCacheMiss {
+		likeCount = loadCount(ctx, postID, likes.LikeCount)
+		if err := cache.SetNX(ctx, likeCountKey, likeCount, time.Hour); err != nil {
 			fmt.Println(err)
 		}
-		redisClient.Expire(ctx, likeCountKey, time.Hour).Result()
 		return likeCount
 	}
-}
-func Like(postID string, redisClient *redis.Client, ctx context.Context, c *gin.Context, session *gocql.Session, comment bool, parentID string) int {
-	likeCountKey := fmt.Sprintf("post:%s:likes", postID)
-	GetPostLikes(postID, redisClient, ctx, session)
-	err := redisClient.Incr(ctx, likeCountKey).Err()
-	if err != nil {
-		ThrowLikeError(c, err)
-	}
-	likeCount, err := redisClient.Get(ctx, likeCountKey).Int()
 	if err != nil {
-		ThrowLikeError(c, err)
+		fmt.Println(err)
 	}
-	if comment {
-		UpdateLikeRanking(redisClient, ctx, likeCount, postID, parentID, float64(1))
+	if err := cache.Expire(ctx, likeCountKey, time.Hour); err != nil {
+		fmt.Println(err)
 	}
 	return likeCount
 }
-func UpdateLikeRanking(redisClient *redis.Client, ctx context.Context, count int, commentID string, postID string, incrAmt float64) {
-	parentPostId := fmt.Sprintf("post:%s:comments", postID)
-	exists, err := redisClient.ZScore(ctx, parentPostId, commentID).Result()
+func loadCount(ctx context.Context, postID string, load func(context.Context, gocql.UUID) (int, error)) int {
+	id, err := gocql.ParseUUID(postID)
 	if err != nil {
 		fmt.Println(err)
+		return 0
 	}
-	if exists == 0 {
-		redisClient.ZAdd(ctx, parentPostId, redis.Z{
-			Score:  float64(count),
-			Member: commentID,
-		})
-	} else {
-		_, err := redisClient.ZIncrBy(ctx, parentPostId, incrAmt, commentID).Result()
-		if err != nil {
-			fmt.Println(err)
-		}
-	}
-	comments, err := redisClient.ZRevRangeWithScores(ctx, parentPostId, 0, -1).Result()
+	count, err := load(ctx, id)
 	if err != nil {
 		fmt.Println(err)
 	}
-	for i, comment := range comments {
-		fmt.Printf("Comment %d: %s - %f likes\n", i+1, comment.Member.(string), comment.Score)
+	return count
+}
+func likeUpdate(postID string, delta int, comment bool, parentID string) CounterUpdate {
+	update := CounterUpdate{
+		Key:   fmt.Sprintf("post:%s:likes", postID),
+		Delta: delta,
+		TTL:   time.Hour,
+	}
+	if comment {
+		update.RankingKey = likesRankingKey(parentID)
+		update.RankingTTL = rankingTTL
+		update.Member = postID
 	}
+	return update
 }
-func Unlike(postID string, redisClient *redis.Client, ctx context.Context, c *gin.Context, session *gocql.Session, comment bool, parentID string) int {
-	likeCountKey := fmt.Sprintf("post:%s:likes", postID)
-	GetPostLikes(postID, redisClient, ctx, session)
-	err := redisClient.Decr(ctx, likeCountKey).Err()
-	if err != nil {
-		ThrowUnlikeError(c, err)
+func likersKey(postID string) string {
+	return fmt.Sprintf("post:%s:likers", postID)
+}
+func seedLikers(ctx context.Context, postID string, likes store.LikeStore) func() ([]string, error) {
+	return func() ([]string, error) {
+		id, err := gocql.ParseUUID(postID)
+		if err != nil {
+			return nil, err
+		}
+		likers, err := likes.ListLikers(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		members := make([]string, 0, len(likers))
+		for _, uid := range likers {
+			members = append(members, strconv.Itoa(uid))
+		}
+		return members, nil
 	}
-	likeCount, err := redisClient.Get(ctx, likeCountKey).Int()
-	if err != nil {
-		ThrowUnlikeError(c, err)
+}
+
+// Like mirrors a like that the store has already recorded into the cache and
+// returns the new count. Only cached entries are adjusted; if they are missing
+// or disagree with the store they are dropped and reloaded on the next read.
+func Like(postID string, uid int, cache CounterCache, ctx context.Context, likes store.LikeStore, comment bool, parentID string) int {
+	return toggleLike(postID, uid, true, cache, ctx, likes, comment, parentID)
+}
+func Unlike(postID string, uid int, cache CounterCache, ctx context.Context, likes store.LikeStore, comment bool, parentID string) int {
+	return toggleLike(postID, uid, false, cache, ctx, likes, comment, parentID)
+}
+func toggleLike(postID string, uid int, add bool, cache CounterCache, ctx context.Context, likes store.LikeStore, comment bool, parentID string) int {
+	update := MembershipUpdate{
+		SetKey:  likersKey(postID),
+		Member:  strconv.Itoa(uid),
+		Add:     add,
+		Counter: likeUpdate(postID, 0, comment, parentID),
+	}
+	changed, likeCount, err := cache.ToggleMember(ctx, update)
+	if err == nil && changed {
+		return likeCount
 	}
+	if err != nil && err != ErrCacheMiss {
+		fmt.Println(err)
+	}
+	if err := cache.Del(ctx, update.SetKey, update.Counter.Key); err != nil {
+		fmt.Println(err)
+	}
+	likeCount = GetPostLikes(postID, cache, ctx, likes)
 	if comment {
-		UpdateLikeRanking(redisClient, ctx, likeCount, postID, parentID, float64(-1))
+		if err := cache.ZAdd(ctx, update.Counter.RankingKey, postID, float64(likeCount), rankingTTL); err != nil {
+			fmt.Println(err)
+		}
 	}
 	return likeCount
 }
-
-func GetRankingByLikes(redisClient *redis.Client, ctx context.Context, page int) {
-
+func LikedByUser(postID string, uid int, cache CounterCache, ctx context.Context, likes store.LikeStore) bool {
+	liked, err := cache.IsMember(ctx, likersKey(postID), strconv.Itoa(uid), time.Hour, seedLikers(ctx, postID, likes))
+	if err != nil {
+		fmt.Println("Error checking user likes:", err)
+		return false
+	}
+	return liked
 }
-func GetRankingByDateLatest(redisClient *redis.Client, ctx context.Context, page int) {
 
+// GetRankingByLikes returns limit of postID's comment IDs from offset, most liked first.
+func GetRankingByLikes(postID string, cache CounterCache, ctx context.Context, offset, limit int) ([]string, error) {
+	return rankedComments(likesRankingKey(postID), cache, ctx, offset, limit, true)
 }
-func GetRankingByDateEarliest(redisClient *redis.Client, ctx context.Context, page int) {
-
+func GetRankingByDateLatest(postID string, cache CounterCache, ctx context.Context, offset, limit int) ([]string, error) {
+	return rankedComments(timeRankingKey(postID), cache, ctx, offset, limit, true)
+}
+func GetRankingByDateEarliest(postID string, cache CounterCache, ctx context.Context, offset, limit int) ([]string, error) {
+	return rankedComments(timeRankingKey(postID), cache, ctx, offset, limit, false)
 }
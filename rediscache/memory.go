@@ -0,0 +1,345 @@
+package cacheoperations
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	value   int
+	bytes   []byte
+	zset    map[string]float64
+	set     map[string]struct{}
+	expires time.Time
+}
+
+// MemoryCache is an in-process CounterCache with Redis-like TTL and sorted-set behaviour.
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: make(map[string]*memoryEntry)}
+}
+
+func (m *MemoryCache) lookup(key string) *memoryEntry {
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+	if !entry.expires.IsZero() && !time.Now().Before(entry.expires) {
+		delete(m.entries, key)
+		return nil
+	}
+	return entry
+}
+
+func (m *MemoryCache) entry(key string) *memoryEntry {
+	entry := m.lookup(key)
+	if entry == nil {
+		entry = &memoryEntry{}
+		m.entries[key] = entry
+	}
+	return entry
+}
+
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+func (m *MemoryCache) Get(ctx context.Context, key string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := m.lookup(key)
+	if entry == nil || entry.zset != nil || entry.set != nil || entry.bytes != nil {
+		return 0, ErrCacheMiss
+	}
+	return entry.value, nil
+}
+
+func (m *MemoryCache) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := m.lookup(key)
+	if entry == nil || entry.bytes == nil {
+		return nil, ErrCacheMiss
+	}
+	return entry.bytes, nil
+}
+
+func (m *MemoryCache) SetBytes(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = &memoryEntry{bytes: append([]byte{}, value...), expires: expiry(ttl)}
+	return nil
+}
+
+func (m *MemoryCache) Set(ctx context.Context, key string, value int, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = &memoryEntry{value: value, expires: expiry(ttl)}
+	return nil
+}
+
+func (m *MemoryCache) SetBytesNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lookup(key) != nil {
+		return false, nil
+	}
+	m.entries[key] = &memoryEntry{bytes: append([]byte{}, value...), expires: expiry(ttl)}
+	return true, nil
+}
+
+func (m *MemoryCache) SetNX(ctx context.Context, key string, value int, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lookup(key) == nil {
+		m.entries[key] = &memoryEntry{value: value, expires: expiry(ttl)}
+	}
+	return nil
+}
+
+func (m *MemoryCache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry := m.lookup(key); entry != nil {
+		entry.expires = expiry(ttl)
+	}
+	return nil
+}
+
+func (m *MemoryCache) Del(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+func (m *MemoryCache) incrBy(key string, delta int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := m.entry(key)
+	entry.value += delta
+	return entry.value
+}
+
+func (m *MemoryCache) Incr(ctx context.Context, key string) (int, error) {
+	return m.incrBy(key, 1), nil
+}
+
+func (m *MemoryCache) Decr(ctx context.Context, key string) (int, error) {
+	return m.incrBy(key, -1), nil
+}
+
+func (m *MemoryCache) AdjustCounter(ctx context.Context, update CounterUpdate) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := m.lookup(update.Key)
+	if entry == nil {
+		return 0, ErrCacheMiss
+	}
+	entry.value += update.Delta
+	if update.TTL > 0 {
+		entry.expires = expiry(update.TTL)
+	}
+	if update.RankingKey != "" {
+		m.zadd(update.RankingKey, update.Member, float64(entry.value), update.RankingTTL)
+	}
+	return entry.value, nil
+}
+
+func (m *MemoryCache) ToggleMember(ctx context.Context, update MembershipUpdate) (bool, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	set := m.lookup(update.SetKey)
+	counter := m.lookup(update.Counter.Key)
+	if set == nil || counter == nil {
+		return false, 0, ErrCacheMiss
+	}
+	_, present := set.set[update.Member]
+	changed := present != update.Add
+	if changed {
+		if update.Add {
+			set.set[update.Member] = struct{}{}
+			counter.value++
+		} else {
+			delete(set.set, update.Member)
+			counter.value--
+		}
+	}
+	if update.Counter.TTL > 0 {
+		set.expires = expiry(update.Counter.TTL)
+		counter.expires = expiry(update.Counter.TTL)
+	}
+	if changed && update.Counter.RankingKey != "" {
+		m.zadd(update.Counter.RankingKey, update.Counter.Member, float64(counter.value), update.Counter.RankingTTL)
+	}
+	return changed, counter.value, nil
+}
+
+func (m *MemoryCache) seedSet(key string, members []string) *memoryEntry {
+	entry := &memoryEntry{set: make(map[string]struct{}, len(members))}
+	for _, member := range members {
+		entry.set[member] = struct{}{}
+	}
+	m.entries[key] = entry
+	return entry
+}
+
+func (m *MemoryCache) IsMember(ctx context.Context, key string, member string, ttl time.Duration, seed func() ([]string, error)) (bool, error) {
+	if found, ok := m.isMember(key, member, ttl, nil, false); ok {
+		return found, nil
+	}
+	var members []string
+	if seed != nil {
+		var err error
+		if members, err = seed(); err != nil {
+			return false, err
+		}
+	}
+	found, _ := m.isMember(key, member, ttl, members, true)
+	return found, nil
+}
+
+func (m *MemoryCache) isMember(key string, member string, ttl time.Duration, members []string, seeded bool) (bool, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := m.lookup(key)
+	if entry == nil {
+		if !seeded {
+			return false, false
+		}
+		entry = m.seedSet(key, members)
+	}
+	if ttl > 0 {
+		entry.expires = expiry(ttl)
+	}
+	_, found := entry.set[member]
+	return found, true
+}
+
+func (m *MemoryCache) zset(key string) map[string]float64 {
+	entry := m.entry(key)
+	if entry.zset == nil {
+		entry.zset = make(map[string]float64)
+	}
+	return entry.zset
+}
+
+func (m *MemoryCache) zadd(key string, member string, score float64, ttl time.Duration) {
+	m.zset(key)[member] = score
+	if ttl > 0 {
+		m.entries[key].expires = expiry(ttl)
+	}
+}
+
+func (m *MemoryCache) ZAdd(ctx context.Context, key string, member string, score float64, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.zadd(key, member, score, ttl)
+	return nil
+}
+
+func (m *MemoryCache) ZIncrBy(ctx context.Context, key string, member string, incr float64) (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	zset := m.zset(key)
+	zset[member] += incr
+	return zset[member], nil
+}
+
+func (m *MemoryCache) ZScore(ctx context.Context, key string, member string) (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := m.lookup(key)
+	if entry == nil {
+		return 0, ErrCacheMiss
+	}
+	score, ok := entry.zset[member]
+	if !ok {
+		return 0, ErrCacheMiss
+	}
+	return score, nil
+}
+
+func (m *MemoryCache) ZRem(ctx context.Context, key string, members ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := m.lookup(key)
+	if entry == nil {
+		return nil
+	}
+	for _, member := range members {
+		delete(entry.zset, member)
+	}
+	if len(entry.zset) == 0 {
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+func (m *MemoryCache) ZRange(ctx context.Context, key string, start, stop int64) ([]RankedMember, error) {
+	return m.zrange(key, start, stop, false), nil
+}
+
+func (m *MemoryCache) ZRevRange(ctx context.Context, key string, start, stop int64) ([]RankedMember, error) {
+	return m.zrange(key, start, stop, true), nil
+}
+
+func (m *MemoryCache) zrange(key string, start, stop int64, reverse bool) []RankedMember {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := m.lookup(key)
+	if entry == nil {
+		return []RankedMember{}
+	}
+	return sliceRange(sortedMembers(entry.zset, reverse), start, stop)
+}
+
+func sortedMembers(zset map[string]float64, reverse bool) []RankedMember {
+	ranked := make([]RankedMember, 0, len(zset))
+	for member, score := range zset {
+		ranked = append(ranked, RankedMember{Member: member, Score: score})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score < ranked[j].Score
+		}
+		return ranked[i].Member < ranked[j].Member
+	})
+	if reverse {
+		for i, j := 0, len(ranked)-1; i < j; i, j = i+1, j-1 {
+			ranked[i], ranked[j] = ranked[j], ranked[i]
+		}
+	}
+	return ranked
+}
+
+func sliceRange(ranked []RankedMember, start, stop int64) []RankedMember {
+	n := int64(len(ranked))
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return []RankedMember{}
+	}
+	return ranked[start : stop+1]
+}
@@ -0,0 +1,142 @@
+package cacheoperations
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/gocql/gocql"
+)
+
+// Each post keeps one sorted set of its comment IDs per ordering, so like and
+// reply counts never overwrite each other's scores.
+func likesRankingKey(postID string) string {
+	return fmt.Sprintf("post:%s:comments:likes", postID)
+}
+func repliesRankingKey(postID string) string {
+	return fmt.Sprintf("post:%s:comments:replies", postID)
+}
+func timeRankingKey(postID string) string {
+	return fmt.Sprintf("post:%s:comments:time", postID)
+}
+func rankingsLoadedKey(postID string) string {
+	return fmt.Sprintf("post:%s:comments:ranked", postID)
+}
+
+// rankingTTL is how long rankings are kept. Every write to a ranking extends
+// it, so that rankings outlive their loaded marker and a ranking started by
+// a write to a post whose rankings were never loaded still expires.
+const rankingTTL = 24 * time.Hour
+
+// AddCommentRankings places a new comment in every ranking of its parent.
+func AddCommentRankings(parentID string, commentID string, createdAt time.Time, cache CounterCache, ctx context.Context) {
+	rankings := []struct {
+		key   string
+		score float64
+	}{
+		{likesRankingKey(parentID), 0},
+		{repliesRankingKey(parentID), 0},
+		{timeRankingKey(parentID), float64(createdAt.UnixMilli())},
+	}
+	for _, ranking := range rankings {
+		if err := cache.ZAdd(ctx, ranking.key, commentID, ranking.score, rankingTTL); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// LoadCommentRankings rebuilds the rankings of postID from the store unless
+// they were already built within the last rankingTTL.
+func LoadCommentRankings(postID string, cache CounterCache, ctx context.Context, comments store.CommentStore, likes store.LikeStore) error {
+	if _, err := cache.Get(ctx, rankingsLoadedKey(postID)); err != ErrCacheMiss {
+		return err
+	}
+	id, err := gocql.ParseUUID(postID)
+	if err != nil {
+		return err
+	}
+	records, err := comments.ListComments(ctx, id, 0)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		likeCount, err := likes.LikeCount(ctx, record.ID)
+		if err != nil {
+			return err
+		}
+		replyCount, err := comments.CommentCount(ctx, record.ID)
+		if err != nil {
+			return err
+		}
+		if err := cache.ZAdd(ctx, likesRankingKey(postID), record.ID.String(), float64(likeCount), rankingTTL); err != nil {
+			return err
+		}
+		if err := cache.ZAdd(ctx, repliesRankingKey(postID), record.ID.String(), float64(replyCount), rankingTTL); err != nil {
+			return err
+		}
+		if err := cache.ZAdd(ctx, timeRankingKey(postID), record.ID.String(), float64(record.CreatedAt.UnixMilli()), rankingTTL); err != nil {
+			return err
+		}
+	}
+	if err := cache.SetNX(ctx, rankingsLoadedKey(postID), 1, rankingTTL); err != nil {
+		return err
+	}
+	// Extended after the marker is set, so the rankings never expire first.
+	for _, key := range []string{likesRankingKey(postID), repliesRankingKey(postID), timeRankingKey(postID)} {
+		if err := cache.Expire(ctx, key, rankingTTL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveCommentRankings takes a deleted comment out of its parent's rankings.
+func RemoveCommentRankings(parentID string, commentID string, cache CounterCache, ctx context.Context) error {
+	for _, key := range []string{likesRankingKey(parentID), repliesRankingKey(parentID), timeRankingKey(parentID)} {
+		if err := cache.ZRem(ctx, key, commentID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClearPostCache drops everything cached about a deleted post or comment: its
+// counts, likers and the rankings of its comments.
+func ClearPostCache(postID string, cache CounterCache, ctx context.Context) error {
+	return cache.Del(ctx,
+		fmt.Sprintf("post:%s:likes", postID),
+		fmt.Sprintf("post:%s:commentcount", postID),
+		likersKey(postID),
+		likesRankingKey(postID),
+		repliesRankingKey(postID),
+		timeRankingKey(postID),
+		rankingsLoadedKey(postID),
+	)
+}
+
+func rankedComments(key string, cache CounterCache, ctx context.Context, offset, limit int, reverse bool) ([]string, error) {
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 {
+		return []string{}, nil
+	}
+	start := int64(offset)
+	stop := start + int64(limit) - 1
+	var ranked []RankedMember
+	var err error
+	if reverse {
+		ranked, err = cache.ZRevRange(ctx, key, start, stop)
+	} else {
+		ranked, err = cache.ZRange(ctx, key, start, stop)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(ranked))
+	for _, member := range ranked {
+		ids = append(ids, member.Member)
+	}
+	return ids, nil
+}
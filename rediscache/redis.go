@@ -0,0 +1,232 @@
+package cacheoperations
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type RedisCache struct {
+	Client *redis.Client
+}
+
+func NewRedisCache(client *redis.Client) *RedisCache {
+	return &RedisCache{Client: client}
+}
+
+func missing(err error) error {
+	if err == redis.Nil {
+		return ErrCacheMiss
+	}
+	return err
+}
+
+func (r *RedisCache) Get(ctx context.Context, key string) (int, error) {
+	value, err := r.Client.Get(ctx, key).Int()
+	return value, missing(err)
+}
+
+func (r *RedisCache) Set(ctx context.Context, key string, value int, ttl time.Duration) error {
+	return r.Client.Set(ctx, key, value, ttl).Err()
+}
+
+func (r *RedisCache) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	value, err := r.Client.Get(ctx, key).Bytes()
+	return value, missing(err)
+}
+
+func (r *RedisCache) SetBytes(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return r.Client.Set(ctx, key, value, ttl).Err()
+}
+
+func (r *RedisCache) SetBytesNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	return r.Client.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (r *RedisCache) SetNX(ctx context.Context, key string, value int, ttl time.Duration) error {
+	return r.Client.SetNX(ctx, key, value, ttl).Err()
+}
+
+func (r *RedisCache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return r.Client.Expire(ctx, key, ttl).Err()
+}
+
+func (r *RedisCache) Del(ctx context.Context, keys ...string) error {
+	return r.Client.Del(ctx, keys...).Err()
+}
+
+func (r *RedisCache) Incr(ctx context.Context, key string) (int, error) {
+	value, err := r.Client.Incr(ctx, key).Result()
+	return int(value), err
+}
+
+func (r *RedisCache) Decr(ctx context.Context, key string) (int, error) {
+	value, err := r.Client.Decr(ctx, key).Result()
+	return int(value), err
+}
+
+// KEYS[1] counter, KEYS[2] optional ranking set.
+// ARGV[1] delta, ARGV[2] ttl in ms, ARGV[3] ranking member, ARGV[4] ranking ttl in ms.
+var adjustCounterScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+local count = redis.call('INCRBY', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+if KEYS[2] then
+	redis.call('ZADD', KEYS[2], count, ARGV[3])
+	if tonumber(ARGV[4]) > 0 then
+		redis.call('PEXPIRE', KEYS[2], ARGV[4])
+	end
+end
+return count
+`)
+
+func (r *RedisCache) AdjustCounter(ctx context.Context, update CounterUpdate) (int, error) {
+	keys := []string{update.Key}
+	if update.RankingKey != "" {
+		keys = append(keys, update.RankingKey)
+	}
+	count, err := adjustCounterScript.Run(ctx, r.Client, keys, update.Delta, update.TTL.Milliseconds(), update.Member, update.RankingTTL.Milliseconds()).Int()
+	return count, missing(err)
+}
+
+// loadedMarker keeps a seeded set alive in Redis even when it has no real members.
+const loadedMarker = "*"
+
+// KEYS[1] member set, KEYS[2] counter, KEYS[3] optional ranking set.
+// ARGV[1] member, ARGV[2] 1 to add or 0 to remove, ARGV[3] ttl in ms,
+// ARGV[4] ranking member, ARGV[5] ranking ttl in ms.
+var toggleMemberScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 or redis.call('EXISTS', KEYS[2]) == 0 then
+	return false
+end
+local changed
+local count
+if ARGV[2] == '1' then
+	changed = redis.call('SADD', KEYS[1], ARGV[1])
+	if changed == 1 then
+		count = redis.call('INCR', KEYS[2])
+	end
+else
+	changed = redis.call('SREM', KEYS[1], ARGV[1])
+	if changed == 1 then
+		count = redis.call('DECR', KEYS[2])
+	end
+end
+if changed == 0 then
+	count = tonumber(redis.call('GET', KEYS[2]))
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+	redis.call('PEXPIRE', KEYS[2], ARGV[3])
+end
+if changed == 1 and KEYS[3] then
+	redis.call('ZADD', KEYS[3], count, ARGV[4])
+	if tonumber(ARGV[5]) > 0 then
+		redis.call('PEXPIRE', KEYS[3], ARGV[5])
+	end
+end
+return {changed, count}
+`)
+
+func (r *RedisCache) ToggleMember(ctx context.Context, update MembershipUpdate) (bool, int, error) {
+	keys := []string{update.SetKey, update.Counter.Key}
+	if update.Counter.RankingKey != "" {
+		keys = append(keys, update.Counter.RankingKey)
+	}
+	add := 0
+	if update.Add {
+		add = 1
+	}
+	res, err := toggleMemberScript.Run(ctx, r.Client, keys, update.Member, add, update.Counter.TTL.Milliseconds(), update.Counter.Member, update.Counter.RankingTTL.Milliseconds()).Int64Slice()
+	if err != nil {
+		return false, 0, missing(err)
+	}
+	return res[0] == 1, int(res[1]), nil
+}
+
+// KEYS[1] member set. ARGV[1] member, ARGV[2] ttl in ms, ARGV[3] set when seeding, ARGV[4..] set seed.
+var isMemberScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	if ARGV[3] == nil then
+		return false
+	end
+	redis.call('SADD', KEYS[1], '` + loadedMarker + `')
+	for i = 4, #ARGV do
+		redis.call('SADD', KEYS[1], ARGV[i])
+	end
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return redis.call('SISMEMBER', KEYS[1], ARGV[1])
+`)
+
+func (r *RedisCache) IsMember(ctx context.Context, key string, member string, ttl time.Duration, seed func() ([]string, error)) (bool, error) {
+	args := []interface{}{member, ttl.Milliseconds()}
+	found, err := isMemberScript.Run(ctx, r.Client, []string{key}, args...).Int()
+	if err == redis.Nil {
+		var members []string
+		if seed != nil {
+			if members, err = seed(); err != nil {
+				return false, err
+			}
+		}
+		args = append(args, 1)
+		for _, m := range members {
+			args = append(args, m)
+		}
+		found, err = isMemberScript.Run(ctx, r.Client, []string{key}, args...).Int()
+	}
+	return found == 1, err
+}
+
+func (r *RedisCache) ZAdd(ctx context.Context, key string, member string, score float64, ttl time.Duration) error {
+	_, err := r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, key, redis.Z{Score: score, Member: member})
+		if ttl > 0 {
+			pipe.PExpire(ctx, key, ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *RedisCache) ZIncrBy(ctx context.Context, key string, member string, incr float64) (float64, error) {
+	return r.Client.ZIncrBy(ctx, key, incr, member).Result()
+}
+
+func (r *RedisCache) ZScore(ctx context.Context, key string, member string) (float64, error) {
+	score, err := r.Client.ZScore(ctx, key, member).Result()
+	return score, missing(err)
+}
+
+func (r *RedisCache) ZRem(ctx context.Context, key string, members ...string) error {
+	values := make([]interface{}, 0, len(members))
+	for _, member := range members {
+		values = append(values, member)
+	}
+	return r.Client.ZRem(ctx, key, values...).Err()
+}
+
+func (r *RedisCache) ZRange(ctx context.Context, key string, start, stop int64) ([]RankedMember, error) {
+	members, err := r.Client.ZRangeWithScores(ctx, key, start, stop).Result()
+	return rankedMembers(members), err
+}
+
+func (r *RedisCache) ZRevRange(ctx context.Context, key string, start, stop int64) ([]RankedMember, error) {
+	members, err := r.Client.ZRevRangeWithScores(ctx, key, start, stop).Result()
+	return rankedMembers(members), err
+}
+
+func rankedMembers(members []redis.Z) []RankedMember {
+	ranked := make([]RankedMember, 0, len(members))
+	for _, z := range members {
+		ranked = append(ranked, RankedMember{Member: z.Member.(string), Score: z.Score})
+	}
+	return ranked
+}
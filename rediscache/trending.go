@@ -0,0 +1,123 @@
+package cacheoperations
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TrendingWindow is a span hashtags trend over. Uses are counted in Buckets
+// sorted sets of Length/Buckets each, so old uses fall out as whole buckets
+// expire and recent buckets can be weighted above older ones.
+type TrendingWindow struct {
+	Name    string
+	Length  time.Duration
+	Buckets int
+}
+
+// bucketTopN is how many of each bucket's leaders are combined when ranking;
+// a tag that only shows up further down every bucket is not trending.
+const bucketTopN = 100
+
+// trendingHalfLives is how many times a use's weight halves across its window.
+const trendingHalfLives = 4
+
+func (w TrendingWindow) bucketLength() time.Duration {
+	buckets := w.Buckets
+	if buckets <= 0 {
+		buckets = 1
+	}
+	return w.Length / time.Duration(buckets)
+}
+
+func trendingKey(window string, bucket time.Time) string {
+	return fmt.Sprintf("trending:%s:%d", window, bucket.Unix())
+}
+
+// DefaultTrendingWindows are the windows used when none are configured.
+func DefaultTrendingWindows() []TrendingWindow {
+	return []TrendingWindow{
+		{Name: "1h", Length: time.Hour, Buckets: 12},
+		{Name: "24h", Length: 24 * time.Hour, Buckets: 24},
+		{Name: "168h", Length: 7 * 24 * time.Hour, Buckets: 28},
+	}
+}
+
+// ParseTrendingWindows reads a comma separated list of durations, each
+// optionally followed by /buckets, such as "1h/12,24h". A window is named by
+// its duration as written and has 12 buckets unless told otherwise.
+func ParseTrendingWindows(value string) ([]TrendingWindow, error) {
+	var windows []TrendingWindow
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		name, buckets, hasBuckets := strings.Cut(entry, "/")
+		length, err := time.ParseDuration(name)
+		if err != nil || length <= 0 {
+			return nil, fmt.Errorf("invalid trending window %q", entry)
+		}
+		window := TrendingWindow{Name: name, Length: length, Buckets: 12}
+		if hasBuckets {
+			if window.Buckets, err = strconv.Atoi(buckets); err != nil || window.Buckets <= 0 {
+				return nil, fmt.Errorf("invalid trending window %q", entry)
+			}
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// RecordHashtags counts one use of each tag at the given time in every window.
+func RecordHashtags(tags []string, at time.Time, windows []TrendingWindow, cache CounterCache, ctx context.Context) error {
+	for _, window := range windows {
+		length := window.bucketLength()
+		key := trendingKey(window.Name, at.Truncate(length))
+		for _, tag := range tags {
+			if _, err := cache.ZIncrBy(ctx, key, tag, 1); err != nil {
+				return err
+			}
+		}
+		if len(tags) > 0 {
+			if err := cache.Expire(ctx, key, window.Length+length); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// TrendingHashtags ranks the tags used within window before now, with each
+// bucket's counts decayed by its age.
+func TrendingHashtags(window TrendingWindow, now time.Time, limit int, cache CounterCache, ctx context.Context) ([]RankedMember, error) {
+	length := window.bucketLength()
+	scores := map[string]float64{}
+	current := now.Truncate(length)
+	for bucket := current; now.Sub(bucket) < window.Length; bucket = bucket.Add(-length) {
+		ranked, err := cache.ZRevRange(ctx, trendingKey(window.Name, bucket), 0, bucketTopN-1)
+		if err != nil {
+			return nil, err
+		}
+		age := now.Sub(bucket).Seconds() / window.Length.Seconds()
+		weight := math.Pow(0.5, trendingHalfLives*age)
+		for _, member := range ranked {
+			scores[member.Member] += member.Score * weight
+		}
+	}
+	trending := make([]RankedMember, 0, len(scores))
+	for tag, score := range scores {
+		trending = append(trending, RankedMember{Member: tag, Score: score})
+	}
+	sort.Slice(trending, func(i, j int) bool {
+		if trending[i].Score != trending[j].Score {
+			return trending[i].Score > trending[j].Score
+		}
+		return trending[i].Member < trending[j].Member
+	})
+	if limit > 0 && len(trending) > limit {
+		trending = trending[:limit]
+	}
+	return trending, nil
+}
@@ -0,0 +1,76 @@
+package search
+
+import (
+	"context"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+var (
+	_ SearchBackend = (*Elasticsearch)(nil)
+	_ SearchBackend = (*Local)(nil)
+)
+
+// SearchBackend keeps posts searchable. IndexPost and DeletePost may apply
+// asynchronously; IndexPostNow only returns once doc is written. Suggest
+// completes prefix to at most size suggestions: hashtags and mentions first,
+// then posts containing words that start with prefix. A prefix that starts with # or @ only completes that kind of entity.
+type SearchBackend interface {
+	IndexPost(doc Document)
+	IndexPostNow(ctx context.Context, doc Document) error
+	DeletePost(id string)
+	Search(ctx context.Context, req Request) (Results, error)
+	Suggest(ctx context.Context, prefix string, size int) ([]Suggestion, error)
+}
+
+// Elasticsearch searches the index or alias Index and writes to it through a
+// bulk Indexer, which has to be running for writes to arrive. The Indexer
+// mirrors writes into the index a Reindexer of Index is filling.
+type Elasticsearch struct {
+	Client  *elasticsearch.Client
+	Index   string
+	Indexer *Indexer
+}
+
+func NewElasticsearch(client *elasticsearch.Client, index string) *Elasticsearch {
+	indexer := NewIndexer(client, index)
+	indexer.Mirror = MirrorAlias(index)
+	return &Elasticsearch{
+		Client:  client,
+		Index:   index,
+		Indexer: indexer,
+	}
+}
+
+// EnsureIndex creates Index with Mapping unless an index or alias of that
+// name exists already. It is created as Index-initial behind an alias, the
+// way a Reindexer leaves it, so instances starting together all end up on the
+// same index and a reindex can later swap it out.
+func (e *Elasticsearch) EnsureIndex(ctx context.Context) error {
+	exists, err := indexExists(ctx, e.Client, e.Index)
+	if err != nil || exists {
+		return err
+	}
+	initial := e.Index + "-initial"
+	if err := createIndex(ctx, e.Client, initial); err != nil {
+		// Another instance may have just created it.
+		if exists, _ := indexExists(ctx, e.Client, initial); !exists {
+			return err
+		}
+	}
+	return updateAliases(ctx, e.Client, []map[string]map[string]string{
+		{"add": {"index": initial, "alias": e.Index}},
+	})
+}
+
+func (e *Elasticsearch) IndexPost(doc Document) {
+	e.Indexer.IndexPost(doc)
+}
+
+func (e *Elasticsearch) IndexPostNow(ctx context.Context, doc Document) error {
+	return e.Indexer.IndexPostNow(ctx, doc)
+}
+
+func (e *Elasticsearch) DeletePost(id string) {
+	e.Indexer.DeletePost(id)
+}
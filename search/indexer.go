@@ -0,0 +1,334 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/entities"
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+var (
+	indexedTotal = expvar.NewInt("search_indexed_total")
+	failedTotal  = expvar.NewInt("search_index_failed_total")
+)
+
+// Document is what a post looks like in the search index.
+type Document struct {
+	PostID      string     `json:"post_id"`
+	UserID      int        `json:"user_id"`
+	PostContent string     `json:"post_content"`
+	CreatedAt   time.Time  `json:"created_at"`
+	EditedAt    *time.Time `json:"edited_at,omitempty"`
+	Media       []string   `json:"media"`
+	Likes       int        `json:"like_count"`
+	Comments    int        `json:"comments_count"`
+	Hashtags    []string   `json:"hashtags"`
+	Mentions    []string   `json:"mentions"`
+	Suggest     []string   `json:"suggest"`
+}
+
+func NewDocument(post store.Post) Document {
+	doc := Document{
+		PostID:      post.ID.String(),
+		UserID:      post.UserID,
+		PostContent: post.Content,
+		CreatedAt:   post.CreatedAt,
+		Hashtags:    entities.Hashtags(post.Content),
+		Mentions:    entities.Mentions(post.Content),
+	}
+	for _, tag := range doc.Hashtags {
+		doc.Suggest = append(doc.Suggest, "#"+tag)
+	}
+	for _, mention := range doc.Mentions {
+		doc.Suggest = append(doc.Suggest, "@"+mention)
+	}
+	if !post.EditedAt.IsZero() {
+		doc.EditedAt = &post.EditedAt
+	}
+	return doc
+}
+
+type operation struct {
+	action string
+	id     string
+	doc    *Document
+}
+
+// Indexer queues index and delete operations and sends them to Elasticsearch
+// in bulk requests. Operations that fail with a retryable status are retried
+// up to MaxRetries times with a growing backoff, then dropped and counted in
+// search_index_failed_total.
+//
+// When Mirror is set, every operation is also sent to whatever index that
+// alias points at. A Reindexer points it at the index it is filling, so
+// posts written or deleted during a reindex are not lost when the alias is
+// swapped. The alias is looked up again every MirrorRefresh.
+type Indexer struct {
+	Client        *elasticsearch.Client
+	Index         string
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+	Backoff       time.Duration
+	Mirror        string
+	MirrorRefresh time.Duration
+
+	mu      sync.Mutex
+	pending []operation
+	full    chan struct{}
+
+	mirrorMu      sync.Mutex
+	mirrorIndex   string
+	mirrorChecked time.Time
+}
+
+func NewIndexer(client *elasticsearch.Client, index string) *Indexer {
+	return &Indexer{
+		Client:        client,
+		Index:         index,
+		BatchSize:     500,
+		FlushInterval: time.Second,
+		MaxRetries:    3,
+		Backoff:       100 * time.Millisecond,
+		MirrorRefresh: 5 * time.Second,
+		full:          make(chan struct{}, 1),
+	}
+}
+
+// IndexPost queues doc to be added to the index, replacing any earlier version.
+func (i *Indexer) IndexPost(doc Document) {
+	i.enqueue(operation{action: "index", id: doc.PostID, doc: &doc})
+}
+
+// DeletePost queues the post with id to be removed from the index.
+func (i *Indexer) DeletePost(id string) {
+	i.enqueue(operation{action: "delete", id: id})
+}
+
+// IndexPostNow sends doc in a request of its own, bypassing the queue, and
+// returns an error unless it was indexed. Failures are not retried here.
+func (i *Indexer) IndexPostNow(ctx context.Context, doc Document) error {
+	retry, failed, err := i.bulk(ctx, []operation{{action: "index", id: doc.PostID, doc: &doc}})
+	if err != nil {
+		return err
+	}
+	if len(retry) > 0 || failed > 0 {
+		return fmt.Errorf("indexing post %s failed", doc.PostID)
+	}
+	return nil
+}
+
+func (i *Indexer) enqueue(op operation) {
+	i.mu.Lock()
+	i.pending = append(i.pending, op)
+	full := len(i.pending) >= i.BatchSize
+	i.mu.Unlock()
+	if full {
+		select {
+		case i.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run flushes queued operations every FlushInterval, or sooner once a batch
+// fills up, until ctx is cancelled. Whatever is still queued then is flushed
+// one last time.
+func (i *Indexer) Run(ctx context.Context) {
+	ticker := time.NewTicker(i.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := i.Flush(flushCtx); err != nil {
+				log.Printf("Error flushing search index: %v", err)
+			}
+			return
+		case <-ticker.C:
+		case <-i.full:
+		}
+		if err := i.Flush(ctx); err != nil {
+			log.Printf("Error flushing search index: %v", err)
+		}
+	}
+}
+
+// Flush sends every queued operation, BatchSize at a time. It stops at the
+// first batch that still fails after MaxRetries.
+func (i *Indexer) Flush(ctx context.Context) error {
+	for {
+		i.mu.Lock()
+		n := len(i.pending)
+		if n > i.BatchSize {
+			n = i.BatchSize
+		}
+		batch := i.pending[:n:n]
+		i.pending = i.pending[n:]
+		i.mu.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := i.send(ctx, batch); err != nil {
+			return err
+		}
+	}
+}
+
+func (i *Indexer) send(ctx context.Context, batch []operation) error {
+	backoff := i.Backoff
+	for attempt := 0; ; attempt++ {
+		retry, _, err := i.bulk(ctx, batch)
+		if err != nil {
+			log.Printf("Error sending bulk request: %v", err)
+			retry = batch
+		}
+		if len(retry) == 0 {
+			return nil
+		}
+		if attempt == i.MaxRetries {
+			failedTotal.Add(int64(len(retry)))
+			return fmt.Errorf("gave up on %d search index operations", len(retry))
+		}
+		select {
+		case <-ctx.Done():
+			failedTotal.Add(int64(len(retry)))
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		batch = retry
+	}
+}
+
+type bulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkItemResponse `json:"items"`
+}
+
+type bulkItemResponse struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// bulk sends batch in a single request and returns the operations worth
+// retrying and how many failed for good. A request that fails as a whole is
+// returned as an error. An operation that is mirrored only counts as done
+// once it went through on both indices.
+func (i *Indexer) bulk(ctx context.Context, batch []operation) ([]operation, int, error) {
+	targets := []string{i.Index}
+	mirror, err := i.mirror(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if mirror != "" && mirror != i.Index {
+		targets = append(targets, mirror)
+	}
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, op := range batch {
+		for _, index := range targets {
+			meta := map[string]map[string]string{op.action: {"_index": index, "_id": op.id}}
+			if err := enc.Encode(meta); err != nil {
+				return nil, 0, err
+			}
+			if op.doc != nil {
+				if err := enc.Encode(op.doc); err != nil {
+					return nil, 0, err
+				}
+			}
+		}
+	}
+	req := esapi.BulkRequest{Body: &body}
+	res, err := req.Do(ctx, i.Client)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, 0, fmt.Errorf("bulk request failed: %s", res.Status())
+	}
+	var result bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, 0, err
+	}
+	if !result.Errors {
+		indexedTotal.Add(int64(len(batch)))
+		return nil, 0, nil
+	}
+	// Each operation keeps the worst outcome among its targets: failing for
+	// good beats a retry, which beats success.
+	const (
+		done = iota
+		retryable
+		failedForGood
+	)
+	outcomes := make([]int, len(batch))
+	for n, item := range result.Items {
+		if n >= len(batch)*len(targets) {
+			break
+		}
+		op := n / len(targets)
+		for _, status := range item {
+			outcome := done
+			switch {
+			case status.Status < 300, batch[op].action == "delete" && status.Status == http.StatusNotFound:
+			case status.Status == http.StatusTooManyRequests, status.Status >= 500:
+				outcome = retryable
+			default:
+				outcome = failedForGood
+				log.Printf("Error indexing post %s: %d %s", batch[op].id, status.Status, status.Error)
+			}
+			if outcome > outcomes[op] {
+				outcomes[op] = outcome
+			}
+		}
+	}
+	var retry []operation
+	failed := 0
+	for n, outcome := range outcomes {
+		switch outcome {
+		case done:
+			indexedTotal.Add(1)
+		case retryable:
+			retry = append(retry, batch[n])
+		case failedForGood:
+			failed++
+			failedTotal.Add(1)
+		}
+	}
+	return retry, failed, nil
+}
+
+// mirror returns the index Mirror points at, or "" while it points nowhere.
+func (i *Indexer) mirror(ctx context.Context) (string, error) {
+	if i.Mirror == "" {
+		return "", nil
+	}
+	i.mirrorMu.Lock()
+	defer i.mirrorMu.Unlock()
+	if !i.mirrorChecked.IsZero() && time.Since(i.mirrorChecked) < i.MirrorRefresh {
+		return i.mirrorIndex, nil
+	}
+	indices, err := aliasedIndices(ctx, i.Client, i.Mirror)
+	if err != nil {
+		return "", err
+	}
+	i.mirrorIndex = ""
+	if len(indices) > 0 {
+		i.mirrorIndex = indices[0]
+	}
+	i.mirrorChecked = time.Now()
+	return i.mirrorIndex, nil
+}
@@ -0,0 +1,390 @@
+package search
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/cal1co/movielogv2-postservice/entities"
+	"github.com/cal1co/movielogv2-postservice/store"
+)
+
+// Local is an in-process inverted index over post_content for running the
+// service without Elasticsearch. It mirrors what the Elasticsearch backend
+// asks for: AUTO fuzziness, TF-IDF-like scoring, <em> highlighting and the
+// same sort orders, but keeps everything in memory and applies writes
+// immediately.
+type Local struct {
+	mu       sync.RWMutex
+	docs     map[string]Document
+	postings map[string]map[string]int
+}
+
+func NewLocal() *Local {
+	return &Local{
+		docs:     make(map[string]Document),
+		postings: make(map[string]map[string]int),
+	}
+}
+
+// Fill indexes every post in s, for building the index at startup.
+func (l *Local) Fill(ctx context.Context, s store.Store) error {
+	var cursor []byte
+	for {
+		posts, next, err := s.ScanPosts(ctx, cursor, 500)
+		if err != nil {
+			return err
+		}
+		for _, post := range posts {
+			doc, err := LoadDocument(ctx, s, s, s, post)
+			if err != nil {
+				return err
+			}
+			l.IndexPost(doc)
+		}
+		if len(next) == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+type token struct {
+	term       string
+	start, end int
+}
+
+// tokenize splits text into lower-cased runs of letters and digits, keeping
+// their byte offsets for highlighting.
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if word && start < 0 {
+			start = i
+		}
+		if !word && start >= 0 {
+			tokens = append(tokens, token{term: strings.ToLower(text[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{term: strings.ToLower(text[start:]), start: start, end: len(text)})
+	}
+	return tokens
+}
+
+func (l *Local) IndexPost(doc Document) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.remove(doc.PostID)
+	l.docs[doc.PostID] = doc
+	for _, t := range tokenize(doc.PostContent) {
+		if l.postings[t.term] == nil {
+			l.postings[t.term] = make(map[string]int)
+		}
+		l.postings[t.term][doc.PostID]++
+	}
+}
+
+func (l *Local) IndexPostNow(ctx context.Context, doc Document) error {
+	l.IndexPost(doc)
+	return nil
+}
+
+func (l *Local) DeletePost(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.remove(id)
+}
+
+func (l *Local) remove(id string) {
+	doc, ok := l.docs[id]
+	if !ok {
+		return
+	}
+	delete(l.docs, id)
+	for _, t := range tokenize(doc.PostContent) {
+		delete(l.postings[t.term], id)
+		if len(l.postings[t.term]) == 0 {
+			delete(l.postings, t.term)
+		}
+	}
+}
+
+// maxEdits follows Elasticsearch's AUTO fuzziness.
+func maxEdits(term string) int {
+	switch n := utf8.RuneCountInString(term); {
+	case n < 3:
+		return 0
+	case n < 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance counts insertions, deletions, substitutions and, like
+// Elasticsearch's fuzzy queries, transpositions of adjacent characters.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
+
+func min(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// expand returns the indexed terms within reach of term, weighted down by
+// how many edits they are away.
+func (l *Local) expand(term string) map[string]float64 {
+	terms := map[string]float64{}
+	if _, ok := l.postings[term]; ok {
+		terms[term] = 1
+	}
+	edits := maxEdits(term)
+	if edits == 0 {
+		return terms
+	}
+	for candidate := range l.postings {
+		if candidate == term {
+			continue
+		}
+		if d := editDistance(term, candidate); d <= edits {
+			terms[candidate] = 1 - float64(d)/float64(utf8.RuneCountInString(term))
+		}
+	}
+	return terms
+}
+
+type localHit struct {
+	doc     Document
+	score   float64
+	matched map[string]bool
+	sort    []interface{}
+}
+
+func (l *Local) Search(ctx context.Context, req Request) (Results, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	hits := map[string]*localHit{}
+	queryTerms := tokenize(req.Query)
+	if len(queryTerms) == 0 {
+		for id, doc := range l.docs {
+			hits[id] = &localHit{doc: doc, score: 1}
+		}
+	}
+	for _, q := range queryTerms {
+		for term, weight := range l.expand(q.term) {
+			idf := 1 + math.Log(float64(len(l.docs))/float64(len(l.postings[term])+1))
+			for id, freq := range l.postings[term] {
+				hit, ok := hits[id]
+				if !ok {
+					hit = &localHit{doc: l.docs[id], matched: map[string]bool{}}
+					hits[id] = hit
+				}
+				hit.score += weight * math.Sqrt(float64(freq)) * idf
+				hit.matched[term] = true
+			}
+		}
+	}
+
+	var matches []*localHit
+	for _, hit := range hits {
+		if req.matches(hit.doc) {
+			hit.sort = sortValues(req.Sort, hit)
+			matches = append(matches, hit)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return compareSort(matches[i].sort, matches[j].sort) < 0
+	})
+
+	results := Results{Total: len(matches), Hits: []Hit{}}
+	start := req.From
+	if len(req.After) > 0 {
+		start = sort.Search(len(matches), func(i int) bool {
+			return compareSort(matches[i].sort, req.After) > 0
+		})
+	}
+	for i := start; i < len(matches) && len(results.Hits) < req.Size; i++ {
+		hit := matches[i]
+		var highlights []string
+		if len(hit.matched) > 0 {
+			highlights = []string{highlight(hit.doc.PostContent, hit.matched)}
+		}
+		results.Hits = append(results.Hits, Hit{Document: hit.doc, Highlights: highlights, Sort: hit.sort})
+	}
+	return results, nil
+}
+
+func (req Request) matches(doc Document) bool {
+	if req.UserID != nil && doc.UserID != *req.UserID {
+		return false
+	}
+	if req.CreatedAfter != nil && doc.CreatedAt.Before(*req.CreatedAfter) {
+		return false
+	}
+	if req.CreatedBefore != nil && !doc.CreatedAt.Before(*req.CreatedBefore) {
+		return false
+	}
+	if req.HasMedia != nil && (len(doc.Media) > 0) != *req.HasMedia {
+		return false
+	}
+	return true
+}
+
+// sortValues builds the same sort values Elasticsearch returns for each
+// order, as float64s and strings so they survive a round trip through a
+// JSON cursor. Numbers sort descending and the trailing post_id ascending.
+func sortValues(order string, hit *localHit) []interface{} {
+	created := float64(hit.doc.CreatedAt.UnixMilli())
+	switch order {
+	case SortRecency:
+		return []interface{}{created, hit.doc.PostID}
+	case SortLikes:
+		return []interface{}{float64(hit.doc.Likes), created, hit.doc.PostID}
+	default:
+		return []interface{}{hit.score, created, hit.doc.PostID}
+	}
+}
+
+func compareSort(a, b []interface{}) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		switch x := a[i].(type) {
+		case float64:
+			y, _ := b[i].(float64)
+			if x != y {
+				if x > y {
+					return -1
+				}
+				return 1
+			}
+		case string:
+			y, _ := b[i].(string)
+			if x != y {
+				return strings.Compare(x, y)
+			}
+		}
+	}
+	return 0
+}
+
+func highlight(content string, matched map[string]bool) string {
+	var b strings.Builder
+	last := 0
+	for _, t := range tokenize(content) {
+		if !matched[t.term] {
+			continue
+		}
+		b.WriteString(content[last:t.start])
+		b.WriteString("<em>")
+		b.WriteString(content[t.start:t.end])
+		b.WriteString("</em>")
+		last = t.end
+	}
+	b.WriteString(content[last:])
+	return b.String()
+}
+
+func (l *Local) Suggest(ctx context.Context, prefix string, size int) ([]Suggestion, error) {
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	prefixes := []string{prefix}
+	if !strings.HasPrefix(prefix, "#") && !strings.HasPrefix(prefix, "@") {
+		prefixes = []string{"#" + prefix, "@" + prefix}
+	}
+	suggestions := []Suggestion{}
+	for _, p := range prefixes {
+		seen := map[string]bool{}
+		var completions []string
+		for _, doc := range l.docs {
+			for _, input := range doc.Suggest {
+				if strings.HasPrefix(input, p) && !seen[input] {
+					seen[input] = true
+					completions = append(completions, input)
+				}
+			}
+		}
+		sort.Strings(completions)
+		for _, text := range completions {
+			kind := entities.Hashtag
+			if strings.HasPrefix(text, "@") {
+				kind = entities.Mention
+			}
+			suggestions = append(suggestions, Suggestion{Text: text, Type: kind})
+		}
+	}
+
+	if len(prefixes) == 2 {
+		var posts []Document
+		words := tokenize(prefix)
+		for _, doc := range l.docs {
+			if len(words) > 0 && startsWords(doc.PostContent, words) {
+				posts = append(posts, doc)
+			}
+		}
+		sort.Slice(posts, func(i, j int) bool {
+			return posts[i].CreatedAt.After(posts[j].CreatedAt)
+		})
+		for _, doc := range posts {
+			suggestions = append(suggestions, Suggestion{Text: truncate(doc.PostContent, maxSuggestionText), Type: "post", PostID: doc.PostID})
+		}
+	}
+	if len(suggestions) > size {
+		suggestions = suggestions[:size]
+	}
+	return suggestions, nil
+}
+
+// startsWords reports whether every word is the start of some word in content.
+func startsWords(content string, words []token) bool {
+	terms := tokenize(content)
+	for _, w := range words {
+		found := false
+		for _, t := range terms {
+			if strings.HasPrefix(t.term, w.term) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
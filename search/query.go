@@ -0,0 +1,170 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+const (
+	SortRelevance = "relevance"
+	SortRecency   = "recency"
+	SortLikes     = "likes"
+)
+
+// Request describes a search for posts. Every filter is optional; an empty
+// Query matches every post that passes the filters. After continues from the
+// sort values of the last hit of a previous page and cannot be combined with
+// From.
+type Request struct {
+	Query         string        `json:"query"`
+	UserID        *int          `json:"user_id"`
+	CreatedAfter  *time.Time    `json:"created_after"`
+	CreatedBefore *time.Time    `json:"created_before"`
+	HasMedia      *bool         `json:"has_media"`
+	Sort          string        `json:"sort"`
+	From          int           `json:"from"`
+	Size          int           `json:"size"`
+	After         []interface{} `json:"-"`
+}
+
+type Hit struct {
+	Document
+	Highlights []string
+	Sort       []interface{}
+}
+
+type Results struct {
+	Hits  []Hit
+	Total int
+}
+
+// sorts always end in post_id so that hits with equal scores, dates or likes
+// keep a stable order across pages.
+var sorts = map[string][]interface{}{
+	SortRelevance: {"_score", map[string]string{"created_at": "desc"}, map[string]string{"post_id": "asc"}},
+	SortRecency:   {map[string]string{"created_at": "desc"}, map[string]string{"post_id": "asc"}},
+	SortLikes:     {map[string]string{"like_count": "desc"}, map[string]string{"created_at": "desc"}, map[string]string{"post_id": "asc"}},
+}
+
+func ValidSort(sort string) bool {
+	_, ok := sorts[sort]
+	return ok || sort == ""
+}
+
+func (req Request) body() map[string]interface{} {
+	var must interface{} = map[string]interface{}{"match_all": struct{}{}}
+	if req.Query != "" {
+		must = map[string]interface{}{
+			"match": map[string]interface{}{
+				"post_content": map[string]interface{}{
+					"query":     req.Query,
+					"fuzziness": "AUTO",
+				},
+			},
+		}
+	}
+	filter := []interface{}{}
+	mustNot := []interface{}{}
+	if req.UserID != nil {
+		filter = append(filter, map[string]interface{}{"term": map[string]interface{}{"user_id": *req.UserID}})
+	}
+	if req.CreatedAfter != nil || req.CreatedBefore != nil {
+		dates := map[string]interface{}{}
+		if req.CreatedAfter != nil {
+			dates["gte"] = req.CreatedAfter.Format(time.RFC3339Nano)
+		}
+		if req.CreatedBefore != nil {
+			dates["lt"] = req.CreatedBefore.Format(time.RFC3339Nano)
+		}
+		filter = append(filter, map[string]interface{}{"range": map[string]interface{}{"created_at": dates}})
+	}
+	if req.HasMedia != nil {
+		hasMedia := map[string]interface{}{"exists": map[string]interface{}{"field": "media"}}
+		if *req.HasMedia {
+			filter = append(filter, hasMedia)
+		} else {
+			mustNot = append(mustNot, hasMedia)
+		}
+	}
+	sort := req.Sort
+	if sort == "" {
+		sort = SortRelevance
+	}
+	body := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must":     must,
+				"filter":   filter,
+				"must_not": mustNot,
+			},
+		},
+		"sort":             sorts[sort],
+		"size":             req.Size,
+		"track_total_hits": true,
+		"highlight": map[string]interface{}{
+			"fields": map[string]interface{}{
+				"post_content": struct{}{},
+			},
+		},
+	}
+	if len(req.After) > 0 {
+		body["search_after"] = req.After
+	} else {
+		body["from"] = req.From
+	}
+	return body
+}
+
+type searchResponse struct {
+	Hits struct {
+		Total struct {
+			Value int `json:"value"`
+		} `json:"total"`
+		Hits []struct {
+			Source    Document            `json:"_source"`
+			Highlight map[string][]string `json:"highlight"`
+			Sort      []interface{}       `json:"sort"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+func (e *Elasticsearch) Search(ctx context.Context, req Request) (Results, error) {
+	var results Results
+	body, err := json.Marshal(req.body())
+	if err != nil {
+		return results, err
+	}
+	search := esapi.SearchRequest{
+		Index: []string{e.Index},
+		Body:  bytes.NewReader(body),
+	}
+	res, err := search.Do(ctx, e.Client)
+	if err != nil {
+		return results, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return results, fmt.Errorf("search failed: %s", res.Status())
+	}
+	var parsed searchResponse
+	decoder := json.NewDecoder(res.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&parsed); err != nil {
+		return results, err
+	}
+	results.Total = parsed.Hits.Total.Value
+	results.Hits = []Hit{}
+	for _, hit := range parsed.Hits.Hits {
+		results.Hits = append(results.Hits, Hit{
+			Document:   hit.Source,
+			Highlights: hit.Highlight["post_content"],
+			Sort:       hit.Sort,
+		})
+	}
+	return results, nil
+}
@@ -0,0 +1,360 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/gocql/gocql"
+)
+
+// Mapping is used for every new index. post_content.autocomplete holds edge
+// n-grams of each word for search-as-you-type, and suggest completes hashtags
+// and mentions including their sigil.
+const Mapping = `{
+	"settings": {
+		"analysis": {
+			"tokenizer": {
+				"autocomplete": {
+					"type": "edge_ngram",
+					"min_gram": 1,
+					"max_gram": 20,
+					"token_chars": ["letter", "digit"]
+				}
+			},
+			"analyzer": {
+				"autocomplete": {
+					"tokenizer": "autocomplete",
+					"filter": ["lowercase"]
+				}
+			}
+		}
+	},
+	"mappings": {
+		"properties": {
+			"post_id": {"type": "keyword"},
+			"user_id": {"type": "integer"},
+			"post_content": {
+				"type": "text",
+				"fields": {
+					"autocomplete": {"type": "text", "analyzer": "autocomplete", "search_analyzer": "standard"}
+				}
+			},
+			"created_at": {"type": "date"},
+			"edited_at": {"type": "date"},
+			"media": {"type": "keyword"},
+			"like_count": {"type": "integer"},
+			"comments_count": {"type": "integer"},
+			"hashtags": {"type": "keyword"},
+			"mentions": {"type": "keyword"},
+			"suggest": {"type": "completion", "analyzer": "whitespace"}
+		}
+	}
+}`
+
+// Checkpoint records how far a reindex got, so an interrupted run can carry
+// on into the same index instead of starting over.
+type Checkpoint struct {
+	Index   string `json:"index"`
+	Cursor  []byte `json:"cursor"`
+	Indexed int    `json:"indexed"`
+}
+
+// Reindexer rebuilds the index behind Alias from the store. Every run loads
+// posts into a new index named after the alias and the time it started, and
+// only points the alias at it once every post is in, so searches keep using
+// the old index until then. Progress is saved to CheckpointPath after every
+// page.
+//
+// While it runs, MirrorAlias(Alias) points at the new index so that live
+// Indexers write there as well. Settle is how long to wait after that before
+// reading the store; it has to cover their Indexer.MirrorRefresh.
+type Reindexer struct {
+	Store          store.Store
+	Client         *elasticsearch.Client
+	Alias          string
+	PageSize       int
+	CheckpointPath string
+	Settle         time.Duration
+}
+
+func NewReindexer(s store.Store, client *elasticsearch.Client, alias string, checkpointPath string) *Reindexer {
+	return &Reindexer{
+		Store:          s,
+		Client:         client,
+		Alias:          alias,
+		PageSize:       500,
+		CheckpointPath: checkpointPath,
+		Settle:         10 * time.Second,
+	}
+}
+
+// MirrorAlias names the alias that points at the index a reindex of alias is
+// filling.
+func MirrorAlias(alias string) string {
+	return alias + "-reindex"
+}
+
+// Reindex copies every post into a new index and swaps the alias over to it,
+// returning the name of the new index.
+func (r *Reindexer) Reindex(ctx context.Context) (string, error) {
+	checkpoint, err := r.loadCheckpoint()
+	if err != nil {
+		return "", err
+	}
+	if checkpoint.Index == "" {
+		checkpoint.Index = fmt.Sprintf("%s-%s", r.Alias, time.Now().UTC().Format("20060102150405"))
+		if err := createIndex(ctx, r.Client, checkpoint.Index); err != nil {
+			return "", err
+		}
+		if err := updateAliases(ctx, r.Client, []map[string]map[string]string{
+			{"add": {"index": checkpoint.Index, "alias": MirrorAlias(r.Alias)}},
+		}); err != nil {
+			return "", err
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(r.Settle):
+		}
+		if err := r.saveCheckpoint(checkpoint); err != nil {
+			return "", err
+		}
+	} else {
+		log.Printf("Resuming reindex into %s after %d posts", checkpoint.Index, checkpoint.Indexed)
+	}
+
+	indexer := NewIndexer(r.Client, checkpoint.Index)
+	indexer.BatchSize = r.PageSize
+	for {
+		posts, next, err := r.Store.ScanPosts(ctx, checkpoint.Cursor, r.PageSize)
+		if err != nil {
+			return "", err
+		}
+		docs := make([]Document, len(posts))
+		for n, post := range posts {
+			if docs[n], err = LoadDocument(ctx, r.Store, r.Store, r.Store, post); err != nil {
+				return "", err
+			}
+			indexer.IndexPost(docs[n])
+		}
+		if err := indexer.Flush(ctx); err != nil {
+			return "", err
+		}
+		if err := r.catchUp(ctx, indexer, docs); err != nil {
+			return "", err
+		}
+		checkpoint.Cursor = next
+		checkpoint.Indexed += len(posts)
+		if err := r.saveCheckpoint(checkpoint); err != nil {
+			return "", err
+		}
+		log.Printf("Reindexed %d posts into %s", checkpoint.Indexed, checkpoint.Index)
+		if len(next) == 0 {
+			break
+		}
+	}
+
+	if err := r.swapAlias(ctx, checkpoint.Index); err != nil {
+		return "", err
+	}
+	log.Printf("Pointed %s at %s", r.Alias, checkpoint.Index)
+	return checkpoint.Index, r.clearCheckpoint()
+}
+
+// catchUp reads the posts behind docs again after they were written. A live
+// write that landed in the store between the scan and the flush was mirrored
+// before the stale copy arrived and got overwritten, so whatever changed since
+// is sent once more; anything later is mirrored after this.
+func (r *Reindexer) catchUp(ctx context.Context, indexer *Indexer, docs []Document) error {
+	changed := false
+	for _, doc := range docs {
+		id, err := gocql.ParseUUID(doc.PostID)
+		if err != nil {
+			return err
+		}
+		post, err := r.Store.GetPost(ctx, id)
+		if err == store.ErrNotFound {
+			indexer.DeletePost(doc.PostID)
+			changed = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		current, err := LoadDocument(ctx, r.Store, r.Store, r.Store, post)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(current, doc) {
+			indexer.IndexPost(current)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return indexer.Flush(ctx)
+}
+
+// LoadDocument builds the document for post with its media and counts, as it
+// is stored now.
+func LoadDocument(ctx context.Context, media store.MediaStore, likes store.LikeStore, comments store.CommentStore, post store.Post) (Document, error) {
+	doc := NewDocument(post)
+	var err error
+	if doc.Media, err = media.ListMedia(ctx, post.ID); err != nil {
+		return doc, err
+	}
+	if doc.Likes, err = likes.LikeCount(ctx, post.ID); err != nil {
+		return doc, err
+	}
+	doc.Comments, err = comments.CommentCount(ctx, post.ID)
+	return doc, err
+}
+
+// createIndex creates index with Mapping.
+func createIndex(ctx context.Context, client *elasticsearch.Client, index string) error {
+	req := esapi.IndicesCreateRequest{Index: index, Body: strings.NewReader(Mapping)}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("creating index %s failed: %s", index, res.Status())
+	}
+	return nil
+}
+
+// swapAlias points the alias at index and away from every other index in one
+// request, and stops mirroring live writes into index. A concrete index still
+// using the alias's name, from before the index was versioned, is deleted in
+// the same request.
+func (r *Reindexer) swapAlias(ctx context.Context, index string) error {
+	actions := []map[string]map[string]string{
+		{"add": {"index": index, "alias": r.Alias}},
+		{"remove": {"index": index, "alias": MirrorAlias(r.Alias)}},
+	}
+	current, err := aliasedIndices(ctx, r.Client, r.Alias)
+	if err != nil {
+		return err
+	}
+	for _, old := range current {
+		if old != index {
+			actions = append(actions, map[string]map[string]string{"remove": {"index": old, "alias": r.Alias}})
+		}
+	}
+	if len(current) == 0 {
+		exists, err := indexExists(ctx, r.Client, r.Alias)
+		if err != nil {
+			return err
+		}
+		if exists {
+			actions = append(actions, map[string]map[string]string{"remove_index": {"index": r.Alias}})
+		}
+	}
+	return updateAliases(ctx, r.Client, actions)
+}
+
+// indexExists reports whether an index or alias called name exists.
+func indexExists(ctx context.Context, client *elasticsearch.Client, name string) (bool, error) {
+	res, err := esapi.IndicesExistsRequest{Index: []string{name}}.Do(ctx, client)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return false, nil
+	case res.IsError():
+		return false, fmt.Errorf("looking up index %s failed: %s", name, res.Status())
+	}
+	return true, nil
+}
+
+// updateAliases applies actions in a single request.
+func updateAliases(ctx context.Context, client *elasticsearch.Client, actions []map[string]map[string]string) error {
+	body, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+	req := esapi.IndicesUpdateAliasesRequest{Body: bytes.NewReader(body)}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("updating aliases failed: %s", res.Status())
+	}
+	return nil
+}
+
+func aliasedIndices(ctx context.Context, client *elasticsearch.Client, alias string) ([]string, error) {
+	req := esapi.IndicesGetAliasRequest{Name: []string{alias}}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("looking up alias %s failed: %s", alias, res.Status())
+	}
+	var aliases map[string]json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&aliases); err != nil && err != io.EOF {
+		return nil, err
+	}
+	var indices []string
+	for index := range aliases {
+		indices = append(indices, index)
+	}
+	return indices, nil
+}
+
+func (r *Reindexer) loadCheckpoint() (Checkpoint, error) {
+	var checkpoint Checkpoint
+	data, err := os.ReadFile(r.CheckpointPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return checkpoint, err
+	}
+	return checkpoint, json.Unmarshal(data, &checkpoint)
+}
+
+// saveCheckpoint writes to a temporary file first so an interruption never
+// leaves a half-written checkpoint behind.
+func (r *Reindexer) saveCheckpoint(checkpoint Checkpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	tmp := r.CheckpointPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.CheckpointPath)
+}
+
+func (r *Reindexer) clearCheckpoint() error {
+	if err := os.Remove(r.CheckpointPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
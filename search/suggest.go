@@ -0,0 +1,138 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/cal1co/movielogv2-postservice/entities"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// maxSuggestionText caps how much of a post is echoed back as a suggestion.
+const maxSuggestionText = 100
+
+// ErrNoSuggestField is returned by Suggest while the index was created without
+// Mapping, before EnsureIndex or a reindex, so it has no suggest field.
+var ErrNoSuggestField = errors.New("the search index has no suggest field; run the reindex command to rebuild it with search.Mapping")
+
+type Suggestion struct {
+	Text   string `json:"text"`
+	Type   string `json:"type"`
+	PostID string `json:"post_id,omitempty"`
+}
+
+func (e *Elasticsearch) Suggest(ctx context.Context, prefix string, size int) ([]Suggestion, error) {
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	completions := map[string]interface{}{}
+	postSize := size
+	switch {
+	case strings.HasPrefix(prefix, "#"), strings.HasPrefix(prefix, "@"):
+		completions["entities"] = completion(prefix, size)
+		postSize = 0
+	default:
+		completions["hashtags"] = completion("#"+prefix, size)
+		completions["mentions"] = completion("@"+prefix, size)
+	}
+	body := map[string]interface{}{
+		"size":    postSize,
+		"_source": []string{"post_id", "post_content"},
+		"suggest": completions,
+	}
+	if postSize > 0 {
+		body["query"] = map[string]interface{}{
+			"match": map[string]interface{}{
+				"post_content.autocomplete": map[string]interface{}{
+					"query":    prefix,
+					"operator": "and",
+				},
+			},
+		}
+	}
+	query, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req := esapi.SearchRequest{
+		Index: []string{e.Index},
+		Body:  bytes.NewReader(query),
+	}
+	res, err := req.Do(ctx, e.Client)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		if res.StatusCode == http.StatusBadRequest {
+			body, _ := io.ReadAll(res.Body)
+			if strings.Contains(string(body), "[suggest]") {
+				return nil, ErrNoSuggestField
+			}
+		}
+		return nil, fmt.Errorf("suggest failed: %s", res.Status())
+	}
+	var parsed struct {
+		Hits struct {
+			Hits []struct {
+				Source Document `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+		Suggest map[string][]struct {
+			Options []struct {
+				Text string `json:"text"`
+			} `json:"options"`
+		} `json:"suggest"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		return nil, err
+	}
+
+	suggestions := []Suggestion{}
+	seen := map[string]bool{}
+	for _, name := range []string{"entities", "hashtags", "mentions"} {
+		for _, entry := range parsed.Suggest[name] {
+			for _, option := range entry.Options {
+				if seen[option.Text] {
+					continue
+				}
+				seen[option.Text] = true
+				kind := entities.Hashtag
+				if strings.HasPrefix(option.Text, "@") {
+					kind = entities.Mention
+				}
+				suggestions = append(suggestions, Suggestion{Text: option.Text, Type: kind})
+			}
+		}
+	}
+	for _, hit := range parsed.Hits.Hits {
+		suggestions = append(suggestions, Suggestion{Text: truncate(hit.Source.PostContent, maxSuggestionText), Type: "post", PostID: hit.Source.PostID})
+	}
+	if len(suggestions) > size {
+		suggestions = suggestions[:size]
+	}
+	return suggestions, nil
+}
+
+func completion(prefix string, size int) map[string]interface{} {
+	return map[string]interface{}{
+		"prefix": prefix,
+		"completion": map[string]interface{}{
+			"field":           "suggest",
+			"size":            size,
+			"skip_duplicates": true,
+		},
+	}
+}
+
+func truncate(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	return string(runes[:max])
+}
@@ -0,0 +1,647 @@
+package store
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/entities"
+	"github.com/gocql/gocql"
+)
+
+// Cassandra stores everything in the tables described by schema.cql.
+type Cassandra struct {
+	Session *gocql.Session
+}
+
+func NewCassandra(session *gocql.Session) *Cassandra {
+	return &Cassandra{Session: session}
+}
+
+func notFound(err error) error {
+	if err == gocql.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *Cassandra) CreatePost(ctx context.Context, post Post, jobs ...OutboxJob) error {
+	b := s.Session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	b.Query(`INSERT INTO posts (post_id, user_id, post_content, created_at, mentions) VALUES (?, ?, ?, ?, ?)`, post.ID, post.UserID, post.Content, post.CreatedAt, post.Mentions)
+	tag(b, entities.Hashtags(post.Content), taggedPost(post))
+	mention(b, MentionedUsers(post.Mentions), taggedPost(post))
+	for _, job := range jobs {
+		insertJob(b, job)
+	}
+	return s.Session.ExecuteBatch(b)
+}
+
+func tag(b *gocql.Batch, tags []string, post TaggedPost) {
+	for _, hashtag := range tags {
+		b.Query(`INSERT INTO posts_by_hashtag (hashtag, created_at, post_id, parent_post_id, user_id) VALUES (?, ?, ?, ?, ?)`, hashtag, post.CreatedAt, post.PostID, post.ParentID, post.UserID)
+	}
+}
+func untag(b *gocql.Batch, tags []string, post TaggedPost) {
+	for _, hashtag := range tags {
+		b.Query(`DELETE FROM posts_by_hashtag WHERE hashtag = ? AND created_at = ? AND post_id = ?`, hashtag, post.CreatedAt, post.PostID)
+	}
+}
+
+func (s *Cassandra) ListTaggedPosts(ctx context.Context, hashtag string, before TimelineCursor, limit int) ([]TaggedPost, error) {
+	return s.listTagged(ctx, `SELECT post_id, parent_post_id, user_id, created_at FROM posts_by_hashtag WHERE hashtag = ?`, hashtag, before, limit)
+}
+
+// listTagged pages through posts_by_hashtag or mentions_by_user. Entries
+// sharing the cursor's time are read on their own and compared by id in
+// taggedPage, like ListUserPosts does.
+func (s *Cassandra) listTagged(ctx context.Context, columns string, key interface{}, before TimelineCursor, limit int) ([]TaggedPost, error) {
+	stmt := columns
+	args := []interface{}{key}
+	if !before.IsZero() {
+		stmt += ` AND created_at < ?`
+		args = append(args, before.CreatedAt)
+	}
+	stmt += ` LIMIT ?`
+	args = append(args, limit)
+	posts, err := s.scanTagged(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	if before.PostID != (gocql.UUID{}) {
+		tied, err := s.scanTagged(ctx, columns+` AND created_at = ?`, key, before.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, tied...)
+	}
+	return taggedPage(posts, before, limit), nil
+}
+
+func (s *Cassandra) scanTagged(ctx context.Context, stmt string, args ...interface{}) ([]TaggedPost, error) {
+	iter := s.Session.Query(stmt, args...).WithContext(ctx).Iter()
+	var posts []TaggedPost
+	var post TaggedPost
+	for iter.Scan(&post.PostID, &post.ParentID, &post.UserID, &post.CreatedAt) {
+		posts = append(posts, post)
+	}
+	return posts, iter.Close()
+}
+
+func mention(b *gocql.Batch, users []int, post TaggedPost) {
+	for _, userID := range users {
+		b.Query(`INSERT INTO mentions_by_user (user_id, created_at, post_id, parent_post_id, author_id) VALUES (?, ?, ?, ?, ?)`, userID, post.CreatedAt, post.PostID, post.ParentID, post.UserID)
+	}
+}
+func unmention(b *gocql.Batch, users []int, post TaggedPost) {
+	for _, userID := range users {
+		b.Query(`DELETE FROM mentions_by_user WHERE user_id = ? AND created_at = ? AND post_id = ?`, userID, post.CreatedAt, post.PostID)
+	}
+}
+
+func (s *Cassandra) ListMentions(ctx context.Context, userID int, before TimelineCursor, limit int) ([]TaggedPost, error) {
+	return s.listTagged(ctx, `SELECT post_id, parent_post_id, author_id, created_at FROM mentions_by_user WHERE user_id = ?`, userID, before, limit)
+}
+
+func (s *Cassandra) GetPost(ctx context.Context, postID gocql.UUID) (Post, error) {
+	var post Post
+	err := s.Session.Query(`SELECT post_id, user_id, post_content, created_at, edited_at, mentions FROM posts WHERE post_id = ? LIMIT 1`, postID).WithContext(ctx).Consistency(gocql.One).Scan(&post.ID, &post.UserID, &post.Content, &post.CreatedAt, &post.EditedAt, &post.Mentions)
+	return post, notFound(err)
+}
+
+func (s *Cassandra) ListUserPosts(ctx context.Context, userID int, before, after TimelineCursor, limit int) ([]Post, error) {
+	const columns = `SELECT post_id, user_id, post_content, created_at, edited_at, mentions FROM posts WHERE user_id = ?`
+	stmt := columns
+	args := []interface{}{userID}
+	if !before.IsZero() {
+		stmt += ` AND created_at < ?`
+		args = append(args, before.CreatedAt)
+	}
+	if !after.IsZero() {
+		stmt += ` AND created_at > ? ORDER BY created_at ASC`
+		args = append(args, after.CreatedAt)
+	}
+	stmt += ` LIMIT ?`
+	args = append(args, limit)
+	posts, err := s.scanPosts(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	// Posts sharing a cursor's time are read on their own and compared by id
+	// in timelinePage, whichever way post_id is clustered.
+	var ties []time.Time
+	if before.PostID != (gocql.UUID{}) {
+		ties = append(ties, before.CreatedAt)
+	}
+	if after.PostID != (gocql.UUID{}) && !(len(ties) == 1 && ties[0].Equal(after.CreatedAt)) {
+		ties = append(ties, after.CreatedAt)
+	}
+	for _, createdAt := range ties {
+		tied, err := s.scanPosts(ctx, columns+` AND created_at = ?`, userID, createdAt)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, tied...)
+	}
+	return timelinePage(posts, before, after, limit), nil
+}
+
+func (s *Cassandra) scanPosts(ctx context.Context, stmt string, args ...interface{}) ([]Post, error) {
+	iter := s.Session.Query(stmt, args...).WithContext(ctx).Iter()
+	var posts []Post
+	var post Post
+	for iter.Scan(&post.ID, &post.UserID, &post.Content, &post.CreatedAt, &post.EditedAt, &post.Mentions) {
+		posts = append(posts, post)
+	}
+	return posts, iter.Close()
+}
+
+// EditPost diffs hashtags and mentions against the post as stored, read again
+// by its full key, rather than against the caller's copy, and writes the
+// revision in the same batch as the edit.
+func (s *Cassandra) EditPost(ctx context.Context, post Post, content string, mentions []Mention, editedAt time.Time) error {
+	current := post
+	err := s.Session.Query(`SELECT post_content, edited_at, mentions FROM posts WHERE user_id = ? AND created_at = ? AND post_id = ?`, post.UserID, post.CreatedAt, post.ID).WithContext(ctx).Scan(&current.Content, &current.EditedAt, &current.Mentions)
+	if err != nil {
+		return notFound(err)
+	}
+	removed, added := tagChanges(current.Content, content)
+	b := s.Session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	addRevision(b, current.ID, current.Content, revisionTime(current.CreatedAt, current.EditedAt), editedAt)
+	b.Query(`UPDATE posts SET post_content = ?, edited_at = ?, mentions = ? WHERE post_id = ? AND user_id = ? AND created_at = ?`, content, editedAt, mentions, current.ID, current.UserID, current.CreatedAt)
+	untag(b, removed, taggedPost(current))
+	tag(b, added, taggedPost(current))
+	unmentioned, mentioned := mentionChanges(current.Mentions, mentions)
+	unmention(b, unmentioned, taggedPost(current))
+	mention(b, mentioned, taggedPost(current))
+	return s.Session.ExecuteBatch(b)
+}
+
+func addRevision(b *gocql.Batch, id gocql.UUID, content string, writtenAt, replacedAt time.Time) {
+	b.Query(`INSERT INTO post_revisions (post_id, revision_id, content, written_at) VALUES (?, ?, ?, ?)`, id, gocql.UUIDFromTime(replacedAt), content, writtenAt)
+}
+
+func (s *Cassandra) ListRevisions(ctx context.Context, id gocql.UUID) ([]Revision, error) {
+	iter := s.Session.Query(`SELECT post_id, content, written_at, revision_id FROM post_revisions WHERE post_id = ?`, id).WithContext(ctx).Iter()
+	var revisions []Revision
+	var revision Revision
+	var revisionID gocql.UUID
+	for iter.Scan(&revision.PostID, &revision.Content, &revision.WrittenAt, &revisionID) {
+		revision.ReplacedAt = revisionID.Time()
+		revisions = append(revisions, revision)
+	}
+	return revisions, iter.Close()
+}
+
+func (s *Cassandra) ScanPosts(ctx context.Context, cursor []byte, limit int) ([]Post, []byte, error) {
+	iter := s.Session.Query(`SELECT post_id, user_id, post_content, created_at, edited_at, mentions FROM posts`).WithContext(ctx).PageSize(limit).PageState(cursor).Iter()
+	next := iter.PageState()
+	var posts []Post
+	var post Post
+	for iter.Scan(&post.ID, &post.UserID, &post.Content, &post.CreatedAt, &post.EditedAt, &post.Mentions) {
+		posts = append(posts, post)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, nil, err
+	}
+	return posts, next, nil
+}
+
+func (s *Cassandra) CreateComment(ctx context.Context, comment Comment) error {
+	b := s.Session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	b.Query(`INSERT INTO post_comments (comment_id, user_id, parent_post_id, comment_content, created_at, mentions) VALUES (?, ?, ?, ?, ?, ?)`, comment.ID, comment.UserID, comment.ParentID, comment.Content, comment.CreatedAt, comment.Mentions)
+	tag(b, entities.Hashtags(comment.Content), taggedComment(comment))
+	mention(b, MentionedUsers(comment.Mentions), taggedComment(comment))
+	if err := s.Session.ExecuteBatch(b); err != nil {
+		return err
+	}
+	return s.AddCommentCount(ctx, comment.ParentID, 1)
+}
+
+// DeleteComment clears away the replies, likes, revisions, counters and
+// entries of the comment first, all of which can safely be done twice, and
+// only then deletes the comment's own row with a lightweight transaction.
+// Whichever of two concurrent deletes applies it takes one off the parent's
+// count; a delete cut short before that is finished by the next attempt.
+func (s *Cassandra) DeleteComment(ctx context.Context, comment Comment, replies []Comment) (bool, error) {
+	b := s.Session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+	counters := s.Session.NewBatch(gocql.CounterBatch).WithContext(ctx)
+	for _, c := range append([]Comment{comment}, replies...) {
+		if c.ID != comment.ID {
+			b.Entries = append(b.Entries, gocql.BatchEntry{
+				Stmt:       "DELETE FROM post_comments WHERE comment_id=? AND user_id=? and parent_post_id=?;",
+				Args:       []interface{}{c.ID, c.UserID, c.ParentID},
+				Idempotent: true,
+			})
+		}
+		b.Entries = append(b.Entries, gocql.BatchEntry{
+			Stmt:       "DELETE FROM user_likes WHERE post_id=?;",
+			Args:       []interface{}{c.ID},
+			Idempotent: true,
+		})
+		b.Entries = append(b.Entries, gocql.BatchEntry{
+			Stmt:       "DELETE FROM post_revisions WHERE post_id=?;",
+			Args:       []interface{}{c.ID},
+			Idempotent: true,
+		})
+		counters.Entries = append(counters.Entries, gocql.BatchEntry{
+			Stmt:       "DELETE FROM post_counters WHERE post_id=?;",
+			Args:       []interface{}{c.ID},
+			Idempotent: true,
+		})
+		untag(b, entities.Hashtags(c.Content), taggedComment(c))
+		unmention(b, MentionedUsers(c.Mentions), taggedComment(c))
+	}
+	if err := s.Session.ExecuteBatch(b); err != nil {
+		return false, err
+	}
+	if err := s.Session.ExecuteBatch(counters); err != nil {
+		return false, err
+	}
+	applied, err := s.Session.Query(`DELETE FROM post_comments WHERE comment_id=? AND user_id=? AND parent_post_id=? IF EXISTS`, comment.ID, comment.UserID, comment.ParentID).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil || !applied {
+		return false, err
+	}
+	return true, s.AddCommentCount(ctx, comment.ParentID, -1)
+}
+
+// EditComment reads the comment again like EditPost does.
+func (s *Cassandra) EditComment(ctx context.Context, comment Comment, content string, mentions []Mention, editedAt time.Time) error {
+	current := comment
+	err := s.Session.Query(`SELECT comment_content, edited_at, mentions FROM post_comments WHERE parent_post_id = ? AND comment_id = ? AND user_id = ?`, comment.ParentID, comment.ID, comment.UserID).WithContext(ctx).Scan(&current.Content, &current.EditedAt, &current.Mentions)
+	if err != nil {
+		return notFound(err)
+	}
+	removed, added := tagChanges(current.Content, content)
+	b := s.Session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	addRevision(b, current.ID, current.Content, revisionTime(current.CreatedAt, current.EditedAt), editedAt)
+	b.Query(`UPDATE post_comments SET comment_content = ?, edited_at = ?, mentions = ? WHERE comment_id = ? AND user_id = ? AND parent_post_id = ?`, content, editedAt, mentions, current.ID, current.UserID, current.ParentID)
+	untag(b, removed, taggedComment(current))
+	tag(b, added, taggedComment(current))
+	unmentioned, mentioned := mentionChanges(current.Mentions, mentions)
+	unmention(b, unmentioned, taggedComment(current))
+	mention(b, mentioned, taggedComment(current))
+	return s.Session.ExecuteBatch(b)
+}
+
+func (s *Cassandra) GetComment(ctx context.Context, commentID gocql.UUID) (Comment, error) {
+	var comment Comment
+	err := s.Session.Query(`SELECT comment_id, user_id, parent_post_id, comment_content, created_at, edited_at, mentions FROM post_comments WHERE comment_id = ? LIMIT 1`, commentID).WithContext(ctx).Consistency(gocql.One).Scan(&comment.ID, &comment.UserID, &comment.ParentID, &comment.Content, &comment.CreatedAt, &comment.EditedAt, &comment.Mentions)
+	return comment, notFound(err)
+}
+
+func (s *Cassandra) ListComments(ctx context.Context, parentID gocql.UUID, limit int) ([]Comment, error) {
+	var iter *gocql.Iter
+	if limit > 0 {
+		iter = s.Session.Query(`SELECT comment_id, user_id, parent_post_id, comment_content, created_at, edited_at, mentions FROM post_comments WHERE parent_post_id = ? LIMIT ?`, parentID, limit).WithContext(ctx).Iter()
+	} else {
+		iter = s.Session.Query(`SELECT comment_id, user_id, parent_post_id, comment_content, created_at, edited_at, mentions FROM post_comments WHERE parent_post_id = ?`, parentID).WithContext(ctx).Iter()
+	}
+	var comments []Comment
+	var comment Comment
+	for iter.Scan(&comment.ID, &comment.UserID, &comment.ParentID, &comment.Content, &comment.CreatedAt, &comment.EditedAt, &comment.Mentions) {
+		comments = append(comments, comment)
+	}
+	return comments, iter.Close()
+}
+
+func (s *Cassandra) PageComments(ctx context.Context, parentID gocql.UUID, cursor []byte, limit int) ([]Comment, []byte, error) {
+	iter := s.Session.Query(`SELECT comment_id, user_id, parent_post_id, comment_content, created_at, edited_at, mentions FROM post_comments WHERE parent_post_id = ?`, parentID).WithContext(ctx).PageSize(limit).PageState(cursor).Iter()
+	next := iter.PageState()
+	var comments []Comment
+	var comment Comment
+	for iter.Scan(&comment.ID, &comment.UserID, &comment.ParentID, &comment.Content, &comment.CreatedAt, &comment.EditedAt, &comment.Mentions) {
+		comments = append(comments, comment)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, nil, err
+	}
+	return comments, next, nil
+}
+
+func (s *Cassandra) CommentCount(ctx context.Context, postID gocql.UUID) (int, error) {
+	var count int
+	err := s.Session.Query(`SELECT comments FROM post_counters WHERE post_id=?`, postID).WithContext(ctx).Scan(&count)
+	if err == gocql.ErrNotFound {
+		return 0, nil
+	}
+	return count, err
+}
+
+func (s *Cassandra) AddCommentCount(ctx context.Context, postID gocql.UUID, delta int) error {
+	return s.Session.Query(`UPDATE post_counters SET comments = comments + ? WHERE post_id = ?`, int64(delta), postID).WithContext(ctx).Exec()
+}
+
+func (s *Cassandra) HasLiked(ctx context.Context, userID int, postID gocql.UUID) (bool, error) {
+	var likeCount int
+	if err := s.Session.Query(`SELECT COUNT(*) FROM user_likes WHERE post_id=? AND user_id=?`, postID, userID).WithContext(ctx).Scan(&likeCount); err != nil {
+		return false, err
+	}
+	return likeCount > 0, nil
+}
+
+func (s *Cassandra) ListLikers(ctx context.Context, postID gocql.UUID) ([]int, error) {
+	iter := s.Session.Query(`SELECT user_id FROM user_likes WHERE post_id=?`, postID).WithContext(ctx).Iter()
+	var likers []int
+	var userID int
+	for iter.Scan(&userID) {
+		likers = append(likers, userID)
+	}
+	return likers, iter.Close()
+}
+
+func (s *Cassandra) AddLike(ctx context.Context, userID int, postID gocql.UUID, createdAt time.Time) (bool, error) {
+	applied, err := s.Session.Query(`INSERT INTO user_likes (user_id, post_id, created_at) VALUES (?, ?, ?) IF NOT EXISTS`, userID, postID, createdAt).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil || !applied {
+		return false, err
+	}
+	return true, s.AddLikeCount(ctx, postID, 1)
+}
+
+func (s *Cassandra) RemoveLike(ctx context.Context, userID int, postID gocql.UUID) (bool, error) {
+	applied, err := s.Session.Query(`DELETE FROM user_likes WHERE user_id=? AND post_id=? IF EXISTS`, userID, postID).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil || !applied {
+		return false, err
+	}
+	return true, s.AddLikeCount(ctx, postID, -1)
+}
+
+func (s *Cassandra) LikeCount(ctx context.Context, postID gocql.UUID) (int, error) {
+	var count int
+	err := s.Session.Query(`SELECT likes FROM post_counters WHERE post_id=?`, postID).WithContext(ctx).Scan(&count)
+	if err == gocql.ErrNotFound {
+		return 0, nil
+	}
+	return count, err
+}
+
+func (s *Cassandra) AddLikeCount(ctx context.Context, postID gocql.UUID, delta int) error {
+	return s.Session.Query(`UPDATE post_counters SET likes = likes + ? WHERE post_id = ?`, int64(delta), postID).WithContext(ctx).Exec()
+}
+
+func (s *Cassandra) AddMedia(ctx context.Context, postID gocql.UUID, order int, reference string) error {
+	return s.Session.Query(`INSERT INTO post_media (post_id, media_id, order_number, media_reference) VALUES (?, ?, ?, ?)`, postID, gocql.TimeUUID(), order, reference).WithContext(ctx).Exec()
+}
+
+func (s *Cassandra) ListMedia(ctx context.Context, postID gocql.UUID) ([]string, error) {
+	iter := s.Session.Query(`SELECT media_reference FROM post_media WHERE post_id = ?`, postID).WithContext(ctx).Iter()
+	var mediaReferences []string
+	var mediaStr string
+	for iter.Scan(&mediaStr) {
+		mediaReferences = append(mediaReferences, mediaStr)
+	}
+	return mediaReferences, iter.Close()
+}
+
+// Trashed posts are also filed under the day they were deleted in
+// trash_by_day, and every such day in the single trash_days partition, so
+// finding expired trash only reads the days old enough to hold it.
+func trashDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+func untrash(b *gocql.Batch, post Post) {
+	b.Query(`DELETE FROM trash_by_day WHERE day = ? AND deleted_at = ? AND post_id = ?`, trashDay(post.DeletedAt), post.DeletedAt, post.ID)
+}
+
+func (s *Cassandra) TrashPost(ctx context.Context, post Post, comments []Comment, deletedAt time.Time) error {
+	b := s.Session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	b.Query(`INSERT INTO post_trash (user_id, post_id, post_content, created_at, edited_at, deleted_at, mentions) VALUES (?, ?, ?, ?, ?, ?, ?)`, post.UserID, post.ID, post.Content, post.CreatedAt, post.EditedAt, deletedAt, post.Mentions)
+	b.Query(`INSERT INTO trash_days (bucket, day) VALUES (0, ?)`, trashDay(deletedAt))
+	b.Query(`INSERT INTO trash_by_day (day, deleted_at, post_id, user_id) VALUES (?, ?, ?, ?)`, trashDay(deletedAt), deletedAt, post.ID, post.UserID)
+	b.Query(`DELETE FROM posts WHERE post_id=? AND user_id=? and created_at=?`, post.ID, post.UserID, post.CreatedAt)
+	for _, comment := range comments {
+		b.Query(`INSERT INTO comment_trash (post_id, comment_id, user_id, parent_post_id, comment_content, created_at, edited_at, mentions) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, post.ID, comment.ID, comment.UserID, comment.ParentID, comment.Content, comment.CreatedAt, comment.EditedAt, comment.Mentions)
+		b.Query(`DELETE FROM post_comments WHERE comment_id=? AND user_id=? and parent_post_id=?`, comment.ID, comment.UserID, comment.ParentID)
+	}
+	return s.Session.ExecuteBatch(b)
+}
+
+func (s *Cassandra) GetTrashedPost(ctx context.Context, userID int, postID gocql.UUID) (Post, error) {
+	var post Post
+	err := s.Session.Query(`SELECT post_id, user_id, post_content, created_at, edited_at, deleted_at, mentions FROM post_trash WHERE user_id = ? AND post_id = ?`, userID, postID).WithContext(ctx).Scan(&post.ID, &post.UserID, &post.Content, &post.CreatedAt, &post.EditedAt, &post.DeletedAt, &post.Mentions)
+	return post, notFound(err)
+}
+
+func (s *Cassandra) ListTrash(ctx context.Context, userID int) ([]Post, error) {
+	iter := s.Session.Query(`SELECT post_id, user_id, post_content, created_at, edited_at, deleted_at, mentions FROM post_trash WHERE user_id = ?`, userID).WithContext(ctx).Iter()
+	posts, err := scanTrash(iter)
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].DeletedAt.After(posts[j].DeletedAt)
+	})
+	return posts, err
+}
+
+func (s *Cassandra) ListExpiredTrash(ctx context.Context, before time.Time, limit int) ([]Post, error) {
+	last := trashDay(before)
+	iter := s.Session.Query(`SELECT day FROM trash_days WHERE bucket = 0 AND day <= ?`, last).WithContext(ctx).Iter()
+	var days []time.Time
+	var day time.Time
+	for iter.Scan(&day) {
+		days = append(days, day)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	var posts []Post
+	for _, day := range days {
+		if len(posts) >= limit {
+			break
+		}
+		iter := s.Session.Query(`SELECT user_id, post_id, deleted_at FROM trash_by_day WHERE day = ? AND deleted_at < ? LIMIT ?`, day, before, limit-len(posts)).WithContext(ctx).Iter()
+		var filed []Post
+		var post Post
+		for iter.Scan(&post.UserID, &post.ID, &post.DeletedAt) {
+			filed = append(filed, post)
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+		// Nothing is deleted into a day once it is over, so an empty past
+		// day can be forgotten.
+		if len(filed) == 0 && day.Before(last) {
+			if err := s.Session.Query(`DELETE FROM trash_days WHERE bucket = 0 AND day = ?`, day).WithContext(ctx).Exec(); err != nil {
+				return nil, err
+			}
+		}
+		for _, entry := range filed {
+			post, err := s.GetTrashedPost(ctx, entry.UserID, entry.ID)
+			if err == ErrNotFound {
+				b := s.Session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+				untrash(b, entry)
+				if err := s.Session.ExecuteBatch(b); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			posts = append(posts, post)
+		}
+	}
+	return posts, nil
+}
+
+func scanTrash(iter *gocql.Iter) ([]Post, error) {
+	var posts []Post
+	var post Post
+	for iter.Scan(&post.ID, &post.UserID, &post.Content, &post.CreatedAt, &post.EditedAt, &post.DeletedAt, &post.Mentions) {
+		posts = append(posts, post)
+	}
+	return posts, iter.Close()
+}
+
+func (s *Cassandra) trashedComments(ctx context.Context, postID gocql.UUID) ([]Comment, error) {
+	iter := s.Session.Query(`SELECT comment_id, user_id, parent_post_id, comment_content, created_at, edited_at, mentions FROM comment_trash WHERE post_id = ?`, postID).WithContext(ctx).Iter()
+	var comments []Comment
+	var comment Comment
+	for iter.Scan(&comment.ID, &comment.UserID, &comment.ParentID, &comment.Content, &comment.CreatedAt, &comment.EditedAt, &comment.Mentions) {
+		comments = append(comments, comment)
+	}
+	return comments, iter.Close()
+}
+
+func (s *Cassandra) RestorePost(ctx context.Context, post Post) error {
+	comments, err := s.trashedComments(ctx, post.ID)
+	if err != nil {
+		return err
+	}
+	b := s.Session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	b.Query(`INSERT INTO posts (post_id, user_id, post_content, created_at, edited_at, mentions) VALUES (?, ?, ?, ?, ?, ?)`, post.ID, post.UserID, post.Content, post.CreatedAt, post.EditedAt, post.Mentions)
+	for _, comment := range comments {
+		b.Query(`INSERT INTO post_comments (comment_id, user_id, parent_post_id, comment_content, created_at, edited_at, mentions) VALUES (?, ?, ?, ?, ?, ?, ?)`, comment.ID, comment.UserID, comment.ParentID, comment.Content, comment.CreatedAt, comment.EditedAt, comment.Mentions)
+	}
+	b.Query(`DELETE FROM post_trash WHERE user_id = ? AND post_id = ?`, post.UserID, post.ID)
+	b.Query(`DELETE FROM comment_trash WHERE post_id = ?`, post.ID)
+	untrash(b, post)
+	return s.Session.ExecuteBatch(b)
+}
+
+func (s *Cassandra) PurgePost(ctx context.Context, post Post) error {
+	comments, err := s.trashedComments(ctx, post.ID)
+	if err != nil {
+		return err
+	}
+	b := s.Session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+	counters := s.Session.NewBatch(gocql.CounterBatch).WithContext(ctx)
+	ids := []gocql.UUID{post.ID}
+	untag(b, entities.Hashtags(post.Content), taggedPost(post))
+	unmention(b, MentionedUsers(post.Mentions), taggedPost(post))
+	for _, comment := range comments {
+		ids = append(ids, comment.ID)
+		untag(b, entities.Hashtags(comment.Content), taggedComment(comment))
+		unmention(b, MentionedUsers(comment.Mentions), taggedComment(comment))
+	}
+	for _, id := range ids {
+		b.Query(`DELETE FROM user_likes WHERE post_id = ?`, id)
+		b.Query(`DELETE FROM post_revisions WHERE post_id = ?`, id)
+		b.Query(`DELETE FROM post_media WHERE post_id = ?`, id)
+		counters.Query(`DELETE FROM post_counters WHERE post_id = ?`, id)
+	}
+	if err := s.Session.ExecuteBatch(counters); err != nil {
+		return err
+	}
+	// The tombstones go last so a failed purge is retried on the next run.
+	b.Query(`DELETE FROM comment_trash WHERE post_id = ?`, post.ID)
+	b.Query(`DELETE FROM post_trash WHERE user_id = ? AND post_id = ?`, post.UserID, post.ID)
+	untrash(b, post)
+	return s.Session.ExecuteBatch(b)
+}
+
+// The outbox is spread over outboxShards partitions, each clustered by
+// next_attempt, so finding due jobs reads the head of every shard rather than
+// scanning the table. Rescheduling a job moves its row within its shard.
+const outboxShards = 16
+
+func outboxShard(id gocql.UUID) int {
+	hash := fnv.New32a()
+	hash.Write(id.Bytes())
+	return int(hash.Sum32() % outboxShards)
+}
+
+func insertJob(b *gocql.Batch, job OutboxJob) {
+	b.Query(`INSERT INTO outbox (shard, next_attempt, job_id, kind, payload, attempts, last_error, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, outboxShard(job.ID), job.NextAttempt, job.ID, job.Kind, job.Payload, job.Attempts, job.LastError, job.CreatedAt)
+}
+
+func deleteJob(b *gocql.Batch, job OutboxJob) {
+	b.Query(`DELETE FROM outbox WHERE shard = ? AND next_attempt = ? AND job_id = ?`, outboxShard(job.ID), job.NextAttempt, job.ID)
+}
+
+func (s *Cassandra) ListDueJobs(ctx context.Context, now time.Time, limit int) ([]OutboxJob, error) {
+	var jobs []OutboxJob
+	for shard := 0; shard < outboxShards; shard++ {
+		iter := s.Session.Query(`SELECT job_id, kind, payload, attempts, next_attempt, last_error, created_at FROM outbox WHERE shard = ? AND next_attempt <= ? LIMIT ?`, shard, now, limit).WithContext(ctx).Iter()
+		var job OutboxJob
+		for iter.Scan(&job.ID, &job.Kind, &job.Payload, &job.Attempts, &job.NextAttempt, &job.LastError, &job.CreatedAt) {
+			jobs = append(jobs, job)
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].NextAttempt.Before(jobs[j].NextAttempt)
+	})
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs, nil
+}
+
+func (s *Cassandra) CompleteJob(ctx context.Context, job OutboxJob) error {
+	return s.Session.Query(`DELETE FROM outbox WHERE shard = ? AND next_attempt = ? AND job_id = ?`, outboxShard(job.ID), job.NextAttempt, job.ID).WithContext(ctx).Exec()
+}
+
+func (s *Cassandra) RetryJob(ctx context.Context, job OutboxJob, nextAttempt time.Time) error {
+	b := s.Session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	deleteJob(b, job)
+	job.NextAttempt = nextAttempt
+	insertJob(b, job)
+	return s.Session.ExecuteBatch(b)
+}
+
+// Dead letters share one partition, clustered by job_id so a replay can find
+// one directly; there should only ever be a handful, so listing them reads
+// the partition and sorts by failed_at.
+func (s *Cassandra) DeadLetterJob(ctx context.Context, job OutboxJob) error {
+	b := s.Session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	b.Query(`INSERT INTO outbox_dead_letters (bucket, job_id, failed_at, kind, payload, attempts, last_error, created_at) VALUES (0, ?, ?, ?, ?, ?, ?, ?)`, job.ID, job.FailedAt, job.Kind, job.Payload, job.Attempts, job.LastError, job.CreatedAt)
+	deleteJob(b, job)
+	return s.Session.ExecuteBatch(b)
+}
+
+func (s *Cassandra) ListDeadLetters(ctx context.Context, limit int) ([]OutboxJob, error) {
+	iter := s.Session.Query(`SELECT job_id, kind, payload, attempts, last_error, created_at, failed_at FROM outbox_dead_letters WHERE bucket = 0`).WithContext(ctx).Iter()
+	var jobs []OutboxJob
+	var job OutboxJob
+	for iter.Scan(&job.ID, &job.Kind, &job.Payload, &job.Attempts, &job.LastError, &job.CreatedAt, &job.FailedAt) {
+		jobs = append(jobs, job)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].FailedAt.After(jobs[j].FailedAt)
+	})
+	if limit > 0 && len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs, nil
+}
+
+func (s *Cassandra) ReplayDeadLetter(ctx context.Context, id gocql.UUID, now time.Time) (OutboxJob, error) {
+	var job OutboxJob
+	err := s.Session.Query(`SELECT job_id, kind, payload, attempts, last_error, created_at, failed_at FROM outbox_dead_letters WHERE bucket = 0 AND job_id = ?`, id).WithContext(ctx).Scan(&job.ID, &job.Kind, &job.Payload, &job.Attempts, &job.LastError, &job.CreatedAt, &job.FailedAt)
+	if err != nil {
+		return job, notFound(err)
+	}
+	job.Attempts = 0
+	job.NextAttempt = now
+	job.FailedAt = time.Time{}
+	b := s.Session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	insertJob(b, job)
+	b.Query(`DELETE FROM outbox_dead_letters WHERE bucket = 0 AND job_id = ?`, job.ID)
+	return job, s.Session.ExecuteBatch(b)
+}
@@ -0,0 +1,604 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/entities"
+	"github.com/gocql/gocql"
+)
+
+type likeKey struct {
+	userID int
+	postID gocql.UUID
+}
+
+type counters struct {
+	likes    int
+	comments int
+}
+
+type media struct {
+	order     int
+	reference string
+}
+
+// Memory is an in-process Store for running the service and its tests without Cassandra.
+type Memory struct {
+	mu        sync.RWMutex
+	posts     map[gocql.UUID]Post
+	comments  map[gocql.UUID]Comment
+	likes     map[likeKey]time.Time
+	counters  map[gocql.UUID]counters
+	media     map[gocql.UUID][]media
+	revisions map[gocql.UUID][]Revision
+	trash     map[gocql.UUID]trashed
+	tags      map[string]map[gocql.UUID]TaggedPost
+	mentions  map[int]map[gocql.UUID]TaggedPost
+	outbox    map[gocql.UUID]OutboxJob
+	dead      map[gocql.UUID]OutboxJob
+}
+
+type trashed struct {
+	post     Post
+	comments []Comment
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		posts:     make(map[gocql.UUID]Post),
+		comments:  make(map[gocql.UUID]Comment),
+		likes:     make(map[likeKey]time.Time),
+		counters:  make(map[gocql.UUID]counters),
+		media:     make(map[gocql.UUID][]media),
+		revisions: make(map[gocql.UUID][]Revision),
+		trash:     make(map[gocql.UUID]trashed),
+		tags:      make(map[string]map[gocql.UUID]TaggedPost),
+		mentions:  make(map[int]map[gocql.UUID]TaggedPost),
+		outbox:    make(map[gocql.UUID]OutboxJob),
+		dead:      make(map[gocql.UUID]OutboxJob),
+	}
+}
+
+func (m *Memory) CreatePost(ctx context.Context, post Post, jobs ...OutboxJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.posts[post.ID] = post
+	for _, job := range jobs {
+		m.outbox[job.ID] = job
+	}
+	m.tag(entities.Hashtags(post.Content), taggedPost(post))
+	m.mention(MentionedUsers(post.Mentions), taggedPost(post))
+	return nil
+}
+
+func (m *Memory) tag(tags []string, post TaggedPost) {
+	for _, hashtag := range tags {
+		if m.tags[hashtag] == nil {
+			m.tags[hashtag] = make(map[gocql.UUID]TaggedPost)
+		}
+		m.tags[hashtag][post.PostID] = post
+	}
+}
+
+func (m *Memory) untag(tags []string, post TaggedPost) {
+	for _, hashtag := range tags {
+		delete(m.tags[hashtag], post.PostID)
+		if len(m.tags[hashtag]) == 0 {
+			delete(m.tags, hashtag)
+		}
+	}
+}
+
+func (m *Memory) mention(users []int, post TaggedPost) {
+	for _, userID := range users {
+		if m.mentions[userID] == nil {
+			m.mentions[userID] = make(map[gocql.UUID]TaggedPost)
+		}
+		m.mentions[userID][post.PostID] = post
+	}
+}
+
+func (m *Memory) unmention(users []int, post TaggedPost) {
+	for _, userID := range users {
+		delete(m.mentions[userID], post.PostID)
+		if len(m.mentions[userID]) == 0 {
+			delete(m.mentions, userID)
+		}
+	}
+}
+
+func (m *Memory) ListTaggedPosts(ctx context.Context, hashtag string, before TimelineCursor, limit int) ([]TaggedPost, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return newestTagged(m.tags[hashtag], before, limit), nil
+}
+
+func (m *Memory) ListMentions(ctx context.Context, userID int, before TimelineCursor, limit int) ([]TaggedPost, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return newestTagged(m.mentions[userID], before, limit), nil
+}
+
+func newestTagged(tagged map[gocql.UUID]TaggedPost, before TimelineCursor, limit int) []TaggedPost {
+	posts := make([]TaggedPost, 0, len(tagged))
+	for _, post := range tagged {
+		posts = append(posts, post)
+	}
+	return taggedPage(posts, before, limit)
+}
+
+func (m *Memory) GetPost(ctx context.Context, postID gocql.UUID) (Post, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	post, ok := m.posts[postID]
+	if !ok {
+		return Post{}, ErrNotFound
+	}
+	return post, nil
+}
+
+func (m *Memory) ListUserPosts(ctx context.Context, userID int, before, after TimelineCursor, limit int) ([]Post, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var posts []Post
+	for _, post := range m.posts {
+		if post.UserID == userID {
+			posts = append(posts, post)
+		}
+	}
+	return timelinePage(posts, before, after, limit), nil
+}
+
+func (m *Memory) EditPost(ctx context.Context, post Post, content string, mentions []Mention, editedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, ok := m.posts[post.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	m.addRevision(post.ID, current.Content, revisionTime(current.CreatedAt, current.EditedAt), editedAt)
+	removed, added := tagChanges(current.Content, content)
+	m.untag(removed, taggedPost(current))
+	m.tag(added, taggedPost(current))
+	unmentioned, mentioned := mentionChanges(current.Mentions, mentions)
+	m.unmention(unmentioned, taggedPost(current))
+	m.mention(mentioned, taggedPost(current))
+	current.Content = content
+	current.Mentions = mentions
+	current.EditedAt = editedAt
+	m.posts[post.ID] = current
+	return nil
+}
+
+func (m *Memory) addRevision(id gocql.UUID, content string, writtenAt, replacedAt time.Time) {
+	revision := Revision{PostID: id, Content: content, WrittenAt: writtenAt, ReplacedAt: replacedAt}
+	m.revisions[id] = append([]Revision{revision}, m.revisions[id]...)
+}
+
+func (m *Memory) ListRevisions(ctx context.Context, id gocql.UUID) ([]Revision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]Revision(nil), m.revisions[id]...), nil
+}
+
+// ScanPosts pages through posts in ID order; the cursor is the last ID returned.
+func (m *Memory) ScanPosts(ctx context.Context, cursor []byte, limit int) ([]Post, []byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var after gocql.UUID
+	if len(cursor) > 0 {
+		var err error
+		if after, err = gocql.UUIDFromBytes(cursor); err != nil {
+			return nil, nil, err
+		}
+	}
+	var posts []Post
+	for _, post := range m.posts {
+		if len(cursor) == 0 || post.ID.String() > after.String() {
+			posts = append(posts, post)
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].ID.String() < posts[j].ID.String()
+	})
+	if limit <= 0 || len(posts) <= limit {
+		return posts, nil, nil
+	}
+	posts = posts[:limit]
+	return posts, posts[limit-1].ID.Bytes(), nil
+}
+
+func (m *Memory) CreateComment(ctx context.Context, comment Comment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.comments[comment.ID] = comment
+	m.tag(entities.Hashtags(comment.Content), taggedComment(comment))
+	m.mention(MentionedUsers(comment.Mentions), taggedComment(comment))
+	m.addCount(comment.ParentID, 0, 1)
+	return nil
+}
+
+func (m *Memory) DeleteComment(ctx context.Context, comment Comment, replies []Comment) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.comments[comment.ID]; !ok {
+		return false, nil
+	}
+	for _, c := range append([]Comment{comment}, replies...) {
+		delete(m.comments, c.ID)
+		m.untag(entities.Hashtags(c.Content), taggedComment(c))
+		m.unmention(MentionedUsers(c.Mentions), taggedComment(c))
+		delete(m.counters, c.ID)
+		delete(m.revisions, c.ID)
+		for key := range m.likes {
+			if key.postID == c.ID {
+				delete(m.likes, key)
+			}
+		}
+	}
+	m.addCount(comment.ParentID, 0, -1)
+	return true, nil
+}
+
+func (m *Memory) EditComment(ctx context.Context, comment Comment, content string, mentions []Mention, editedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, ok := m.comments[comment.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	m.addRevision(comment.ID, current.Content, revisionTime(current.CreatedAt, current.EditedAt), editedAt)
+	removed, added := tagChanges(current.Content, content)
+	m.untag(removed, taggedComment(current))
+	m.tag(added, taggedComment(current))
+	unmentioned, mentioned := mentionChanges(current.Mentions, mentions)
+	m.unmention(unmentioned, taggedComment(current))
+	m.mention(mentioned, taggedComment(current))
+	current.Content = content
+	current.Mentions = mentions
+	current.EditedAt = editedAt
+	m.comments[comment.ID] = current
+	return nil
+}
+
+func (m *Memory) GetComment(ctx context.Context, commentID gocql.UUID) (Comment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	comment, ok := m.comments[commentID]
+	if !ok {
+		return Comment{}, ErrNotFound
+	}
+	return comment, nil
+}
+
+func (m *Memory) ListComments(ctx context.Context, parentID gocql.UUID, limit int) ([]Comment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var comments []Comment
+	for _, comment := range m.comments {
+		if comment.ParentID == parentID {
+			comments = append(comments, comment)
+		}
+	}
+	sort.Slice(comments, func(i, j int) bool {
+		return commentBefore(comments[i], comments[j])
+	})
+	if limit > 0 && len(comments) > limit {
+		comments = comments[:limit]
+	}
+	return comments, nil
+}
+
+func commentBefore(a, b Comment) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.ID.String() < b.ID.String()
+}
+
+// PageComments resumes after the comment encoded in cursor as its creation time
+// in nanoseconds followed by its ID.
+func (m *Memory) PageComments(ctx context.Context, parentID gocql.UUID, cursor []byte, limit int) ([]Comment, []byte, error) {
+	var after Comment
+	if len(cursor) > 0 {
+		if len(cursor) != 24 {
+			return nil, nil, errors.New("invalid comment cursor")
+		}
+		after.CreatedAt = time.Unix(0, int64(binary.BigEndian.Uint64(cursor[:8])))
+		copy(after.ID[:], cursor[8:])
+	}
+	all, err := m.ListComments(ctx, parentID, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var comments []Comment
+	for _, comment := range all {
+		if len(cursor) == 0 || commentBefore(after, comment) {
+			comments = append(comments, comment)
+		}
+	}
+	if limit <= 0 || len(comments) <= limit {
+		return comments, nil, nil
+	}
+	comments = comments[:limit]
+	last := comments[limit-1]
+	next := binary.BigEndian.AppendUint64(nil, uint64(last.CreatedAt.UnixNano()))
+	return comments, append(next, last.ID.Bytes()...), nil
+}
+
+func (m *Memory) CommentCount(ctx context.Context, postID gocql.UUID) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.counters[postID].comments, nil
+}
+
+func (m *Memory) AddCommentCount(ctx context.Context, postID gocql.UUID, delta int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addCount(postID, 0, delta)
+	return nil
+}
+
+func (m *Memory) addCount(postID gocql.UUID, likes, comments int) {
+	c := m.counters[postID]
+	c.likes += likes
+	c.comments += comments
+	m.counters[postID] = c
+}
+
+func (m *Memory) HasLiked(ctx context.Context, userID int, postID gocql.UUID) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.likes[likeKey{userID, postID}]
+	return ok, nil
+}
+
+func (m *Memory) ListLikers(ctx context.Context, postID gocql.UUID) ([]int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var likers []int
+	for key := range m.likes {
+		if key.postID == postID {
+			likers = append(likers, key.userID)
+		}
+	}
+	sort.Ints(likers)
+	return likers, nil
+}
+
+func (m *Memory) AddLike(ctx context.Context, userID int, postID gocql.UUID, createdAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := likeKey{userID, postID}
+	if _, ok := m.likes[key]; ok {
+		return false, nil
+	}
+	m.likes[key] = createdAt
+	m.addCount(postID, 1, 0)
+	return true, nil
+}
+
+func (m *Memory) RemoveLike(ctx context.Context, userID int, postID gocql.UUID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := likeKey{userID, postID}
+	if _, ok := m.likes[key]; !ok {
+		return false, nil
+	}
+	delete(m.likes, key)
+	m.addCount(postID, -1, 0)
+	return true, nil
+}
+
+func (m *Memory) LikeCount(ctx context.Context, postID gocql.UUID) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.counters[postID].likes, nil
+}
+
+func (m *Memory) AddLikeCount(ctx context.Context, postID gocql.UUID, delta int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addCount(postID, delta, 0)
+	return nil
+}
+
+func (m *Memory) AddMedia(ctx context.Context, postID gocql.UUID, order int, reference string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.media[postID] = append(m.media[postID], media{order: order, reference: reference})
+	return nil
+}
+
+func (m *Memory) ListMedia(ctx context.Context, postID gocql.UUID) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	items := append([]media(nil), m.media[postID]...)
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].order < items[j].order
+	})
+	var references []string
+	for _, item := range items {
+		references = append(references, item.reference)
+	}
+	return references, nil
+}
+
+func (m *Memory) TrashPost(ctx context.Context, post Post, comments []Comment, deletedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.posts, post.ID)
+	for _, comment := range comments {
+		delete(m.comments, comment.ID)
+	}
+	post.DeletedAt = deletedAt
+	m.trash[post.ID] = trashed{post: post, comments: comments}
+	return nil
+}
+
+func (m *Memory) GetTrashedPost(ctx context.Context, userID int, postID gocql.UUID) (Post, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t, ok := m.trash[postID]
+	if !ok || t.post.UserID != userID {
+		return Post{}, ErrNotFound
+	}
+	return t.post, nil
+}
+
+func (m *Memory) ListTrash(ctx context.Context, userID int) ([]Post, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var posts []Post
+	for _, t := range m.trash {
+		if t.post.UserID == userID {
+			posts = append(posts, t.post)
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].DeletedAt.After(posts[j].DeletedAt)
+	})
+	return posts, nil
+}
+
+func (m *Memory) ListExpiredTrash(ctx context.Context, before time.Time, limit int) ([]Post, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var posts []Post
+	for _, t := range m.trash {
+		if len(posts) == limit {
+			break
+		}
+		if t.post.DeletedAt.Before(before) {
+			posts = append(posts, t.post)
+		}
+	}
+	return posts, nil
+}
+
+func (m *Memory) RestorePost(ctx context.Context, post Post) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.trash[post.ID]
+	if !ok {
+		return nil
+	}
+	delete(m.trash, post.ID)
+	t.post.DeletedAt = time.Time{}
+	m.posts[post.ID] = t.post
+	for _, comment := range t.comments {
+		m.comments[comment.ID] = comment
+	}
+	return nil
+}
+
+func (m *Memory) PurgePost(ctx context.Context, post Post) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.trash[post.ID]
+	if !ok {
+		return nil
+	}
+	delete(m.trash, post.ID)
+	ids := []gocql.UUID{post.ID}
+	m.untag(entities.Hashtags(t.post.Content), taggedPost(t.post))
+	m.unmention(MentionedUsers(t.post.Mentions), taggedPost(t.post))
+	for _, comment := range t.comments {
+		ids = append(ids, comment.ID)
+		m.untag(entities.Hashtags(comment.Content), taggedComment(comment))
+		m.unmention(MentionedUsers(comment.Mentions), taggedComment(comment))
+	}
+	for _, id := range ids {
+		delete(m.counters, id)
+		delete(m.revisions, id)
+		delete(m.media, id)
+		for key := range m.likes {
+			if key.postID == id {
+				delete(m.likes, key)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ListDueJobs(ctx context.Context, now time.Time, limit int) ([]OutboxJob, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var jobs []OutboxJob
+	for _, job := range m.outbox {
+		if !job.NextAttempt.After(now) {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].NextAttempt.Equal(jobs[j].NextAttempt) {
+			return jobs[i].NextAttempt.Before(jobs[j].NextAttempt)
+		}
+		return jobs[i].ID.String() < jobs[j].ID.String()
+	})
+	if limit > 0 && len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs, nil
+}
+
+func (m *Memory) CompleteJob(ctx context.Context, job OutboxJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.outbox, job.ID)
+	return nil
+}
+
+func (m *Memory) RetryJob(ctx context.Context, job OutboxJob, nextAttempt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.outbox[job.ID]; ok {
+		job.NextAttempt = nextAttempt
+		m.outbox[job.ID] = job
+	}
+	return nil
+}
+
+func (m *Memory) DeadLetterJob(ctx context.Context, job OutboxJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.outbox, job.ID)
+	m.dead[job.ID] = job
+	return nil
+}
+
+func (m *Memory) ListDeadLetters(ctx context.Context, limit int) ([]OutboxJob, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var jobs []OutboxJob
+	for _, job := range m.dead {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].FailedAt.After(jobs[j].FailedAt)
+	})
+	if limit > 0 && len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs, nil
+}
+
+func (m *Memory) ReplayDeadLetter(ctx context.Context, id gocql.UUID, now time.Time) (OutboxJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.dead[id]
+	if !ok {
+		return OutboxJob{}, ErrNotFound
+	}
+	delete(m.dead, id)
+	job.Attempts = 0
+	job.NextAttempt = now
+	job.FailedAt = time.Time{}
+	m.outbox[id] = job
+	return job, nil
+}
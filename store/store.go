@@ -0,0 +1,348 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/entities"
+	"github.com/gocql/gocql"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// EditedAt is zero until the first edit.
+type Post struct {
+	ID        gocql.UUID
+	UserID    int
+	Content   string
+	CreatedAt time.Time
+	EditedAt  time.Time
+	DeletedAt time.Time
+	Mentions  []Mention
+}
+
+type Comment struct {
+	ID        gocql.UUID
+	UserID    int
+	ParentID  gocql.UUID
+	Content   string
+	CreatedAt time.Time
+	EditedAt  time.Time
+	Mentions  []Mention
+}
+
+// Mention is an @mention in a post or comment resolved to the user it names.
+// Start and End are character offsets into the content, as entities.Parse
+// reports them.
+type Mention struct {
+	Username string `cql:"username"`
+	UserID   int    `cql:"user_id"`
+	Start    int    `cql:"start_offset"`
+	End      int    `cql:"end_offset"`
+}
+
+// Revision is a replaced version of a post or comment: the content it had from
+// WrittenAt until an edit at ReplacedAt.
+type Revision struct {
+	PostID     gocql.UUID
+	Content    string
+	WrittenAt  time.Time
+	ReplacedAt time.Time
+}
+
+// TaggedPost is a post or comment whose content carries a hashtag or
+// mention. ParentID is zero for posts and UserID is the author.
+type TaggedPost struct {
+	PostID    gocql.UUID
+	ParentID  gocql.UUID
+	UserID    int
+	CreatedAt time.Time
+}
+
+func taggedPost(post Post) TaggedPost {
+	return TaggedPost{PostID: post.ID, UserID: post.UserID, CreatedAt: post.CreatedAt}
+}
+func taggedComment(comment Comment) TaggedPost {
+	return TaggedPost{PostID: comment.ID, ParentID: comment.ParentID, UserID: comment.UserID, CreatedAt: comment.CreatedAt}
+}
+
+// tagChanges returns the hashtags an edit from before to after drops and adds.
+func tagChanges(before, after string) (removed, added []string) {
+	old := map[string]bool{}
+	for _, tag := range entities.Hashtags(before) {
+		old[tag] = true
+	}
+	for _, tag := range entities.Hashtags(after) {
+		if old[tag] {
+			delete(old, tag)
+		} else {
+			added = append(added, tag)
+		}
+	}
+	for tag := range old {
+		removed = append(removed, tag)
+	}
+	return removed, added
+}
+
+// mentionChanges returns the users an edit from before to after stops and
+// starts mentioning.
+func mentionChanges(before, after []Mention) (removed, added []int) {
+	old := map[int]bool{}
+	for _, id := range MentionedUsers(before) {
+		old[id] = true
+	}
+	for _, id := range MentionedUsers(after) {
+		if old[id] {
+			delete(old, id)
+		} else {
+			added = append(added, id)
+		}
+	}
+	for id := range old {
+		removed = append(removed, id)
+	}
+	return removed, added
+}
+
+// MentionedUsers returns the distinct IDs of the mentioned users.
+func MentionedUsers(mentions []Mention) []int {
+	seen := map[int]bool{}
+	var users []int
+	for _, mention := range mentions {
+		if !seen[mention.UserID] {
+			seen[mention.UserID] = true
+			users = append(users, mention.UserID)
+		}
+	}
+	return users
+}
+
+func revisionTime(createdAt, editedAt time.Time) time.Time {
+	if editedAt.IsZero() {
+		return createdAt
+	}
+	return editedAt
+}
+
+// TimelineCursor is a position in a timeline of posts, such as a user's posts
+// or a hashtag's, which is ordered by CreatedAt and then by post id. Without a
+// PostID the cursor is just a time.
+type TimelineCursor struct {
+	CreatedAt time.Time
+	PostID    gocql.UUID
+}
+
+func (c TimelineCursor) IsZero() bool {
+	return c.CreatedAt.IsZero()
+}
+
+// newer reports whether the post created at createdAt with id comes after the
+// cursor in the timeline.
+func (c TimelineCursor) newer(createdAt time.Time, id gocql.UUID) bool {
+	if !createdAt.Equal(c.CreatedAt) {
+		return createdAt.After(c.CreatedAt)
+	}
+	return c.PostID != (gocql.UUID{}) && compareTimeUUIDs(id, c.PostID) > 0
+}
+
+// older reports whether the post created at createdAt with id comes before the
+// cursor in the timeline.
+func (c TimelineCursor) older(createdAt time.Time, id gocql.UUID) bool {
+	if !createdAt.Equal(c.CreatedAt) {
+		return createdAt.Before(c.CreatedAt)
+	}
+	return c.PostID != (gocql.UUID{}) && compareTimeUUIDs(id, c.PostID) < 0
+}
+
+// compareTimeUUIDs orders ids by time and then by their bytes, like Cassandra
+// orders timeuuid columns.
+func compareTimeUUIDs(a, b gocql.UUID) int {
+	if ta, tb := a.Time(), b.Time(); !ta.Equal(tb) {
+		if ta.Before(tb) {
+			return -1
+		}
+		return 1
+	}
+	return bytes.Compare(a[:], b[:])
+}
+
+// timelinePage sorts posts newest first, keeps those strictly between after
+// and before, and returns the limit closest to after if it is set, or else to
+// before.
+func timelinePage(posts []Post, before, after TimelineCursor, limit int) []Post {
+	var page []Post
+	for _, post := range posts {
+		if (before.IsZero() || before.older(post.CreatedAt, post.ID)) && (after.IsZero() || after.newer(post.CreatedAt, post.ID)) {
+			page = append(page, post)
+		}
+	}
+	sort.Slice(page, func(i, j int) bool {
+		return TimelineCursor{CreatedAt: page[j].CreatedAt, PostID: page[j].ID}.newer(page[i].CreatedAt, page[i].ID)
+	})
+	if limit > 0 && len(page) > limit {
+		if !after.IsZero() {
+			return page[len(page)-limit:]
+		}
+		page = page[:limit]
+	}
+	return page
+}
+
+// taggedPage sorts posts newest first and returns the first limit of those
+// that come before before.
+func taggedPage(posts []TaggedPost, before TimelineCursor, limit int) []TaggedPost {
+	var page []TaggedPost
+	for _, post := range posts {
+		if before.IsZero() || before.older(post.CreatedAt, post.PostID) {
+			page = append(page, post)
+		}
+	}
+	sort.Slice(page, func(i, j int) bool {
+		return TimelineCursor{CreatedAt: page[j].CreatedAt, PostID: page[j].PostID}.newer(page[i].CreatedAt, page[i].PostID)
+	})
+	if limit > 0 && len(page) > limit {
+		page = page[:limit]
+	}
+	return page
+}
+
+type PostStore interface {
+	// CreatePost stores post together with any outbox jobs for its side
+	// effects, so that either both are saved or neither is.
+	CreatePost(ctx context.Context, post Post, jobs ...OutboxJob) error
+	GetPost(ctx context.Context, postID gocql.UUID) (Post, error)
+	// ListUserPosts returns up to limit of a user's posts, newest first, that
+	// come strictly between after and before; a zero cursor leaves that side
+	// open. When after is set the page holds the posts closest to it.
+	ListUserPosts(ctx context.Context, userID int, before, after TimelineCursor, limit int) ([]Post, error)
+	// EditPost replaces the content and mentions of post, keeping the old
+	// content as a revision. Only post's key is used; what is replaced is
+	// whatever is stored, so a stale copy cannot leave hashtags or mentions
+	// behind. EditComment does the same for comments, and ListRevisions
+	// returns the replaced versions of either, newest first.
+	EditPost(ctx context.Context, post Post, content string, mentions []Mention, editedAt time.Time) error
+	ListRevisions(ctx context.Context, id gocql.UUID) ([]Revision, error)
+	// ScanPosts pages through every post. An empty cursor starts from the
+	// beginning and an empty next cursor means there are no more pages.
+	ScanPosts(ctx context.Context, cursor []byte, limit int) ([]Post, []byte, error)
+}
+
+// TrashStore moves deleted posts and their comment trees out of posts and
+// post_comments into tombstones stamped with DeletedAt, so every read path
+// stops seeing them until they are restored or purged.
+type TrashStore interface {
+	TrashPost(ctx context.Context, post Post, comments []Comment, deletedAt time.Time) error
+	GetTrashedPost(ctx context.Context, userID int, postID gocql.UUID) (Post, error)
+	// ListTrash returns a user's tombstoned posts, most recently deleted first.
+	ListTrash(ctx context.Context, userID int) ([]Post, error)
+	RestorePost(ctx context.Context, post Post) error
+	// ListExpiredTrash returns up to limit posts deleted before the given time.
+	ListExpiredTrash(ctx context.Context, before time.Time, limit int) ([]Post, error)
+	// PurgePost permanently removes a tombstoned post and its comment tree along
+	// with their counters, likes, media and revisions.
+	PurgePost(ctx context.Context, post Post) error
+}
+
+// OutboxJob is a side effect of a write, such as a feed fanout, that is
+// stored along with it and delivered afterwards by the outbox relay. Jobs
+// wait until NextAttempt; LastError holds why the previous attempt failed.
+type OutboxJob struct {
+	ID          gocql.UUID
+	Kind        string
+	Payload     []byte
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	CreatedAt   time.Time
+	FailedAt    time.Time
+}
+
+// OutboxStore holds outbox jobs until they are delivered, and the dead
+// letters of jobs that ran out of attempts until they are replayed.
+type OutboxStore interface {
+	// ListDueJobs returns up to limit jobs whose NextAttempt is not after now.
+	ListDueJobs(ctx context.Context, now time.Time, limit int) ([]OutboxJob, error)
+	CompleteJob(ctx context.Context, job OutboxJob) error
+	// RetryJob saves the job's Attempts and LastError and moves it from its
+	// current NextAttempt to nextAttempt.
+	RetryJob(ctx context.Context, job OutboxJob, nextAttempt time.Time) error
+	// DeadLetterJob moves a job out of the outbox, stamped with FailedAt.
+	DeadLetterJob(ctx context.Context, job OutboxJob) error
+	// ListDeadLetters returns up to limit dead letters, most recently failed
+	// first.
+	ListDeadLetters(ctx context.Context, limit int) ([]OutboxJob, error)
+	// ReplayDeadLetter moves a dead letter back into the outbox with its
+	// attempts reset, due at now.
+	ReplayDeadLetter(ctx context.Context, id gocql.UUID, now time.Time) (OutboxJob, error)
+}
+
+// Like and comment counts live in counter columns that are only ever changed by
+// deltas: AddLike, RemoveLike and CreateComment adjust them alongside the rows
+// they count, and AddLikeCount/AddCommentCount exist for reconciliation.
+type CommentStore interface {
+	CreateComment(ctx context.Context, comment Comment) error
+	// DeleteComment removes the comment and the given replies beneath it along
+	// with their counters and likes, and takes one off the parent's count. It
+	// reports whether the comment was still there, so that only one of two
+	// concurrent deletes changes the count.
+	DeleteComment(ctx context.Context, comment Comment, replies []Comment) (bool, error)
+	GetComment(ctx context.Context, commentID gocql.UUID) (Comment, error)
+	EditComment(ctx context.Context, comment Comment, content string, mentions []Mention, editedAt time.Time) error
+	// ListComments returns the direct replies to parentID; limit <= 0 returns all of them.
+	ListComments(ctx context.Context, parentID gocql.UUID, limit int) ([]Comment, error)
+	// PageComments returns one page of the direct replies to parentID, like
+	// ScanPosts does for posts.
+	PageComments(ctx context.Context, parentID gocql.UUID, cursor []byte, limit int) ([]Comment, []byte, error)
+	CommentCount(ctx context.Context, postID gocql.UUID) (int, error)
+	AddCommentCount(ctx context.Context, postID gocql.UUID, delta int) error
+}
+
+// HashtagStore lists what was tagged with a hashtag. The other stores keep
+// posts_by_hashtag in step with the content they create, edit and delete;
+// trashed posts keep their entries until they are purged.
+type HashtagStore interface {
+	// ListTaggedPosts returns up to limit posts and comments tagged with tag,
+	// newest first, that come before before; a zero cursor starts from the
+	// newest.
+	ListTaggedPosts(ctx context.Context, tag string, before TimelineCursor, limit int) ([]TaggedPost, error)
+}
+
+// MentionStore lists where a user was mentioned, kept in step in
+// mentions_by_user the same way as posts_by_hashtag.
+type MentionStore interface {
+	// ListMentions returns up to limit posts and comments mentioning userID,
+	// newest first, that come before before; a zero cursor starts from the
+	// newest.
+	ListMentions(ctx context.Context, userID int, before TimelineCursor, limit int) ([]TaggedPost, error)
+}
+
+type LikeStore interface {
+	HasLiked(ctx context.Context, userID int, postID gocql.UUID) (bool, error)
+	ListLikers(ctx context.Context, postID gocql.UUID) ([]int, error)
+	// AddLike and RemoveLike report whether the like row actually changed, so
+	// that a repeated like or unlike leaves the count alone.
+	AddLike(ctx context.Context, userID int, postID gocql.UUID, createdAt time.Time) (bool, error)
+	RemoveLike(ctx context.Context, userID int, postID gocql.UUID) (bool, error)
+	LikeCount(ctx context.Context, postID gocql.UUID) (int, error)
+	AddLikeCount(ctx context.Context, postID gocql.UUID, delta int) error
+}
+
+type MediaStore interface {
+	AddMedia(ctx context.Context, postID gocql.UUID, order int, reference string) error
+	ListMedia(ctx context.Context, postID gocql.UUID) ([]string, error)
+}
+
+type Store interface {
+	PostStore
+	CommentStore
+	LikeStore
+	MediaStore
+	TrashStore
+	HashtagStore
+	MentionStore
+	OutboxStore
+}
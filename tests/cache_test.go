@@ -2,25 +2,305 @@ package test
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	cacheoperations "github.com/cal1co/movielogv2-postservice/rediscache"
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/gocql/gocql"
 	"github.com/redis/go-redis/v9"
 )
 
-type RedisClient interface {
-	Exists(ctx context.Context, key string) *redis.IntCmd
-	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
-	Get(ctx context.Context, key string) *redis.StringCmd
-	Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd
+type cacheBackend struct {
+	name    string
+	cache   cacheoperations.CounterCache
+	advance func(time.Duration)
 }
 
-// func TestGetPostLikes(t *testing.T) {
-// 	mockRedis := &MockRedisClient{}
-// 	mockSession := &MockSession{}
+func newCacheBackends(t *testing.T) []cacheBackend {
+	mr := miniredis.RunT(t)
+	return []cacheBackend{
+		{
+			name:    "redis",
+			cache:   cacheoperations.NewRedisCache(redis.NewClient(&redis.Options{Addr: mr.Addr()})),
+			advance: mr.FastForward,
+		},
+		{
+			name:    "memory",
+			cache:   cacheoperations.NewMemoryCache(),
+			advance: time.Sleep,
+		},
+	}
+}
+
+func TestCounterCache(t *testing.T) {
+	ctx := context.Background()
+	for _, backend := range newCacheBackends(t) {
+		t.Run(backend.name, func(t *testing.T) {
+			cache := backend.cache
+			if _, err := cache.Get(ctx, "missing"); err != cacheoperations.ErrCacheMiss {
+				t.Errorf("expected cache miss, got %v", err)
+			}
+			if n, _ := cache.Incr(ctx, "counter"); n != 1 {
+				t.Errorf("expected 1, got %d", n)
+			}
+			if n, _ := cache.Decr(ctx, "counter"); n != 0 {
+				t.Errorf("expected 0, got %d", n)
+			}
+
+			cache.SetNX(ctx, "counter", 7, 0)
+			if n, _ := cache.Get(ctx, "counter"); n != 0 {
+				t.Errorf("expected SetNX to keep 0, got %d", n)
+			}
+			if _, err := cache.AdjustCounter(ctx, cacheoperations.CounterUpdate{Key: "uncached", Delta: 1}); err != cacheoperations.ErrCacheMiss {
+				t.Errorf("expected adjusting an uncached counter to miss, got %v", err)
+			}
+
+			cache.Set(ctx, "ttl", 5, 50*time.Millisecond)
+			if n, err := cache.Get(ctx, "ttl"); err != nil || n != 5 {
+				t.Errorf("expected 5, got %d (%v)", n, err)
+			}
+			backend.advance(60 * time.Millisecond)
+			if _, err := cache.Get(ctx, "ttl"); err != cacheoperations.ErrCacheMiss {
+				t.Errorf("expected key to expire, got %v", err)
+			}
+
+		})
+	}
+}
+
+func TestCounterCacheSortedSet(t *testing.T) {
+	ctx := context.Background()
+	for _, backend := range newCacheBackends(t) {
+		t.Run(backend.name, func(t *testing.T) {
+			cache := backend.cache
+			cache.ZAdd(ctx, "ranking", "a", 1, 0)
+			cache.ZAdd(ctx, "ranking", "b", 3, 0)
+			cache.ZAdd(ctx, "ranking", "c", 2, 0)
+			if score, _ := cache.ZIncrBy(ctx, "ranking", "a", 5); score != 6 {
+				t.Errorf("expected 6, got %f", score)
+			}
+			if _, err := cache.ZScore(ctx, "ranking", "missing"); err != cacheoperations.ErrCacheMiss {
+				t.Errorf("expected cache miss, got %v", err)
+			}
+
+			top, _ := cache.ZRevRange(ctx, "ranking", 0, 1)
+			if len(top) != 2 || top[0].Member != "a" || top[1].Member != "b" {
+				t.Errorf("unexpected reverse range: %v", top)
+			}
+			bottom, _ := cache.ZRange(ctx, "ranking", 0, -1)
+			if len(bottom) != 3 || bottom[0].Member != "c" || bottom[2].Member != "a" {
+				t.Errorf("unexpected range: %v", bottom)
+			}
+		})
+	}
+}
+
+func TestGetPostLikes(t *testing.T) {
+	ctx := context.Background()
+	for _, backend := range newCacheBackends(t) {
+		t.Run(backend.name, func(t *testing.T) {
+			mem := store.NewMemory()
+			postID := gocql.TimeUUID()
+			mem.AddLikeCount(ctx, postID, 4)
+
+			if likes := cacheoperations.GetPostLikes(postID.String(), backend.cache, ctx, mem); likes != 4 {
+				t.Errorf("expected 4 likes loaded from the store, got %d", likes)
+			}
+			mem.AddLikeCount(ctx, postID, 6)
+			if likes := cacheoperations.GetPostLikes(postID.String(), backend.cache, ctx, mem); likes != 4 {
+				t.Errorf("expected cached 4 likes, got %d", likes)
+			}
+		})
+	}
+}
+
+// like mirrors the handlers: the store decides whether the like applies and the
+// cache only follows.
+func like(ctx context.Context, backend cacheBackend, mem *store.Memory, postID gocql.UUID, uid int, add bool, comment bool, parentID string) (int, bool) {
+	var changed bool
+	if add {
+		changed, _ = mem.AddLike(ctx, uid, postID, time.Now())
+	} else {
+		changed, _ = mem.RemoveLike(ctx, uid, postID)
+	}
+	if !changed {
+		return 0, false
+	}
+	if add {
+		return cacheoperations.Like(postID.String(), uid, backend.cache, ctx, mem, comment, parentID), true
+	}
+	return cacheoperations.Unlike(postID.String(), uid, backend.cache, ctx, mem, comment, parentID), true
+}
+
+func TestConcurrentLikes(t *testing.T) {
+	const n = 50
+	ctx := context.Background()
+	for _, backend := range newCacheBackends(t) {
+		t.Run(backend.name, func(t *testing.T) {
+			mem := store.NewMemory()
+			postID := gocql.TimeUUID()
+			commentID := gocql.TimeUUID()
+			mem.AddLikeCount(ctx, commentID, 5)
+			cacheoperations.GetPostLikes(commentID.String(), backend.cache, ctx, mem)
+			cacheoperations.LikedByUser(commentID.String(), 0, backend.cache, ctx, mem)
 
-// 	postID := "123"
-// 	ctx := context.Background()
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(uid int) {
+					defer wg.Done()
+					like(ctx, backend, mem, commentID, uid, true, true, postID.String())
+				}(i)
+			}
+			wg.Wait()
 
-// 	likeCount := GetPostLikes(postID, mockRedis, ctx, mockSession)
+			if likes := cacheoperations.GetPostLikes(commentID.String(), backend.cache, ctx, mem); likes != n+5 {
+				t.Errorf("expected %d likes, got %d", n+5, likes)
+			}
+			score, err := backend.cache.ZScore(ctx, fmt.Sprintf("post:%s:comments:likes", postID), commentID.String())
+			if err != nil || score != n+5 {
+				t.Errorf("expected ranking score %d, got %f (%v)", n+5, score, err)
+			}
 
-// }
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(uid int) {
+					defer wg.Done()
+					like(ctx, backend, mem, commentID, uid, false, true, postID.String())
+				}(i)
+			}
+			wg.Wait()
+			if likes := cacheoperations.GetPostLikes(commentID.String(), backend.cache, ctx, mem); likes != 5 {
+				t.Errorf("expected 5 likes, got %d", likes)
+			}
+			if stored, _ := mem.LikeCount(ctx, commentID); stored != 5 {
+				t.Errorf("expected 5 stored likes, got %d", stored)
+			}
+		})
+	}
+}
+
+func TestLikeAfterEviction(t *testing.T) {
+	ctx := context.Background()
+	for _, backend := range newCacheBackends(t) {
+		t.Run(backend.name, func(t *testing.T) {
+			mem := store.NewMemory()
+			postID := gocql.TimeUUID()
+			mem.AddLikeCount(ctx, postID, 2)
+
+			if likes, _ := like(ctx, backend, mem, postID, 1, true, false, "null"); likes != 3 {
+				t.Errorf("expected 3 likes, got %d", likes)
+			}
+			backend.cache.Del(ctx, fmt.Sprintf("post:%s:likes", postID))
+			if likes, _ := like(ctx, backend, mem, postID, 2, true, false, "null"); likes != 4 {
+				t.Errorf("expected 4 likes after reloading, got %d", likes)
+			}
+		})
+	}
+}
+
+func TestStaleLikersAreDropped(t *testing.T) {
+	ctx := context.Background()
+	for _, backend := range newCacheBackends(t) {
+		t.Run(backend.name, func(t *testing.T) {
+			mem := store.NewMemory()
+			postID := gocql.TimeUUID()
+			mem.AddLike(ctx, 1, postID, time.Now())
+			cacheoperations.GetPostLikes(postID.String(), backend.cache, ctx, mem)
+			cacheoperations.LikedByUser(postID.String(), 1, backend.cache, ctx, mem)
+			// These changes reach the store without the cache hearing about them.
+			mem.RemoveLike(ctx, 1, postID)
+			mem.AddLike(ctx, 2, postID, time.Now())
+			mem.AddLike(ctx, 1, postID, time.Now())
+
+			if likes := cacheoperations.Like(postID.String(), 1, backend.cache, ctx, mem, false, "null"); likes != 2 {
+				t.Errorf("expected 2 likes reloaded from the store, got %d", likes)
+			}
+			if !cacheoperations.LikedByUser(postID.String(), 1, backend.cache, ctx, mem) {
+				t.Errorf("expected user 1 to have liked the post")
+			}
+		})
+	}
+}
+
+func TestConcurrentDuplicateLikes(t *testing.T) {
+	const n = 20
+	ctx := context.Background()
+	for _, backend := range newCacheBackends(t) {
+		t.Run(backend.name, func(t *testing.T) {
+			mem := store.NewMemory()
+			postID := gocql.TimeUUID()
+			mem.AddLike(ctx, 1, postID, time.Now())
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			changes := 0
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, changed := like(ctx, backend, mem, postID, 2, true, false, "null"); changed {
+						mu.Lock()
+						changes++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+
+			if changes != 1 {
+				t.Errorf("expected exactly one like to apply, got %d", changes)
+			}
+			if likes := cacheoperations.GetPostLikes(postID.String(), backend.cache, ctx, mem); likes != 2 {
+				t.Errorf("expected 2 likes, got %d", likes)
+			}
+			if _, changed := like(ctx, backend, mem, postID, 1, true, false, "null"); changed {
+				t.Errorf("expected existing like to be kept")
+			}
+			if !cacheoperations.LikedByUser(postID.String(), 2, backend.cache, ctx, mem) {
+				t.Errorf("expected user 2 to have liked the post")
+			}
+			if _, changed := like(ctx, backend, mem, postID, 3, false, false, "null"); changed {
+				t.Errorf("expected unlike without a like to be ignored")
+			}
+		})
+	}
+}
+
+func TestCommentRankingsExpire(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	cache := cacheoperations.NewRedisCache(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	mem := store.NewMemory()
+	post := store.Post{ID: gocql.TimeUUID(), UserID: 1, CreatedAt: time.Now()}
+	comment := store.Comment{ID: gocql.TimeUUID(), UserID: 2, ParentID: post.ID, CreatedAt: time.Now()}
+	mem.CreatePost(ctx, post)
+	mem.CreateComment(ctx, comment)
+	postID, commentID := post.ID.String(), comment.ID.String()
+	rankings := []string{"post:" + postID + ":comments:likes", "post:" + postID + ":comments:replies", "post:" + postID + ":comments:time"}
+
+	// Writes to a post whose rankings were never loaded still expire.
+	cacheoperations.AddCommentRankings(postID, commentID, comment.CreatedAt, cache, ctx)
+	mem.AddLike(ctx, 3, comment.ID, time.Now())
+	cacheoperations.Like(commentID, 3, cache, ctx, mem, true, postID)
+	for _, key := range rankings {
+		if ttl := mr.TTL(key); ttl <= 0 || ttl > 24*time.Hour {
+			t.Errorf("expected %s to expire within a day, got %v", key, ttl)
+		}
+	}
+
+	mr.FastForward(time.Hour)
+	if err := cacheoperations.LoadCommentRankings(postID, cache, ctx, mem, mem); err != nil {
+		t.Fatal(err)
+	}
+	marker := mr.TTL("post:" + postID + ":comments:ranked")
+	for _, key := range rankings {
+		if ttl := mr.TTL(key); ttl < marker {
+			t.Errorf("expected %s to outlive the loaded marker, got %v before %v", key, ttl, marker)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cal1co/movielogv2-postservice/events"
+	"github.com/cal1co/movielogv2-postservice/handlers"
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisStreamsPublisher(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	publisher := events.NewRedisStreams(client, "post-events")
+	ctx := context.Background()
+
+	liked, _ := events.New(events.PostLiked{PostID: "p1", AuthorID: 1, UserID: 2}, time.Now())
+	deleted, _ := events.New(events.PostDeleted{PostID: "p1", AuthorID: 1, DeletedAt: time.Now()}, time.Now())
+	if err := publisher.Publish(ctx, liked, deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := client.XRange(ctx, "post-events", "-", "+").Result()
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("unexpected stream entries %+v: %v", entries, err)
+	}
+	event, err := events.FromStream(entries[0].Values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload events.PostLiked
+	if err := event.Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if event.ID != liked.ID || event.Type != events.TypePostLiked || event.Version != 1 || payload.UserID != 2 || payload.AuthorID != 1 {
+		t.Errorf("unexpected event %+v with payload %+v", event, payload)
+	}
+}
+
+func TestHandlersPublishEvents(t *testing.T) {
+	r, handler, mem, cache := newTestRouter(t, 2)
+	published := events.NewMemory()
+	handler.Events = published
+	r.POST("/post/like/:id", func(c *gin.Context) {
+		handlers.HandleLike(c, false, handler, cache)
+	})
+	r.POST("/post/unlike/:id", func(c *gin.Context) {
+		handlers.HandleUnlike(c, false, handler, cache)
+	})
+	r.POST("/post/:id/comment", func(c *gin.Context) {
+		handlers.HandleComment(c, handler, cache, false)
+	})
+	r.DELETE("/comments/:id", func(c *gin.Context) {
+		handlers.HandleCommentDelete(c, handler, cache)
+	})
+	r.DELETE("/posts/:id", func(c *gin.Context) {
+		handlers.HandlePostDelete(c, handler, cache)
+	})
+	r.POST("/post/media", func(c *gin.Context) {
+		handlers.HandleAddMediaToPost(c, handler)
+	})
+
+	ctx := context.Background()
+	theirs := store.Post{ID: gocql.TimeUUID(), UserID: 1, Content: "my review", CreatedAt: time.Now()}
+	mine := store.Post{ID: gocql.TimeUUID(), UserID: 2, Content: "mine", CreatedAt: time.Now()}
+	mem.CreatePost(ctx, theirs)
+	mem.CreatePost(ctx, mine)
+
+	send := func(method, path, body string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		r.ServeHTTP(w, req)
+		if w.Code >= 300 {
+			t.Fatalf("%s %s returned %v", method, path, w.Code)
+		}
+	}
+	send(http.MethodPost, "/post/like/"+theirs.ID.String(), "")
+	send(http.MethodPost, "/post/unlike/"+theirs.ID.String(), "")
+	send(http.MethodPost, "/post/"+theirs.ID.String()+"/comment", `{"comment_content":"agreed"}`)
+	comments, _ := mem.ListComments(ctx, theirs.ID, 0)
+	send(http.MethodDelete, "/comments/"+comments[0].ID.String(), "")
+	send(http.MethodPost, "/post/media", `{"id":"`+mine.ID.String()+`","file_names":["poster.jpg"]}`)
+	send(http.MethodDelete, "/posts/"+mine.ID.String(), "")
+
+	// A repeated unlike changes nothing and so announces nothing.
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/post/unlike/"+theirs.ID.String(), nil)
+	r.ServeHTTP(w, req)
+
+	var types []string
+	for _, event := range published.Events() {
+		types = append(types, event.Type)
+	}
+	if fmt.Sprint(types) != "[post.liked post.unliked comment.added comment.deleted media.added post.deleted]" {
+		t.Fatalf("unexpected events %v", types)
+	}
+	var liked events.PostLiked
+	published.Events()[0].Decode(&liked)
+	if liked.AuthorID != 1 || liked.UserID != 2 || liked.PostID != theirs.ID.String() {
+		t.Errorf("unexpected like payload %+v", liked)
+	}
+	var added events.CommentAdded
+	published.Events()[2].Decode(&added)
+	if added.ParentID != theirs.ID.String() || added.AuthorID != 2 || added.Content != "agreed" {
+		t.Errorf("unexpected comment payload %+v", added)
+	}
+	var media events.MediaAdded
+	published.Events()[4].Decode(&media)
+	if media.PostID != mine.ID.String() || media.AuthorID != 2 || fmt.Sprint(media.Media) != "[poster.jpg]" {
+		t.Errorf("unexpected media payload %+v", media)
+	}
+}
+
+func TestMemoryPublisherKeepsLatest(t *testing.T) {
+	published := events.NewMemory()
+	published.MaxLen = 3
+	for i := 0; i < 10; i++ {
+		event, _ := events.New(events.PostRestored{PostID: fmt.Sprint(i)}, time.Now())
+		published.Publish(context.Background(), event)
+	}
+	var ids []string
+	for _, event := range published.Events() {
+		var restored events.PostRestored
+		event.Decode(&restored)
+		ids = append(ids, restored.PostID)
+	}
+	if fmt.Sprint(ids) != "[7 8 9]" {
+		t.Errorf("expected the last 3 events, got %v", ids)
+	}
+}
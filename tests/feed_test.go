@@ -0,0 +1,117 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/feed"
+)
+
+// newFeedHandler stands in for the feed handler, answering each POST /post
+// with the next of statuses and then with 200s.
+func newFeedHandler(t *testing.T, statuses ...int) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := int(atomic.AddInt32(&calls, 1)) - 1
+		var post map[string]interface{}
+		if r.URL.Path != "/post" || r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&post) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if call < len(statuses) {
+			http.Error(w, http.StatusText(statuses[call]), statuses[call])
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func newFeedClient(baseURL string) *feed.Client {
+	client := feed.NewClient(baseURL)
+	client.Backoff = time.Millisecond
+	client.MaxBackoff = 5 * time.Millisecond
+	return client
+}
+
+func TestFeedClientRetries(t *testing.T) {
+	server, calls := newFeedHandler(t, http.StatusServiceUnavailable, http.StatusBadGateway)
+	client := newFeedClient(server.URL + "/")
+	if err := client.FanoutPost(context.Background(), map[string]int{"user_id": 1}); err != nil {
+		t.Fatalf("expected the third attempt to succeed, got %v", err)
+	}
+	if atomic.LoadInt32(calls) != 3 {
+		t.Errorf("expected 3 calls, got %v", atomic.LoadInt32(calls))
+	}
+}
+
+func TestFeedClientStatusErrors(t *testing.T) {
+	server, calls := newFeedHandler(t, http.StatusUnprocessableEntity)
+	client := newFeedClient(server.URL)
+	err := client.FanoutPost(context.Background(), map[string]int{"user_id": 1})
+	var status *feed.StatusError
+	if !errors.As(err, &status) || status.StatusCode != http.StatusUnprocessableEntity || status.Temporary() {
+		t.Fatalf("expected a permanent status error, got %v", err)
+	}
+	if atomic.LoadInt32(calls) != 1 {
+		t.Errorf("expected a client error not to be retried, got %v calls", atomic.LoadInt32(calls))
+	}
+
+	server, _ = newFeedHandler(t, 500, 500, 500)
+	err = newFeedClient(server.URL).FanoutPost(context.Background(), map[string]int{"user_id": 1})
+	if !errors.As(err, &status) || status.StatusCode != http.StatusInternalServerError || !status.Temporary() {
+		t.Errorf("expected the last server error once retries ran out, got %v", err)
+	}
+}
+
+func TestFeedClientTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+	client := newFeedClient(server.URL)
+	client.Timeout = 10 * time.Millisecond
+	client.Retries = 0
+	start := time.Now()
+	if err := client.FanoutPost(context.Background(), map[string]int{"user_id": 1}); err == nil || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("expected the request to time out quickly, got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestFeedClientCircuitBreaker(t *testing.T) {
+	server, calls := newFeedHandler(t, 500, 500, 500, 500)
+	client := newFeedClient(server.URL)
+	client.Retries = 0
+	client.Breaker = feed.NewBreaker(3, 50*time.Millisecond)
+	ctx := context.Background()
+	post := map[string]int{"user_id": 1}
+
+	for i := 0; i < 3; i++ {
+		client.FanoutPost(ctx, post)
+	}
+	if err := client.FanoutPost(ctx, post); err != feed.ErrCircuitOpen || atomic.LoadInt32(calls) != 3 {
+		t.Fatalf("expected the open circuit to refuse the call, got %v after %v calls", err, atomic.LoadInt32(calls))
+	}
+
+	// The trial call after the cooldown fails, so the circuit opens again.
+	time.Sleep(60 * time.Millisecond)
+	if err := client.FanoutPost(ctx, post); err == feed.ErrCircuitOpen || atomic.LoadInt32(calls) != 4 {
+		t.Fatalf("expected a trial call, got %v after %v calls", err, atomic.LoadInt32(calls))
+	}
+	if err := client.FanoutPost(ctx, post); err != feed.ErrCircuitOpen {
+		t.Fatalf("expected the failed trial to reopen the circuit, got %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := client.FanoutPost(ctx, post); err != nil || client.Breaker.Open() {
+		t.Errorf("expected a successful trial to close the circuit, got %v", err)
+	}
+}
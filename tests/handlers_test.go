@@ -1,101 +1,607 @@
 package test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/handlers"
+	cacheoperations "github.com/cal1co/movielogv2-postservice/rediscache"
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
 )
 
-type MockQuery struct {
-	ExecError error
+func newTestRouter(t *testing.T, uid float64) (*gin.Engine, *handlers.Handler, *store.Memory, cacheoperations.CounterCache) {
+	gin.SetMode(gin.TestMode)
+	cache := cacheoperations.NewMemoryCache()
+	mem := store.NewMemory()
+	handler := handlers.NewHandler(mem)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("user_id", uid)
+		c.Next()
+	})
+	return r, handler, mem, cache
 }
 
-func (mq *MockQuery) Exec() error {
-	return mq.ExecError
+func TestHandlePostGet(t *testing.T) {
+	r, handler, mem, cache := newTestRouter(t, 1)
+	r.GET("/posts/:id", func(c *gin.Context) {
+		handlers.HandlePostGet(c, false, handler, cache)
+	})
+
+	post := store.Post{ID: gocql.TimeUUID(), UserID: 1, Content: "Test Content", CreatedAt: time.Now()}
+	mem.CreatePost(context.Background(), post)
+	mem.AddMedia(context.Background(), post.ID, 1, "test1.jpg")
+	mem.AddLikeCount(context.Background(), post.ID, 3)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/posts/"+post.ID.String(), nil)
+	r.ServeHTTP(w, req)
+
+	if status := w.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var res handlers.Post
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.PostContent != post.Content || res.Likes != 3 || len(res.Media) != 1 {
+		t.Errorf("unexpected post: %+v", res)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/posts/"+gocql.TimeUUID().String(), nil)
+	r.ServeHTTP(w, req)
+	if status := w.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
 }
 
-type MockSession struct {
-	QueryError   error
-	QueryInvoked bool
-	MockQuery    *MockQuery
+func TestHandleLike(t *testing.T) {
+	r, handler, mem, cache := newTestRouter(t, 7)
+	r.POST("/post/like/:id", func(c *gin.Context) {
+		handlers.HandleLike(c, false, handler, cache)
+	})
+	r.POST("/post/unlike/:id", func(c *gin.Context) {
+		handlers.HandleUnlike(c, false, handler, cache)
+	})
+
+	postID := gocql.TimeUUID()
+	mem.CreatePost(context.Background(), store.Post{ID: postID, UserID: 1, CreatedAt: time.Now()})
+	steps := []struct {
+		path   string
+		status int
+		likes  int
+	}{
+		{"/post/like/", http.StatusOK, 1},
+		{"/post/like/", http.StatusBadRequest, 1},
+		{"/post/unlike/", http.StatusOK, 0},
+		{"/post/unlike/", http.StatusBadRequest, 0},
+	}
+	for _, step := range steps {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, step.path+postID.String(), nil)
+		r.ServeHTTP(w, req)
+		if w.Code != step.status {
+			t.Fatalf("%s: got status %v want %v", step.path, w.Code, step.status)
+		}
+		if step.status == http.StatusOK && w.Body.String() != fmt.Sprint(step.likes) {
+			t.Errorf("%s: got likes %s want %d", step.path, w.Body.String(), step.likes)
+		}
+	}
+	liked, _ := mem.HasLiked(context.Background(), 7, postID)
+	if liked {
+		t.Errorf("expected like to be removed")
+	}
+
+	missing := gocql.TimeUUID()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/post/like/"+missing.String(), nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("like of a missing post: got status %v want %v", w.Code, http.StatusNotFound)
+	}
+	if likers, _ := mem.ListLikers(context.Background(), missing); len(likers) != 0 {
+		t.Errorf("expected no like on a missing post, got %v", likers)
+	}
 }
 
-// func TestHandlePost(t *testing.T) {
-// 	mockSession := &MockSession{
-// 		MockQuery: &MockQuery{
-// 			ExecError: nil,
-// 		},
-// 	}
+func TestHandlePost(t *testing.T) {
+	r, handler, mem, cache := newTestRouter(t, 1)
+	r.POST("/post", func(c *gin.Context) {
+		handlers.HandlePost(c, handler, cache)
+	})
 
-// 	r := gin.Default()
+	post := &handlers.Post{
+		PostContent: "Test Content",
+		Media:       []string{"test1.jpg", "test2.jpg"},
+	}
+	reqBody, _ := json.Marshal(post)
+	req, _ := http.NewRequest(http.MethodPost, "/post", bytes.NewBuffer(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
 
-// 	r.POST("/post", func(c *gin.Context) {
-// 		handlers.HandlePost(c, mockSession)
-// 	})
+	// Fanout is only queued, so the request succeeds without a feed handler.
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected status %v, got %v", http.StatusCreated, w.Code)
+	}
+	jobs, _ := mem.ListDueJobs(context.Background(), time.Now(), 10)
+	if len(jobs) != 3 {
+		t.Errorf("expected fanout, index and event jobs, got %+v", jobs)
+	}
+	posts, _ := mem.ListUserPosts(context.Background(), 1, store.TimelineCursor{}, store.TimelineCursor{}, 10)
+	if len(posts) != 1 || posts[0].Content != "Test Content" {
+		t.Errorf("post was not stored: %+v", posts)
+	}
+	media, _ := mem.ListMedia(context.Background(), posts[0].ID)
+	if len(media) != 2 {
+		t.Errorf("media was not stored: %v", media)
+	}
+}
 
-// 	post := &Post{
-// 		UserID:      1,
-// 		PostContent: "Test Content",
-// 		Media:       []string{"test1.jpg", "test2.jpg"},
-// 	}
+func TestCheckLikedByUser(t *testing.T) {
+	mem := store.NewMemory()
+	handler := handlers.NewHandler(mem)
+	cache := cacheoperations.NewMemoryCache()
+	postID := gocql.TimeUUID()
+	mem.AddLike(context.Background(), 1, postID, time.Now())
 
-// 	reqBody, _ := json.Marshal(post)
+	if result := handlers.CheckLikedByUser("1", postID.String(), handler, cache); result != true {
+		t.Errorf("Expected true, but got %v", result)
+	}
+	if result := handlers.CheckLikedByUser("2", postID.String(), handler, cache); result != false {
+		t.Errorf("Expected false, but got %v", result)
+	}
+}
 
-// 	req, _ := http.NewRequest(http.MethodPost, "/post", bytes.NewBuffer(reqBody))
-// 	req.Header.Set("Content-Type", "application/json")
+func TestGetPostCommentsSorted(t *testing.T) {
+	r, handler, mem, cache := newTestRouter(t, 1)
+	r.GET("/post/:id/comments", func(c *gin.Context) {
+		handlers.GetPostComments(c, handler, cache)
+	})
+	r.POST("/post/:id/comment", func(c *gin.Context) {
+		handlers.HandleComment(c, handler, cache, false)
+	})
+	r.POST("/comment/:id/like", func(c *gin.Context) {
+		handlers.HandleLike(c, true, handler, cache)
+	})
 
-// 	w := httptest.NewRecorder()
+	ctx := context.Background()
+	postID := gocql.TimeUUID()
+	now := time.Now()
+	mem.CreatePost(ctx, store.Post{ID: postID, UserID: 1, CreatedAt: now.Add(-time.Hour)})
+	var ids []gocql.UUID
+	for i := 0; i < 3; i++ {
+		comment := store.Comment{ID: gocql.TimeUUID(), UserID: 2, ParentID: postID, CreatedAt: now.Add(time.Duration(i-3) * time.Minute)}
+		mem.CreateComment(ctx, comment)
+		ids = append(ids, comment.ID)
+	}
+	mem.AddLike(ctx, 2, ids[2], now)
+	mem.AddLike(ctx, 3, ids[2], now)
+	mem.AddLike(ctx, 2, ids[0], now)
+	mem.CreateComment(ctx, store.Comment{ID: gocql.TimeUUID(), UserID: 2, ParentID: ids[1], CreatedAt: now})
 
-// 	r.ServeHTTP(w, req)
+	get := func(query string) []gocql.UUID {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/post/"+postID.String()+"/comments?"+query, nil)
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %v", query, w.Code)
+		}
+		var page handlers.CommentPage
+		json.Unmarshal(w.Body.Bytes(), &page)
+		var got []gocql.UUID
+		for _, comment := range page.Comments {
+			got = append(got, comment.ID)
+		}
+		return got
+	}
+	expect := func(query string, want ...gocql.UUID) {
+		got := get(query)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: got %v want %v", query, got, want)
+		}
+	}
 
-// 	if status := w.Code; status != http.StatusCreated {
-// 		t.Errorf("handler returned wrong status code: got %v want %v",
-// 			status, http.StatusCreated)
-// 	}
+	expect("sort=top", ids[2], ids[0], ids[1])
+	expect("sort=newest", ids[2], ids[1], ids[0])
+	expect("sort=oldest", ids[0], ids[1], ids[2])
+	expect("sort=most_replied", ids[1], ids[2], ids[0])
+	first := getPage(t, r, "/post/"+postID.String()+"/comments?sort=oldest&limit=2")
+	second := getPage(t, r, "/post/"+postID.String()+"/comments?sort=oldest&limit=2&cursor="+first.NextCursor)
+	if len(second.Comments) != 1 || second.Comments[0].ID != ids[2] || second.NextCursor != "" {
+		t.Errorf("unexpected second ranked page: %+v", second)
+	}
 
-// 	if !mockSession.QueryInvoked {
-// 		t.Errorf("Query was not invoked")
-// 	}
-// }
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/comment/"+ids[1].String()+"/like", nil)
+	r.ServeHTTP(w, req)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/post/"+postID.String()+"/comment", bytes.NewBufferString(`{"comment_content":"latest"}`))
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("comment: got status %v", w.Code)
+	}
+	newest := get("sort=newest")
+	if len(newest) != 4 || newest[1] != ids[2] {
+		t.Errorf("expected the new comment first, got %v", newest)
+	}
+	if top := get("sort=top"); top[1] != ids[1] {
+		t.Errorf("expected liked comment to move up, got %v", top)
+	}
+
+	missing := gocql.TimeUUID()
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/post/"+missing.String()+"/comment", bytes.NewBufferString(`{"comment_content":"lost"}`))
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("comment on a missing post: got status %v want %v", w.Code, http.StatusNotFound)
+	}
+	if count, _ := mem.CommentCount(ctx, missing); count != 0 {
+		t.Errorf("expected no comment count on a missing post, got %d", count)
+	}
 
-type MockScan struct {
-	ScanError error
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/post/"+postID.String()+"/comments?sort=random", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected unknown sort to be rejected, got %v", w.Code)
+	}
 }
 
-func (ms *MockScan) Scan(dest ...interface{}) error {
-	*(dest[0].(*int)) = 1
-	return ms.ScanError
+func getPage(t *testing.T, r *gin.Engine, path string) handlers.CommentPage {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, path, nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: got status %v", path, w.Code)
+	}
+	var page handlers.CommentPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	return page
 }
 
-func (ms *MockSession) Query(stmt string, values ...interface{}) *MockQuery {
-	ms.QueryInvoked = true
-	return ms.MockQuery
+func TestGetPostCommentsCursor(t *testing.T) {
+	r, handler, mem, cache := newTestRouter(t, 1)
+	r.GET("/post/:id/comments", func(c *gin.Context) {
+		handlers.GetPostComments(c, handler, cache)
+	})
+	r.GET("/comment/:id/comments", func(c *gin.Context) {
+		handlers.GetPostComments(c, handler, cache)
+	})
+
+	ctx := context.Background()
+	postID := gocql.TimeUUID()
+	now := time.Now()
+	for i := 0; i < 25; i++ {
+		mem.CreateComment(ctx, store.Comment{ID: gocql.TimeUUID(), UserID: 2, ParentID: postID, CreatedAt: now.Add(time.Duration(i) * time.Second)})
+	}
+	first, _ := mem.ListComments(ctx, postID, 1)
+	for i := 0; i < 3; i++ {
+		mem.CreateComment(ctx, store.Comment{ID: gocql.TimeUUID(), UserID: 2, ParentID: first[0].ID, CreatedAt: now})
+	}
+
+	seen := map[gocql.UUID]bool{}
+	var sizes []int
+	cursor := ""
+	for {
+		page := getPage(t, r, "/post/"+postID.String()+"/comments?limit=10&cursor="+cursor)
+		sizes = append(sizes, len(page.Comments))
+		for _, comment := range page.Comments {
+			seen[comment.ID] = true
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if fmt.Sprint(sizes) != "[10 10 5]" || len(seen) != 25 {
+		t.Errorf("unexpected pages %v covering %d comments", sizes, len(seen))
+	}
+
+	replies := getPage(t, r, "/comment/"+first[0].ID.String()+"/comments?limit=2")
+	if len(replies.Comments) != 2 || replies.NextCursor == "" {
+		t.Errorf("unexpected first page of replies: %+v", replies)
+	}
+	replies = getPage(t, r, "/comment/"+first[0].ID.String()+"/comments?limit=2&cursor="+replies.NextCursor)
+	if len(replies.Comments) != 1 || replies.NextCursor != "" {
+		t.Errorf("unexpected last page of replies: %+v", replies)
+	}
+
+	for _, query := range []string{"limit=0", "limit=500", "cursor=***"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/post/"+postID.String()+"/comments?"+query, nil)
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %v want %v", query, w.Code, http.StatusBadRequest)
+		}
+	}
 }
 
-// func TestCheckLikedByUser(t *testing.T) {
-// 	mockSession := &MockSession{
-// 		MockQuery: &MockQuery{
-// 			Scan: &MockScan{
-// 				ScanError: nil,
-// 			},
-// 		},
-// 	}
-// 	mockHandler := &Handler{
-// 		Session: mockSession,
-// 	}
+func TestHandleGetUserPostsTimeline(t *testing.T) {
+	r, handler, mem, cache := newTestRouter(t, 1)
+	r.GET("/posts/user/:id", func(c *gin.Context) {
+		handlers.HandleGetUserPosts(c, handler, cache)
+	})
 
-// 	uid := "test-user-id"
-// 	postId := "test-post-id"
+	ctx := context.Background()
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	var posts []store.Post
+	for i := 0; i < 20; i++ {
+		post := store.Post{ID: gocql.TimeUUID(), UserID: 3, Content: fmt.Sprint(i), CreatedAt: start.Add(time.Duration(i) * time.Minute)}
+		mem.CreatePost(ctx, post)
+		posts = append(posts, post)
+	}
+	mem.CreatePost(ctx, store.Post{ID: gocql.TimeUUID(), UserID: 4, CreatedAt: start})
+	mem.AddLike(ctx, 1, posts[19].ID, start)
+	mem.AddLike(ctx, 3, posts[18].ID, start)
 
-// 	result := handlers.CheckLikedByUser(uid, postId, mockHandler)
+	get := func(query string) handlers.TimelinePage {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/posts/user/3?"+query, nil)
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %v", query, w.Code)
+		}
+		var page handlers.TimelinePage
+		json.Unmarshal(w.Body.Bytes(), &page)
+		return page
+	}
 
-// 	if result != true {
-// 		t.Errorf("Expected true, but got %v", result)
-// 	}
+	var contents []string
+	var sizes []int
+	query := "limit=8"
+	for {
+		page := get(query)
+		sizes = append(sizes, len(page.Posts))
+		for _, post := range page.Posts {
+			contents = append(contents, post.PostContent)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query = "limit=8&before=" + url.QueryEscape(page.NextCursor)
+	}
+	if fmt.Sprint(sizes) != "[8 8 4]" || contents[0] != "19" || contents[19] != "0" {
+		t.Errorf("unexpected pages %v: %v", sizes, contents)
+	}
 
-// 	if !mockSession.QueryInvoked {
-// 		t.Errorf("Query was not invoked")
-// 	}
-// }
+	// liked is about the viewer, user 1, not the owner of the timeline.
+	if page := get("limit=2"); !page.Posts[0].Liked || page.Posts[1].Liked {
+		t.Errorf("expected only the viewer's like to show, got %+v", page.Posts)
+	}
+
+	page := get("limit=3&after=" + url.QueryEscape(posts[5].CreatedAt.Format(time.RFC3339)))
+	if len(page.Posts) != 3 || page.Posts[0].PostContent != "8" || page.Posts[2].PostContent != "6" {
+		t.Errorf("unexpected newer page: %+v", page.Posts)
+	}
+	if page = get("limit=3&after=" + url.QueryEscape(page.NextCursor)); page.Posts[2].PostContent != "9" {
+		t.Errorf("expected next newer page to continue from 9, got %+v", page.Posts)
+	}
+
+	cursor := gocql.UUIDFromTime(posts[2].CreatedAt)
+	if page = get("before=" + cursor.String()); len(page.Posts) != 2 || page.NextCursor != "" {
+		t.Errorf("expected 2 posts before a TimeUUID cursor, got %+v", page)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/posts/user/3?before=yesterday", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected invalid cursor to be rejected, got %v", w.Code)
+	}
+}
+
+func TestHandleGetUserPostsSharedTimestamps(t *testing.T) {
+	r, handler, mem, cache := newTestRouter(t, 1)
+	r.GET("/posts/user/:id", func(c *gin.Context) {
+		handlers.HandleGetUserPosts(c, handler, cache)
+	})
+
+	ctx := context.Background()
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		createdAt := start
+		if i == 6 {
+			createdAt = start.Add(-time.Minute)
+		}
+		mem.CreatePost(ctx, store.Post{ID: gocql.TimeUUID(), UserID: 3, Content: fmt.Sprint(i), CreatedAt: createdAt})
+	}
+
+	get := func(query string) handlers.TimelinePage {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/posts/user/3?"+query, nil)
+		r.ServeHTTP(w, req)
+		var page handlers.TimelinePage
+		json.Unmarshal(w.Body.Bytes(), &page)
+		return page
+	}
+	page := func(param, cursor string) ([]string, string) {
+		var contents []string
+		result := get("limit=2&" + param + "=" + cursor)
+		for _, post := range result.Posts {
+			contents = append(contents, post.PostContent)
+		}
+		return contents, result.NextCursor
+	}
+
+	var older []string
+	cursor := ""
+	for i := 0; i < 5; i++ {
+		contents, next := page("before", cursor)
+		older = append(older, contents...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if fmt.Sprint(older) != "[5 4 3 2 1 0 6]" {
+		t.Fatalf("expected every post once, newest first, got %v", older)
+	}
+
+	var newer []string
+	cursor = ""
+	for _, post := range get("limit=7").Posts {
+		if post.PostContent == "6" {
+			cursor = post.ID.String()
+		}
+	}
+	for i := 0; i < 5 && cursor != ""; i++ {
+		var contents []string
+		contents, cursor = page("after", cursor)
+		newer = append(contents, newer...)
+	}
+	if fmt.Sprint(newer) != "[5 4 3 2 1 0]" {
+		t.Errorf("expected the posts after the cursor post once each, got %v", newer)
+	}
+}
+
+func TestHandleCommentDelete(t *testing.T) {
+	r, handler, mem, cache := newTestRouter(t, 1)
+	r.DELETE("/comments/:id", func(c *gin.Context) {
+		handlers.HandleCommentDelete(c, handler, cache)
+	})
+	r.GET("/post/:id/comments", func(c *gin.Context) {
+		handlers.GetPostComments(c, handler, cache)
+	})
+
+	ctx := context.Background()
+	postID := gocql.TimeUUID()
+	now := time.Now()
+	comment := store.Comment{ID: gocql.TimeUUID(), UserID: 1, ParentID: postID, CreatedAt: now}
+	reply := store.Comment{ID: gocql.TimeUUID(), UserID: 2, ParentID: comment.ID, CreatedAt: now}
+	nested := store.Comment{ID: gocql.TimeUUID(), UserID: 2, ParentID: reply.ID, CreatedAt: now}
+	other := store.Comment{ID: gocql.TimeUUID(), UserID: 2, ParentID: postID, CreatedAt: now}
+	for _, c := range []store.Comment{comment, reply, nested, other} {
+		mem.CreateComment(ctx, c)
+	}
+	mem.AddLike(ctx, 5, comment.ID, now)
+	mem.AddLike(ctx, 5, reply.ID, now)
+	if page := getPage(t, r, "/post/"+postID.String()+"/comments?sort=top"); len(page.Comments) != 2 {
+		t.Fatalf("expected 2 ranked comments, got %+v", page.Comments)
+	}
+	if count := cacheoperations.GetPostComments(postID.String(), cache, ctx, mem); count != 2 {
+		t.Fatalf("expected 2 cached comments, got %d", count)
+	}
+
+	for _, step := range []struct {
+		id     gocql.UUID
+		status int
+	}{
+		{other.ID, http.StatusNotFound},
+		{gocql.TimeUUID(), http.StatusNotFound},
+		{comment.ID, http.StatusOK},
+		{comment.ID, http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodDelete, "/comments/"+step.id.String(), nil)
+		r.ServeHTTP(w, req)
+		if w.Code != step.status {
+			t.Errorf("delete %s: got status %v want %v", step.id, w.Code, step.status)
+		}
+	}
+
+	for _, id := range []gocql.UUID{comment.ID, reply.ID, nested.ID} {
+		if _, err := mem.GetComment(ctx, id); err != store.ErrNotFound {
+			t.Errorf("expected comment %s to be deleted, got %v", id, err)
+		}
+		if likers, _ := mem.ListLikers(ctx, id); len(likers) != 0 {
+			t.Errorf("expected likes on %s to be cleared, got %v", id, likers)
+		}
+	}
+	// A delete that lost the race to another one leaves the count alone.
+	if deleted, err := mem.DeleteComment(ctx, comment, nil); deleted || err != nil {
+		t.Errorf("expected a repeated delete to change nothing, got %v %v", deleted, err)
+	}
+	if count, _ := mem.CommentCount(ctx, postID); count != 1 {
+		t.Errorf("expected 1 stored comment, got %d", count)
+	}
+	if count := cacheoperations.GetPostComments(postID.String(), cache, ctx, mem); count != 1 {
+		t.Errorf("expected 1 cached comment, got %d", count)
+	}
+	page := getPage(t, r, "/post/"+postID.String()+"/comments?sort=top")
+	if len(page.Comments) != 1 || page.Comments[0].ID != other.ID {
+		t.Errorf("expected only the other comment to stay ranked, got %+v", page.Comments)
+	}
+}
+
+func TestHandleEdit(t *testing.T) {
+	r, handler, mem, cache := newTestRouter(t, 1)
+	r.PATCH("/posts/:id", func(c *gin.Context) {
+		handlers.HandlePostEdit(c, handler, cache)
+	})
+	r.PATCH("/comments/:id", func(c *gin.Context) {
+		handlers.HandleCommentEdit(c, handler, cache)
+	})
+	r.GET("/posts/:id/revisions", func(c *gin.Context) {
+		handlers.HandleGetRevisions(c, handler)
+	})
+
+	ctx := context.Background()
+	created := time.Now().Add(-time.Hour)
+	post := store.Post{ID: gocql.TimeUUID(), UserID: 1, Content: "first", CreatedAt: created}
+	theirs := store.Post{ID: gocql.TimeUUID(), UserID: 2, Content: "theirs", CreatedAt: created}
+	comment := store.Comment{ID: gocql.TimeUUID(), UserID: 1, ParentID: theirs.ID, Content: "nice", CreatedAt: created}
+	mem.CreatePost(ctx, post)
+	mem.CreatePost(ctx, theirs)
+	mem.CreateComment(ctx, comment)
+
+	patch := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPatch, path, bytes.NewBufferString(body))
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := patch("/posts/"+post.ID.String(), `{"post_content":"second"}`)
+	var edited handlers.Post
+	json.Unmarshal(w.Body.Bytes(), &edited)
+	if w.Code != http.StatusOK || edited.PostContent != "second" || edited.EditedAt == nil {
+		t.Fatalf("unexpected edit response %v: %s", w.Code, w.Body.String())
+	}
+	patch("/posts/"+post.ID.String(), `{"post_content":"third"}`)
+	if stored, _ := mem.GetPost(ctx, post.ID); stored.Content != "third" || stored.EditedAt.IsZero() {
+		t.Errorf("edit was not stored: %+v", stored)
+	}
+	if w := patch("/posts/"+theirs.ID.String(), `{"post_content":"mine now"}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected editing someone else's post to fail, got %v", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/posts/"+post.ID.String()+"/revisions", nil)
+	r.ServeHTTP(w, req)
+	var revisions []handlers.Revision
+	json.Unmarshal(w.Body.Bytes(), &revisions)
+	if len(revisions) != 2 || revisions[0].Content != "second" || revisions[1].Content != "first" || !revisions[1].WrittenAt.Equal(created) {
+		t.Errorf("unexpected revisions: %+v", revisions)
+	}
+
+	w = patch("/comments/"+comment.ID.String(), `{"comment_content":"great"}`)
+	if stored, _ := mem.GetComment(ctx, comment.ID); w.Code != http.StatusOK || stored.Content != "great" {
+		t.Errorf("comment edit was not stored: %v %+v", w.Code, stored)
+	}
+
+	handler.EditWindow = time.Minute
+	if w := patch("/posts/"+post.ID.String(), `{"post_content":"too late"}`); w.Code != http.StatusForbidden {
+		t.Errorf("expected edit outside the window to be refused, got %v", w.Code)
+	}
+	if w := patch("/comments/"+comment.ID.String(), `{"comment_content":"too late"}`); w.Code != http.StatusForbidden {
+		t.Errorf("expected comment edit outside the window to be refused, got %v", w.Code)
+	}
+}
 
 type MockHttpClient struct{}
 
@@ -0,0 +1,186 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/handlers"
+	cacheoperations "github.com/cal1co/movielogv2-postservice/rediscache"
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+func TestHandleGetTagPosts(t *testing.T) {
+	r, handler, mem, cache := newTestRouter(t, 1)
+	r.GET("/tags/:tag/posts", func(c *gin.Context) {
+		handlers.HandleGetTagPosts(c, handler, cache)
+	})
+
+	ctx := context.Background()
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	var posts []store.Post
+	for i := 0; i < 5; i++ {
+		post := store.Post{ID: gocql.TimeUUID(), UserID: 1, Content: fmt.Sprintf("#Movies night %d", i), CreatedAt: start.Add(time.Duration(i) * time.Minute)}
+		mem.CreatePost(ctx, post)
+		posts = append(posts, post)
+	}
+	comment := store.Comment{ID: gocql.TimeUUID(), UserID: 2, ParentID: posts[0].ID, Content: "me too #movies", CreatedAt: start.Add(time.Hour)}
+	mem.CreateComment(ctx, comment)
+	mem.CreatePost(ctx, store.Post{ID: gocql.TimeUUID(), UserID: 1, Content: "#books", CreatedAt: start})
+	mem.EditPost(ctx, posts[1], "no tags any more", nil, start.Add(2*time.Hour))
+	mem.TrashPost(ctx, posts[2], nil, start.Add(2*time.Hour))
+
+	get := func(path string) handlers.TimelinePage {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %v", path, w.Code)
+		}
+		var page handlers.TimelinePage
+		json.Unmarshal(w.Body.Bytes(), &page)
+		return page
+	}
+
+	page := get("/tags/movies/posts?limit=2")
+	if len(page.Posts) != 2 || page.Posts[0].ID != comment.ID || page.Posts[1].ID != posts[4].ID {
+		t.Fatalf("unexpected first page: %+v", page.Posts)
+	}
+	if page.Posts[0].ParentID == nil || *page.Posts[0].ParentID != posts[0].ID || page.Posts[1].ParentID != nil {
+		t.Errorf("expected only the comment to carry a parent_id: %+v", page.Posts)
+	}
+	// posts[2] is in the trash and posts[1] lost its tag, so they are skipped.
+	page = get("/tags/%23Movies/posts?limit=2&before=" + url.QueryEscape(page.NextCursor))
+	if len(page.Posts) != 1 || page.Posts[0].ID != posts[3].ID {
+		t.Fatalf("unexpected second page: %+v", page.Posts)
+	}
+	page = get("/tags/movies/posts?limit=2&before=" + url.QueryEscape(page.NextCursor))
+	if len(page.Posts) != 1 || page.Posts[0].ID != posts[0].ID || page.NextCursor != "" {
+		t.Errorf("unexpected last page: %+v", page)
+	}
+
+	mem.PurgePost(ctx, posts[2])
+	if tagged, _ := mem.ListTaggedPosts(ctx, "movies", store.TimelineCursor{}, 0); len(tagged) != 4 {
+		t.Errorf("expected purging to drop the tag entry, got %+v", tagged)
+	}
+
+	// Both edits start from the same stale copy; the second still replaces
+	// what the first stored.
+	mem.EditPost(ctx, posts[3], "#sequels", nil, start.Add(3*time.Hour))
+	mem.EditPost(ctx, posts[3], "#remakes", nil, start.Add(4*time.Hour))
+	if tagged, _ := mem.ListTaggedPosts(ctx, "sequels", store.TimelineCursor{}, 0); len(tagged) != 0 {
+		t.Errorf("expected the stale edit to drop #sequels, got %+v", tagged)
+	}
+	if revisions, _ := mem.ListRevisions(ctx, posts[3].ID); len(revisions) != 2 || revisions[0].Content != "#sequels" {
+		t.Errorf("expected #sequels to be kept as the latest revision, got %+v", revisions)
+	}
+}
+
+func TestHandleGetTagPostsSharedTimestamps(t *testing.T) {
+	r, handler, mem, cache := newTestRouter(t, 1)
+	r.GET("/tags/:tag/posts", func(c *gin.Context) {
+		handlers.HandleGetTagPosts(c, handler, cache)
+	})
+
+	ctx := context.Background()
+	createdAt := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	var ids []gocql.UUID
+	for i := 0; i < 5; i++ {
+		id := gocql.TimeUUID()
+		if i == 2 {
+			mem.CreateComment(ctx, store.Comment{ID: id, UserID: 2, ParentID: ids[0], Content: "#ties", CreatedAt: createdAt})
+		} else {
+			mem.CreatePost(ctx, store.Post{ID: id, UserID: 1, Content: "#ties", CreatedAt: createdAt})
+		}
+		ids = append(ids, id)
+	}
+
+	var seen []gocql.UUID
+	query := "limit=3"
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/tags/ties/posts?"+query, nil)
+		r.ServeHTTP(w, req)
+		var page handlers.TimelinePage
+		json.Unmarshal(w.Body.Bytes(), &page)
+		for _, post := range page.Posts {
+			seen = append(seen, post.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query = "limit=3&before=" + page.NextCursor
+	}
+	if fmt.Sprint(seen) != fmt.Sprint([]gocql.UUID{ids[4], ids[3], ids[2], ids[1], ids[0]}) {
+		t.Errorf("expected every entry once, newest first, got %v for %v", seen, ids)
+	}
+}
+
+func TestTrendingTags(t *testing.T) {
+	r, handler, _, cache := newTestRouter(t, 1)
+	r.GET("/tags/trending", func(c *gin.Context) {
+		handlers.HandleTrendingTags(c, handler, cache)
+	})
+	windows, err := cacheoperations.ParseTrendingWindows("1h/12, 24h")
+	if err != nil || len(windows) != 2 || windows[1].Buckets != 12 {
+		t.Fatalf("unexpected windows %+v: %v", windows, err)
+	}
+	if _, err := cacheoperations.ParseTrendingWindows("1h/0"); err == nil {
+		t.Errorf("expected zero buckets to be rejected")
+	}
+	handler.Trending = windows
+
+	ctx := context.Background()
+	now := time.Now()
+	record := func(tag string, uses int, ago time.Duration) {
+		for i := 0; i < uses; i++ {
+			cacheoperations.RecordHashtags([]string{tag}, now.Add(-ago), windows, cache, ctx)
+		}
+	}
+	// An older burst of #oscars is outweighed by fewer, fresher uses of #movies
+	// within the hour, but still leads over the whole day.
+	record("movies", 3, time.Minute)
+	record("oscars", 5, 50*time.Minute)
+	record("oscars", 20, 5*time.Hour)
+	record("books", 1, 30*time.Hour)
+
+	get := func(query string) []handlers.TrendingTag {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/tags/trending?"+query, nil)
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %v", query, w.Code)
+		}
+		var tags []handlers.TrendingTag
+		json.Unmarshal(w.Body.Bytes(), &tags)
+		return tags
+	}
+	names := func(tags []handlers.TrendingTag) string {
+		var names []string
+		for _, tag := range tags {
+			names = append(names, tag.Hashtag)
+		}
+		return fmt.Sprint(names)
+	}
+
+	if tags := get(""); names(tags) != "[movies oscars]" {
+		t.Errorf("unexpected hourly trending: %+v", tags)
+	}
+	if tags := get("window=24h&limit=1"); names(tags) != "[oscars]" {
+		t.Errorf("unexpected daily trending: %+v", tags)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/tags/trending?window=1y", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown window to be rejected, got %v", w.Code)
+	}
+}
@@ -0,0 +1,152 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/handlers"
+	"github.com/cal1co/movielogv2-postservice/middleware"
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/gin-gonic/gin"
+)
+
+func TestIdempotentPost(t *testing.T) {
+	r, handler, mem, cache := newTestRouter(t, 1)
+	r.POST("/post", middleware.IdempotencyMiddleware(cache, time.Hour, time.Minute), func(c *gin.Context) {
+		handlers.HandlePost(c, handler, cache)
+	})
+	send := func(key, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/post", bytes.NewBufferString(body))
+		req.Header.Set("Idempotency-Key", key)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	first := send("k1", `{"post_content":"hello"}`)
+	retry := send("k1", `{"post_content":"hello"}`)
+	if first.Code != http.StatusCreated || retry.Code != http.StatusCreated || retry.Body.String() != first.Body.String() {
+		t.Fatalf("expected the retry to replay %v %s, got %v %s", first.Code, first.Body.String(), retry.Code, retry.Body.String())
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected the replay to be marked")
+	}
+	posts, _ := mem.ListUserPosts(context.Background(), 1, store.TimelineCursor{}, store.TimelineCursor{}, 10)
+	if len(posts) != 1 {
+		t.Fatalf("expected one post, got %+v", posts)
+	}
+
+	if w := send("k1", `{"post_content":"something else"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected a reused key to be refused, got %v", w.Code)
+	}
+	if w := send("k2", `{"post_content":"hello"}`); w.Code != http.StatusCreated {
+		t.Errorf("expected a new key to create a post, got %v", w.Code)
+	}
+	if w := send("", `{"post_content":"hello"}`); w.Code != http.StatusCreated {
+		t.Errorf("expected a request without a key to create a post, got %v", w.Code)
+	}
+	if posts, _ := mem.ListUserPosts(context.Background(), 1, store.TimelineCursor{}, store.TimelineCursor{}, 10); len(posts) != 3 {
+		t.Errorf("expected three posts, got %v", len(posts))
+	}
+}
+
+// failingPosts fails CreatePost while fail is set.
+type failingPosts struct {
+	*store.Memory
+	fail bool
+}
+
+func (f *failingPosts) CreatePost(ctx context.Context, post store.Post, jobs ...store.OutboxJob) error {
+	if f.fail {
+		return errors.New("cassandra unavailable")
+	}
+	return f.Memory.CreatePost(ctx, post, jobs...)
+}
+
+func TestIdempotentPostRetriesStoreFailure(t *testing.T) {
+	r, handler, mem, cache := newTestRouter(t, 1)
+	posts := &failingPosts{Memory: mem, fail: true}
+	handler.Posts = posts
+	r.POST("/post", middleware.IdempotencyMiddleware(cache, time.Hour, time.Minute), func(c *gin.Context) {
+		handlers.HandlePost(c, handler, cache)
+	})
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/post", bytes.NewBufferString(`{"post_content":"hello"}`))
+		req.Header.Set("Idempotency-Key", "k1")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send(); w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected the failed write to be a server error, got %v", w.Code)
+	}
+	posts.fail = false
+	w := send()
+	if w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("expected the retry to create the post, got %v %s", w.Code, w.Body.String())
+	}
+	if stored, _ := mem.ListUserPosts(context.Background(), 1, store.TimelineCursor{}, store.TimelineCursor{}, 10); len(stored) != 1 {
+		t.Errorf("expected one post, got %+v", stored)
+	}
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	r, _, _, cache := newTestRouter(t, 1)
+	other, _, _, _ := newTestRouter(t, 2)
+	started, release := make(chan struct{}), make(chan struct{})
+	failures := 0
+	create := func(c *gin.Context) {
+		if c.Query("fail") != "" && failures == 0 {
+			failures++
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if c.Query("block") != "" {
+			close(started)
+			<-release
+		}
+		c.JSON(http.StatusCreated, "created")
+	}
+	idempotent := middleware.IdempotencyMiddleware(cache, time.Hour, time.Minute)
+	r.POST("/post", idempotent, create)
+	other.POST("/post", idempotent, create)
+	send := func(router *gin.Engine, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("Idempotency-Key", "k1")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- send(r, "/post?block=1")
+	}()
+	<-started
+	if w := send(r, "/post?block=1"); w.Code != http.StatusConflict {
+		t.Errorf("expected a concurrent duplicate to conflict, got %v", w.Code)
+	}
+	if w := send(other, "/post"); w.Code != http.StatusCreated {
+		t.Errorf("expected keys to be per user, got %v", w.Code)
+	}
+	close(release)
+	if w := <-done; w.Code != http.StatusCreated {
+		t.Fatalf("first request returned %v", w.Code)
+	}
+
+	// Server errors release the key so that the retry runs.
+	r.POST("/retry", idempotent, create)
+	cache.Del(context.Background(), "idempotency:1:k1")
+	if w := send(r, "/retry?fail=1"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected the first attempt to fail, got %v", w.Code)
+	}
+	if w := send(r, "/retry?fail=1"); w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected the retry to run, got %v", w.Code)
+	}
+}
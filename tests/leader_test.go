@@ -0,0 +1,110 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cal1co/movielogv2-postservice/leader"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestLeaseTakeover(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	a := leader.NewElector(client, "leader:test", "a")
+	b := leader.NewElector(client, "leader:test", "b")
+
+	leaseA, err := a.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Acquire(ctx); err != leader.ErrNotLeader {
+		t.Fatalf("expected lease to be held, got %v", err)
+	}
+	if err := leaseA.Renew(ctx); err != nil {
+		t.Fatalf("expected renewal to succeed, got %v", err)
+	}
+
+	mr.FastForward(a.TTL + time.Second)
+	leaseB, err := b.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("expected expired lease to be taken over, got %v", err)
+	}
+	if err := leaseA.Validate(ctx); err != leader.ErrNotLeader {
+		t.Errorf("expected stale lease to be invalid, got %v", err)
+	}
+	if err := leaseA.Renew(ctx); err != leader.ErrNotLeader {
+		t.Errorf("expected stale renewal to fail, got %v", err)
+	}
+	leaseA.Release(ctx)
+	if err := leaseB.Validate(ctx); err != nil {
+		t.Errorf("expected stale release to leave the new lease alone, got %v", err)
+	}
+
+	// The same holder taking the lease again gets a lease of its own.
+	leaseB.Release(ctx)
+	again, err := b.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaseB.Validate(ctx); err != leader.ErrNotLeader {
+		t.Errorf("expected the released lease to stay invalid, got %v", err)
+	}
+	if err := again.Validate(ctx); err != nil {
+		t.Errorf("expected the new lease to be valid, got %v", err)
+	}
+}
+
+func TestLeaderFailover(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan string, 4)
+	stopped := make(chan string, 4)
+	for _, id := range []string{"a", "b"} {
+		elector := leader.NewElector(client, "leader:test", id)
+		elector.TTL = 150 * time.Millisecond
+		go elector.Run(ctx, func(ctx context.Context, lease *leader.Lease) {
+			started <- elector.ID
+			<-ctx.Done()
+			stopped <- elector.ID
+		})
+	}
+
+	first := waitFor(t, started)
+	select {
+	case id := <-started:
+		t.Fatalf("%s started while %s held the lease", id, first)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// Simulate the leader's lease expiring, for example after a long pause.
+	mr.Del("leader:test")
+	second := waitFor(t, started)
+	if second == first {
+		// The old leader may win the race to re-acquire; it must have stopped first.
+		if waitFor(t, stopped) != first {
+			t.Fatalf("expected %s to stop", first)
+		}
+		return
+	}
+	if stoppedID := waitFor(t, stopped); stoppedID != first {
+		t.Errorf("expected %s to stop after losing the lease, got %s", first, stoppedID)
+	}
+}
+
+func waitFor(t *testing.T, ch chan string) string {
+	t.Helper()
+	select {
+	case id := <-ch:
+		return id
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for leader")
+		return ""
+	}
+}
@@ -0,0 +1,176 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/directory"
+	"github.com/cal1co/movielogv2-postservice/entities"
+	"github.com/cal1co/movielogv2-postservice/handlers"
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+func TestEntityOffsets(t *testing.T) {
+	content := "Café with @Ana, #films"
+	found := entities.Parse(content)
+	if len(found) != 2 {
+		t.Fatalf("unexpected entities %+v", found)
+	}
+	runes := []rune(content)
+	for _, entity := range found {
+		if text := string(runes[entity.Start:entity.End]); text != map[string]string{entities.Mention: "@Ana", entities.Hashtag: "#films"}[entity.Type] {
+			t.Errorf("offsets of %+v cover %q", entity, text)
+		}
+	}
+}
+
+func TestDirectoryClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/users/lookup" {
+			http.NotFound(w, r)
+			return
+		}
+		var users []map[string]interface{}
+		for _, name := range r.URL.Query()["username"] {
+			if name == "ana" {
+				users = append(users, map[string]interface{}{"id": 5, "username": "Ana"})
+			}
+		}
+		json.NewEncoder(w).Encode(users)
+	}))
+	defer server.Close()
+
+	users, err := directory.NewClient(server.URL+"/").Resolve(context.Background(), []string{"ana", "ghost"})
+	if err != nil || len(users) != 1 || users["ana"] != 5 {
+		t.Errorf("unexpected users %v: %v", users, err)
+	}
+	if _, err := directory.NewClient(server.URL+"/missing").Resolve(context.Background(), []string{"ana"}); err == nil {
+		t.Errorf("expected a failed lookup to be an error")
+	}
+}
+
+func TestMentions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r, handler, mem, cache := newTestRouter(t, 1)
+	users := directory.NewMemory()
+	users.Add("Ana", 5)
+	users.Add("bob", 6)
+	handler.Users = users
+	r.POST("/post/:id/comment", func(c *gin.Context) {
+		handlers.HandleComment(c, handler, cache, false)
+	})
+	r.PATCH("/posts/:id", func(c *gin.Context) {
+		handlers.HandlePostEdit(c, handler, cache)
+	})
+	// A second router serves /me/mentions as whichever user asks.
+	me := func(uid float64, query string) handlers.TimelinePage {
+		router := gin.New()
+		router.Use(func(c *gin.Context) {
+			c.Set("user_id", uid)
+		})
+		router.GET("/me/mentions", func(c *gin.Context) {
+			handlers.HandleGetMentions(c, handler, cache)
+		})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/me/mentions?"+query, nil)
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("mentions of %v returned %v", uid, w.Code)
+		}
+		var page handlers.TimelinePage
+		json.Unmarshal(w.Body.Bytes(), &page)
+		return page
+	}
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	ctx := context.Background()
+	post := store.Post{ID: gocql.TimeUUID(), UserID: 1, Content: "draft", CreatedAt: time.Now().Add(-time.Minute)}
+	mem.CreatePost(ctx, post)
+	w := send(http.MethodPatch, "/posts/"+post.ID.String(), `{"post_content":"hi @ANA and @ghost, @bob"}`)
+	var edited handlers.Post
+	json.Unmarshal(w.Body.Bytes(), &edited)
+	if w.Code != http.StatusOK || fmt.Sprint(edited.Mentions) != "[{ana 5 3 7} {bob 6 20 24}]" {
+		t.Fatalf("unexpected edit response %v: %s", w.Code, w.Body.String())
+	}
+	if w := send(http.MethodPost, "/post/"+post.ID.String()+"/comment", `{"comment_content":"@ana look"}`); w.Code != http.StatusCreated {
+		t.Fatalf("comment returned %v", w.Code)
+	}
+
+	page := me(5, "limit=1")
+	if len(page.Posts) != 1 || page.Posts[0].ParentID == nil || *page.Posts[0].ParentID != post.ID || page.NextCursor == "" {
+		t.Fatalf("expected the comment first, got %+v", page)
+	}
+	if page.Posts[0].Mentions[0].UserID != 5 {
+		t.Errorf("expected the comment to carry its mention, got %+v", page.Posts[0].Mentions)
+	}
+	page = me(5, "limit=1&before="+url.QueryEscape(page.NextCursor))
+	if len(page.Posts) != 1 || page.Posts[0].ID != post.ID {
+		t.Errorf("expected the post next, got %+v", page)
+	}
+
+	send(http.MethodPatch, "/posts/"+post.ID.String(), `{"post_content":"just @bob"}`)
+	if page := me(5, ""); len(page.Posts) != 1 {
+		t.Errorf("expected the edit to drop ana's mention in the post, got %+v", page.Posts)
+	}
+	if page := me(6, ""); len(page.Posts) != 1 || page.Posts[0].Mentions[0].Start != 5 {
+		t.Errorf("expected bob to still be mentioned, got %+v", page.Posts)
+	}
+	if page := me(7, ""); page.Posts == nil || len(page.Posts) != 0 {
+		t.Errorf("expected no mentions, got %+v", page)
+	}
+}
+
+func TestMentionsSharedTimestamps(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	_, handler, mem, cache := newTestRouter(t, 5)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("user_id", float64(5))
+	})
+	r.GET("/me/mentions", func(c *gin.Context) {
+		handlers.HandleGetMentions(c, handler, cache)
+	})
+
+	ctx := context.Background()
+	createdAt := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	var ids []gocql.UUID
+	for i := 0; i < 5; i++ {
+		post := store.Post{ID: gocql.TimeUUID(), UserID: 1, Content: "@ana", CreatedAt: createdAt, Mentions: []store.Mention{{Username: "ana", UserID: 5, Start: 0, End: 4}}}
+		mem.CreatePost(ctx, post)
+		ids = append(ids, post.ID)
+	}
+
+	var seen []gocql.UUID
+	query := "limit=2"
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/me/mentions?"+query, nil)
+		r.ServeHTTP(w, req)
+		var page handlers.TimelinePage
+		json.Unmarshal(w.Body.Bytes(), &page)
+		for _, post := range page.Posts {
+			seen = append(seen, post.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query = "limit=2&before=" + page.NextCursor
+	}
+	if fmt.Sprint(seen) != fmt.Sprint([]gocql.UUID{ids[4], ids[3], ids[2], ids[1], ids[0]}) {
+		t.Errorf("expected every mention once, newest first, got %v for %v", seen, ids)
+	}
+}
@@ -0,0 +1,149 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/handlers"
+	"github.com/cal1co/movielogv2-postservice/outbox"
+	"github.com/cal1co/movielogv2-postservice/search"
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+func TestOutboxRelay(t *testing.T) {
+	mem := store.NewMemory()
+	ctx := context.Background()
+	now := time.Now()
+
+	delivered := map[string]int{}
+	failures := 0
+	relay := outbox.NewRelay(mem, map[string]outbox.Deliver{
+		outbox.KindIndex: func(ctx context.Context, payload []byte) error {
+			delivered[string(payload)]++
+			return nil
+		},
+		outbox.KindFanout: func(ctx context.Context, payload []byte) error {
+			failures++
+			return errors.New("feed handler unavailable")
+		},
+	})
+	relay.MaxAttempts = 2
+
+	index, _ := outbox.NewJob(outbox.KindIndex, "p1", now)
+	fanout, _ := outbox.NewJob(outbox.KindFanout, "p1", now)
+	if err := mem.CreatePost(ctx, store.Post{ID: gocql.TimeUUID(), UserID: 1, CreatedAt: now}, index, fanout); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := relay.Relay(ctx)
+	if err != nil || count != 1 || delivered[`"p1"`] != 1 {
+		t.Fatalf("expected the index job delivered, got %v %v: %v", count, delivered, err)
+	}
+	jobs, _ := mem.ListDueJobs(ctx, time.Now(), 10)
+	if len(jobs) != 0 {
+		t.Fatalf("expected the failed job to back off, got %+v", jobs)
+	}
+	jobs, _ = mem.ListDueJobs(ctx, time.Now().Add(relay.Backoff), 10)
+	if len(jobs) != 1 || jobs[0].Attempts != 1 || jobs[0].LastError != "feed handler unavailable" {
+		t.Fatalf("expected the fanout job rescheduled, got %+v", jobs)
+	}
+
+	// Pull the retry forward rather than waiting out the backoff.
+	mem.RetryJob(ctx, jobs[0], time.Now())
+	if _, err := relay.Relay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if jobs, _ := mem.ListDueJobs(ctx, time.Now().Add(time.Hour), 10); len(jobs) != 0 {
+		t.Errorf("expected no jobs left, got %+v", jobs)
+	}
+	dead, _ := mem.ListDeadLetters(ctx, 10)
+	if failures != 2 || len(dead) != 1 || dead[0].ID != fanout.ID || dead[0].Attempts != 2 || dead[0].FailedAt.IsZero() {
+		t.Fatalf("expected the fanout job dead-lettered after 2 attempts, got %+v", dead)
+	}
+}
+
+func TestReplayDeadLetter(t *testing.T) {
+	r, handler, mem, _ := newTestRouter(t, 1)
+	r.GET("/admin/outbox/dead-letters", func(c *gin.Context) {
+		handlers.HandleGetDeadLetters(c, handler)
+	})
+	r.POST("/admin/outbox/dead-letters/:id/replay", func(c *gin.Context) {
+		handlers.HandleReplayDeadLetter(c, handler)
+	})
+	ctx := context.Background()
+	job, _ := outbox.NewJob(outbox.KindFanout, map[string]string{"post_id": "p1"}, time.Now())
+	job.Attempts = 8
+	job.LastError = "feed handler unavailable"
+	job.FailedAt = time.Now()
+	mem.DeadLetterJob(ctx, job)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/admin/outbox/dead-letters", nil)
+	r.ServeHTTP(w, req)
+	var letters []handlers.DeadLetter
+	json.Unmarshal(w.Body.Bytes(), &letters)
+	if w.Code != http.StatusOK || len(letters) != 1 || letters[0].ID != job.ID || string(letters[0].Payload) != `{"post_id":"p1"}` {
+		t.Fatalf("unexpected dead letters %v: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/admin/outbox/dead-letters/"+job.ID.String()+"/replay", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("replay returned %v: %s", w.Code, w.Body.String())
+	}
+	jobs, _ := mem.ListDueJobs(ctx, time.Now(), 10)
+	if len(jobs) != 1 || jobs[0].ID != job.ID || jobs[0].Attempts != 0 {
+		t.Errorf("expected the job back in the outbox with fresh attempts, got %+v", jobs)
+	}
+	if dead, _ := mem.ListDeadLetters(ctx, 10); len(dead) != 0 {
+		t.Errorf("expected the dead letter removed, got %+v", dead)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/admin/outbox/dead-letters/"+job.ID.String()+"/replay", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected a second replay to be %v, got %v", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestIndexDeliveryReadsStoredPost(t *testing.T) {
+	_, handler, mem, _ := newTestRouter(t, 1)
+	local := search.NewLocal()
+	handler.Search = local
+	deliver := handler.Deliveries()[outbox.KindIndex]
+	ctx := context.Background()
+	find := func(query string) int {
+		results, _ := local.Search(ctx, search.Request{Query: query, Size: 10})
+		return len(results.Hits)
+	}
+
+	post := store.Post{ID: gocql.TimeUUID(), UserID: 1, Content: "first draft", CreatedAt: time.Now()}
+	mem.CreatePost(ctx, post)
+	mem.EditPost(ctx, post, "final cut", nil, time.Now())
+	job, _ := outbox.NewJob(outbox.KindIndex, search.NewDocument(post), post.CreatedAt)
+	if err := deliver(ctx, job.Payload); err != nil {
+		t.Fatal(err)
+	}
+	if find("draft") != 0 || find("final") != 1 {
+		t.Errorf("expected the edited post to be indexed, not the queued snapshot")
+	}
+
+	local.DeletePost(post.ID.String())
+	stored, _ := mem.GetPost(ctx, post.ID)
+	mem.TrashPost(ctx, stored, nil, time.Now())
+	if err := deliver(ctx, job.Payload); err != nil || find("final") != 0 {
+		t.Errorf("expected a trashed post to be skipped, got %v", err)
+	}
+	if err := deliver(ctx, []byte(`{"post_id":"not-a-uuid"}`)); err == nil {
+		t.Errorf("expected a bad payload to fail the job")
+	}
+}
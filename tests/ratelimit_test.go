@@ -0,0 +1,139 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cal1co/movielogv2-postservice/middleware"
+	"github.com/cal1co/movielogv2-postservice/ratelimit"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisRateLimiter(t *testing.T) {
+	mr := miniredis.RunT(t)
+	limiter := ratelimit.NewRedis(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	ctx := context.Background()
+	policy := ratelimit.Policy{Name: "create-post", Limit: 3, Period: time.Minute}
+
+	for want := 2; want >= 0; want-- {
+		result, err := limiter.Allow(ctx, "user:1", policy)
+		if err != nil || !result.Allowed || result.Remaining != want {
+			t.Fatalf("expected %v remaining, got %+v: %v", want, result, err)
+		}
+	}
+	result, err := limiter.Allow(ctx, "user:1", policy)
+	if err != nil || result.Allowed || result.RetryAfter < 19*time.Second || result.RetryAfter > 20*time.Second || result.Reset < 59*time.Second {
+		t.Fatalf("expected a refusal for about 20s, got %+v: %v", result, err)
+	}
+	if result, _ := limiter.Allow(ctx, "user:2", policy); !result.Allowed {
+		t.Errorf("expected another user to have their own budget")
+	}
+	if result, _ := limiter.Allow(ctx, "user:1", ratelimit.Policy{Name: "default", Limit: 3, Period: time.Minute}); !result.Allowed {
+		t.Errorf("expected another policy to have its own budget")
+	}
+	if ttl := mr.TTL("ratelimit:create-post:user:1"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("expected the arrival time to expire within the period, got %v", ttl)
+	}
+
+	// Budget comes back one request at a time.
+	fast := ratelimit.Policy{Name: "fast", Limit: 2, Period: 100 * time.Millisecond}
+	limiter.Allow(ctx, "user:1", fast)
+	limiter.Allow(ctx, "user:1", fast)
+	if result, _ := limiter.Allow(ctx, "user:1", fast); result.Allowed {
+		t.Fatalf("expected the budget to be spent")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if result, _ := limiter.Allow(ctx, "user:1", fast); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("expected one request back, got %+v", result)
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("SECRET_TOKEN", "secret")
+	r := gin.New()
+	r.Use(middleware.RateLimiterMiddleware(ratelimit.NewMemory(), map[string]ratelimit.Policy{
+		"POST /post": {Name: "create-post", Limit: 1, Period: time.Minute},
+	}, ratelimit.Policy{Name: "default", Limit: 2, Period: time.Minute}))
+	ok := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	}
+	r.POST("/post", ok)
+	r.GET("/posts/:id", ok)
+
+	token := func(id int) string {
+		signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"id": id}).SignedString([]byte("secret"))
+		return "Bearer " + signed
+	}
+	send := func(method, path, auth, ip string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", auth)
+		req.RemoteAddr = ip + ":1234"
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(http.MethodPost, "/post", token(1), "10.0.0.1")
+	if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "1" || w.Header().Get("RateLimit-Remaining") != "0" || w.Header().Get("RateLimit-Policy") != "1;w=60" {
+		t.Fatalf("unexpected first response %v %v", w.Code, w.Header())
+	}
+	w = send(http.MethodPost, "/post", token(1), "10.0.0.2")
+	retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After"))
+	if w.Code != http.StatusTooManyRequests || retryAfter < 59 || retryAfter > 60 {
+		t.Fatalf("expected the same user from another IP to be refused, got %v %v", w.Code, w.Header())
+	}
+	if w := send(http.MethodPost, "/post", token(2), "10.0.0.1"); w.Code != http.StatusOK {
+		t.Errorf("expected another user from the same IP to be allowed, got %v", w.Code)
+	}
+	if w := send(http.MethodGet, "/posts/1", token(1), "10.0.0.1"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "2" {
+		t.Errorf("expected reads to use the default policy, got %v %v", w.Code, w.Header())
+	}
+
+	// Without a valid token requests are limited by IP.
+	send(http.MethodGet, "/posts/1", "", "10.0.0.3")
+	send(http.MethodGet, "/posts/1", "Bearer forged", "10.0.0.3")
+	if w := send(http.MethodGet, "/posts/1", "", "10.0.0.3"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the IP to be limited, got %v", w.Code)
+	}
+	if w := send(http.MethodGet, "/posts/1", "", "10.0.0.4"); w.Code != http.StatusOK {
+		t.Errorf("expected another IP to be allowed, got %v", w.Code)
+	}
+}
+
+func TestRateLimiterSharesAuthentication(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("SECRET_TOKEN", "secret")
+	r := gin.New()
+	r.Use(middleware.RateLimiterMiddleware(ratelimit.NewMemory(), nil, ratelimit.Policy{Name: "default", Limit: 5, Period: time.Minute}))
+	r.Use(middleware.AuthMiddleware())
+	r.GET("/me", func(c *gin.Context) {
+		c.JSON(http.StatusOK, c.MustGet("user_id"))
+	})
+	send := func(auth string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set("Authorization", auth)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"id": 7}).SignedString([]byte("secret"))
+	if w := send("Bearer " + signed); w.Code != http.StatusOK || w.Body.String() != "7" {
+		t.Errorf("expected user 7 through both middlewares, got %v %s", w.Code, w.Body.String())
+	}
+	if w := send("Bearer forged"); w.Code != http.StatusUnauthorized || w.Header().Get("RateLimit-Remaining") != "4" {
+		t.Errorf("expected a forged token to be limited by IP and refused, got %v %v", w.Code, w.Header())
+	}
+	noID, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"name": "x"}).SignedString([]byte("secret"))
+	if w := send("Bearer " + noID); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a token without an id to be refused, got %v", w.Code)
+	}
+}
@@ -0,0 +1,118 @@
+package test
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/leader"
+	"github.com/cal1co/movielogv2-postservice/reconcile"
+	cacheoperations "github.com/cal1co/movielogv2-postservice/rediscache"
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/gocql/gocql"
+)
+
+func TestReconcileReportsAndRepairsDrift(t *testing.T) {
+	ctx := context.Background()
+	mem := store.NewMemory()
+	cache := cacheoperations.NewMemoryCache()
+	var posts []gocql.UUID
+	for i := 0; i < 5; i++ {
+		post := store.Post{ID: gocql.TimeUUID(), UserID: 1, CreatedAt: time.Now()}
+		mem.CreatePost(ctx, post)
+		mem.AddLike(ctx, 1, post.ID, time.Now())
+		posts = append(posts, post.ID)
+	}
+	comment := store.Comment{ID: gocql.TimeUUID(), UserID: 2, ParentID: posts[0], CreatedAt: time.Now()}
+	mem.CreateComment(ctx, comment)
+	mem.AddLike(ctx, 2, comment.ID, time.Now())
+
+	mem.AddLikeCount(ctx, posts[1], 3)
+	mem.AddCommentCount(ctx, posts[0], -1)
+	mem.AddLikeCount(ctx, comment.ID, -1)
+	cacheoperations.GetPostLikes(posts[1].String(), cache, ctx, mem)
+
+	reconciler := reconcile.NewReconciler(mem, cache)
+	reconciler.PageSize = 2
+	report, err := reconciler.Reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 12 || len(report.Drift) != 3 || report.Repaired != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if likes, _ := mem.LikeCount(ctx, posts[1]); likes != 4 {
+		t.Errorf("expected a report-only run to leave counts alone, got %d", likes)
+	}
+
+	reconciler.Repair = true
+	if report, err = reconciler.Reconcile(ctx); err != nil || report.Repaired != 3 {
+		t.Fatalf("expected 3 repairs, got %+v (%v)", report, err)
+	}
+	for _, id := range posts {
+		if likes, _ := mem.LikeCount(ctx, id); likes != 1 {
+			t.Errorf("expected 1 like on %s, got %d", id, likes)
+		}
+	}
+	if comments, _ := mem.CommentCount(ctx, posts[0]); comments != 1 {
+		t.Errorf("expected 1 comment, got %d", comments)
+	}
+	if likes, _ := mem.LikeCount(ctx, comment.ID); likes != 1 {
+		t.Errorf("expected 1 like on the comment, got %d", likes)
+	}
+	if _, err := cache.Get(ctx, fmt.Sprintf("post:%s:likes", posts[1])); err != cacheoperations.ErrCacheMiss {
+		t.Errorf("expected repaired count to be evicted from the cache, got %v", err)
+	}
+
+	if report, _ = reconciler.Reconcile(ctx); len(report.Drift) != 0 {
+		t.Errorf("expected no drift after repair, got %+v", report.Drift)
+	}
+}
+
+func TestReconcileStopsWithoutLease(t *testing.T) {
+	ctx := context.Background()
+	mem := store.NewMemory()
+	post := store.Post{ID: gocql.TimeUUID(), UserID: 1, CreatedAt: time.Now()}
+	mem.CreatePost(ctx, post)
+	mem.AddLikeCount(ctx, post.ID, 2)
+	reconciler := reconcile.NewReconciler(mem, cacheoperations.NewMemoryCache())
+	reconciler.Repair = true
+	reconciler.CheckLease = func(ctx context.Context) error { return leader.ErrNotLeader }
+
+	if _, err := reconciler.Reconcile(ctx); err != leader.ErrNotLeader {
+		t.Fatalf("expected reconcile without the lease to fail, got %v", err)
+	}
+	if likes, _ := mem.LikeCount(ctx, post.ID); likes != 2 {
+		t.Errorf("expected counts to be left alone, got %d", likes)
+	}
+}
+
+func TestReconcileLag(t *testing.T) {
+	ctx := context.Background()
+	mem := store.NewMemory()
+	mem.CreatePost(ctx, store.Post{ID: gocql.TimeUUID(), UserID: 1, CreatedAt: time.Now()})
+	reconciler := reconcile.NewReconciler(mem, cacheoperations.NewMemoryCache())
+	lag := func() float64 {
+		seconds, err := strconv.ParseFloat(expvar.Get("reconcile_lag_seconds").String(), 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seconds
+	}
+
+	if _, err := reconciler.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if seconds := lag(); seconds >= 1 {
+		t.Fatalf("expected the lag to reset after a complete pass, got %v", seconds)
+	}
+	time.Sleep(20 * time.Millisecond)
+	reconciler.CheckLease = func(ctx context.Context) error { return leader.ErrNotLeader }
+	reconciler.Reconcile(ctx)
+	if seconds := lag(); seconds < 0.02 {
+		t.Errorf("expected an interrupted pass to leave the lag growing, got %v", seconds)
+	}
+}
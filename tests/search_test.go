@@ -0,0 +1,728 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/entities"
+	"github.com/cal1co/movielogv2-postservice/handlers"
+	"github.com/cal1co/movielogv2-postservice/search"
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// fakeES is a stand-in for the parts of the Elasticsearch API the service
+// uses. fail, when set, decides the status of each bulk request (called with
+// an empty action) and of each item in it.
+type fakeES struct {
+	mu          sync.Mutex
+	indices     map[string]map[string]search.Document
+	aliases     map[string]string
+	requests    int
+	fail        func(request int, action, id string) int
+	searches    []map[string]interface{}
+	hits        []map[string]interface{}
+	completions []string
+	searchError string
+}
+
+func newFakeES(t *testing.T) (*fakeES, *elasticsearch.Client) {
+	fake := &fakeES{indices: make(map[string]map[string]search.Document), aliases: make(map[string]string)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	es, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}, DisableRetry: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, es
+}
+
+func (f *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "_bulk":
+		f.bulk(w, r)
+	case strings.HasSuffix(path, "/_search") && f.searchError != "":
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(f.searchError))
+	case strings.HasSuffix(path, "/_search"):
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.searches = append(f.searches, body)
+		hits := f.hits
+		if hits == nil {
+			hits = []map[string]interface{}{}
+		}
+		if size, ok := body["size"].(float64); ok && int(size) < len(hits) {
+			hits = hits[:int(size)]
+		}
+		suggest := map[string]interface{}{}
+		completions, _ := body["suggest"].(map[string]interface{})
+		for name, completion := range completions {
+			prefix := completion.(map[string]interface{})["prefix"].(string)
+			options := []map[string]string{}
+			for _, text := range f.completions {
+				if strings.HasPrefix(text, prefix) {
+					options = append(options, map[string]string{"text": text})
+				}
+			}
+			suggest[name] = []interface{}{map[string]interface{}{"options": options}}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"hits": map[string]interface{}{"total": map[string]int{"value": len(hits)}, "hits": hits}, "suggest": suggest})
+	case path == "_aliases":
+		f.updateAliases(w, r)
+	case strings.HasPrefix(path, "_alias/"):
+		name := strings.TrimPrefix(path, "_alias/")
+		index, ok := f.aliases[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{index: map[string]interface{}{"aliases": map[string]interface{}{name: struct{}{}}}})
+	case r.Method == http.MethodPut:
+		if _, ok := f.indices[path]; ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.indices[path] = make(map[string]search.Document)
+		w.Write([]byte(`{"acknowledged":true}`))
+	case r.Method == http.MethodHead:
+		_, index := f.indices[path]
+		_, alias := f.aliases[path]
+		if !index && !alias {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// resolve follows an alias to its index, creating the index on first write as
+// Elasticsearch does.
+func (f *fakeES) resolve(name string) map[string]search.Document {
+	if index, ok := f.aliases[name]; ok {
+		name = index
+	}
+	if f.indices[name] == nil {
+		f.indices[name] = make(map[string]search.Document)
+	}
+	return f.indices[name]
+}
+
+func (f *fakeES) bulk(w http.ResponseWriter, r *http.Request) {
+	f.requests++
+	if f.fail != nil && f.fail(f.requests, "", "") != 0 {
+		w.WriteHeader(f.fail(f.requests, "", ""))
+		return
+	}
+	var items []map[string]map[string]interface{}
+	failed := false
+	lines := bufio.NewScanner(r.Body)
+	for lines.Scan() {
+		var meta map[string]map[string]string
+		json.Unmarshal(lines.Bytes(), &meta)
+		for action, target := range meta {
+			id := target["_id"]
+			var doc search.Document
+			if action == "index" {
+				lines.Scan()
+				json.Unmarshal(lines.Bytes(), &doc)
+			}
+			status := http.StatusOK
+			if f.fail != nil {
+				if s := f.fail(f.requests, action, id); s != 0 {
+					status = s
+				}
+			}
+			if status == http.StatusOK {
+				docs := f.resolve(target["_index"])
+				if action == "index" {
+					docs[id] = doc
+				} else if _, ok := docs[id]; ok {
+					delete(docs, id)
+				} else {
+					status = http.StatusNotFound
+				}
+			}
+			failed = failed || status >= 300
+			items = append(items, map[string]map[string]interface{}{action: {"_id": id, "status": status}})
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": failed, "items": items})
+}
+
+func (f *fakeES) updateAliases(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Actions []map[string]map[string]string `json:"actions"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	for _, action := range body.Actions {
+		for name, args := range action {
+			switch name {
+			case "add":
+				f.aliases[args["alias"]] = args["index"]
+			case "remove":
+				if f.aliases[args["alias"]] == args["index"] {
+					delete(f.aliases, args["alias"])
+				}
+			case "remove_index":
+				delete(f.indices, args["index"])
+			}
+		}
+	}
+	w.Write([]byte(`{"acknowledged":true}`))
+}
+
+func (f *fakeES) doc(id gocql.UUID) (search.Document, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	doc, ok := f.resolve("posts")[id.String()]
+	return doc, ok
+}
+
+func TestIndexerFollowsPostLifecycle(t *testing.T) {
+	fake, es := newFakeES(t)
+	r, handler, mem, cache := newTestRouter(t, 1)
+	backend := search.NewElasticsearch(es, "posts")
+	handler.Search = backend
+	r.PATCH("/posts/:id", func(c *gin.Context) {
+		handlers.HandlePostEdit(c, handler, cache)
+	})
+	r.DELETE("/posts/:id", func(c *gin.Context) {
+		handlers.HandlePostDelete(c, handler, cache)
+	})
+	r.POST("/me/trash/:id/restore", func(c *gin.Context) {
+		handlers.HandleRestorePost(c, handler)
+	})
+
+	ctx := context.Background()
+	post := store.Post{ID: gocql.TimeUUID(), UserID: 1, Content: "first", CreatedAt: time.Now()}
+	mem.CreatePost(ctx, post)
+	backend.IndexPost(search.NewDocument(post))
+	do := func(method, path, body string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s returned %v: %s", method, path, w.Code, w.Body.String())
+		}
+		if err := backend.Indexer.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	do(http.MethodPatch, "/posts/"+post.ID.String(), `{"post_content":"second"}`)
+	if doc, ok := fake.doc(post.ID); !ok || doc.PostContent != "second" || doc.EditedAt == nil {
+		t.Errorf("expected the edit to be indexed, got %+v", doc)
+	}
+	do(http.MethodDelete, "/posts/"+post.ID.String(), "")
+	if _, ok := fake.doc(post.ID); ok {
+		t.Errorf("expected the deleted post to leave the index")
+	}
+	do(http.MethodPost, "/me/trash/"+post.ID.String()+"/restore", "")
+	if doc, ok := fake.doc(post.ID); !ok || doc.PostContent != "second" {
+		t.Errorf("expected the restored post to be indexed again, got %+v", doc)
+	}
+	if fake.requests != 3 {
+		t.Errorf("expected one bulk request per flush, got %d", fake.requests)
+	}
+}
+
+func TestIndexerRetriesBulkFailures(t *testing.T) {
+	fake, es := newFakeES(t)
+	indexer := search.NewIndexer(es, "posts")
+	indexer.BatchSize = 3
+	indexer.Backoff = time.Millisecond
+	var posts []store.Post
+	for i := 0; i < 5; i++ {
+		post := store.Post{ID: gocql.TimeUUID(), UserID: 1, Content: "post", CreatedAt: time.Now()}
+		posts = append(posts, post)
+		indexer.IndexPost(search.NewDocument(post))
+	}
+	indexer.DeletePost(gocql.TimeUUID().String())
+
+	// The first request is throttled outright and the second rejects one of
+	// its items, so the first batch takes three requests.
+	rejected := posts[1].ID.String()
+	fake.fail = func(request int, action, id string) int {
+		if request == 1 && action == "" {
+			return http.StatusTooManyRequests
+		}
+		if request == 2 && id == rejected {
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	}
+	if err := indexer.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, post := range posts {
+		if _, ok := fake.doc(post.ID); !ok {
+			t.Errorf("expected %s to be indexed", post.ID)
+		}
+	}
+	if fake.requests != 4 {
+		t.Errorf("expected 4 bulk requests, got %d", fake.requests)
+	}
+
+	fake.fail = func(request int, action, id string) int {
+		return http.StatusBadGateway
+	}
+	indexer.MaxRetries = 2
+	indexer.IndexPost(search.NewDocument(posts[0]))
+	if err := indexer.Flush(context.Background()); err == nil {
+		t.Error("expected flush to report the dropped operation")
+	}
+	if fake.requests != 7 {
+		t.Errorf("expected the indexer to give up after 2 retries, got %d requests", fake.requests)
+	}
+}
+
+func TestIndexPostNowReportsFailures(t *testing.T) {
+	fake, es := newFakeES(t)
+	indexer := search.NewIndexer(es, "posts")
+	post := store.Post{ID: gocql.TimeUUID(), UserID: 1, Content: "post", CreatedAt: time.Now()}
+	ctx := context.Background()
+
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusBadRequest} {
+		status := status
+		fake.fail = func(request int, action, id string) int {
+			if action != "" {
+				return status
+			}
+			return 0
+		}
+		if err := indexer.IndexPostNow(ctx, search.NewDocument(post)); err == nil {
+			t.Errorf("expected an item failing with %d to be an error", status)
+		}
+	}
+	fake.fail = nil
+	if err := indexer.IndexPostNow(ctx, search.NewDocument(post)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.doc(post.ID); !ok || fake.requests != 3 {
+		t.Errorf("expected one request per call and the post indexed, got %d requests", fake.requests)
+	}
+}
+
+func TestReindexResumesAndSwapsAlias(t *testing.T) {
+	fake, es := newFakeES(t)
+	ctx := context.Background()
+	mem := store.NewMemory()
+	var posts []store.Post
+	for i := 0; i < 7; i++ {
+		post := store.Post{ID: gocql.TimeUUID(), UserID: 1, Content: fmt.Sprint(i), CreatedAt: time.Now()}
+		mem.CreatePost(ctx, post)
+		mem.AddLike(ctx, 2, post.ID, time.Now())
+		mem.AddMedia(ctx, post.ID, 0, "photo.jpg")
+		posts = append(posts, post)
+	}
+	// An index created before the alias existed is replaced by the swap.
+	stale := search.NewIndexer(es, "posts")
+	stale.IndexPost(search.NewDocument(store.Post{ID: gocql.TimeUUID()}))
+	stale.Flush(ctx)
+	fake.requests = 0
+
+	checkpoint := filepath.Join(t.TempDir(), "reindex.checkpoint")
+	reindexer := search.NewReindexer(mem, es, "posts", checkpoint)
+	reindexer.PageSize = 3
+	reindexer.Settle = 0
+	fake.fail = func(request int, action, id string) int {
+		if request > 1 && action == "" {
+			return http.StatusInternalServerError
+		}
+		return 0
+	}
+	if _, err := reindexer.Reindex(ctx); err == nil {
+		t.Fatal("expected the reindex to fail while bulk requests fail")
+	}
+	if _, ok := fake.aliases["posts"]; ok {
+		t.Fatal("expected the alias to stay put until the reindex completes")
+	}
+
+	fake.fail = nil
+	index, err := reindexer.Reindex(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.aliases["posts"] != index || len(fake.indices[index]) != 7 {
+		t.Fatalf("expected posts to point at %s with 7 documents, got %v", index, fake.aliases)
+	}
+	for _, post := range posts {
+		doc, ok := fake.doc(post.ID)
+		if !ok || doc.PostContent != post.Content || doc.Likes != 1 || len(doc.Media) != 1 {
+			t.Errorf("unexpected document for %s: %+v", post.ID, doc)
+		}
+	}
+	// The first page got through, the second failed on every attempt and the
+	// rerun only sent the two pages that were left.
+	if fake.requests != 1+4+2 {
+		t.Errorf("expected the second run to resume after the first page, got %d bulk requests", fake.requests)
+	}
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Errorf("expected the checkpoint to be removed, got %v", err)
+	}
+	if _, ok := fake.aliases[search.MirrorAlias("posts")]; ok {
+		t.Error("expected the mirror alias to be removed by the swap")
+	}
+}
+
+func TestReindexKeepsLiveWrites(t *testing.T) {
+	fake, es := newFakeES(t)
+	ctx := context.Background()
+	mem := store.NewMemory()
+	live := search.NewElasticsearch(es, "posts")
+	live.Indexer.MirrorRefresh = 0
+	index := func(post store.Post) {
+		doc, err := search.LoadDocument(ctx, mem, mem, mem, post)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := live.IndexPostNow(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var posts []store.Post
+	for i := 0; i < 6; i++ {
+		post := store.Post{ID: gocql.TimeUUID(), UserID: 1, Content: fmt.Sprint(i), CreatedAt: time.Now()}
+		mem.CreatePost(ctx, post)
+		index(post)
+		posts = append(posts, post)
+	}
+
+	checkpoint := filepath.Join(t.TempDir(), "reindex.checkpoint")
+	reindexer := search.NewReindexer(mem, es, "posts", checkpoint)
+	reindexer.PageSize = 3
+	reindexer.Settle = 0
+	start := fake.requests
+	fake.fail = func(request int, action, id string) int {
+		if request > start+1 && action == "" {
+			return http.StatusInternalServerError
+		}
+		return 0
+	}
+	if _, err := reindexer.Reindex(ctx); err == nil {
+		t.Fatal("expected the reindex to stop after the first page")
+	}
+	fake.fail = nil
+	target := fake.aliases[search.MirrorAlias("posts")]
+	var copied []store.Post
+	for _, post := range posts {
+		if _, ok := fake.indices[target][post.ID.String()]; ok {
+			copied = append(copied, post)
+		}
+	}
+	if len(copied) != 3 {
+		t.Fatalf("expected the first page in %s, got %d posts", target, len(copied))
+	}
+
+	// While the reindex is stopped halfway, one copied post is edited and
+	// another deleted, and a post is created behind the scan's cursor.
+	edited := time.Now()
+	if err := mem.EditPost(ctx, copied[0], "edited", nil, edited); err != nil {
+		t.Fatal(err)
+	}
+	record, _ := mem.GetPost(ctx, copied[0].ID)
+	index(record)
+	if err := mem.TrashPost(ctx, copied[1], nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	live.DeletePost(copied[1].ID.String())
+	if err := live.Indexer.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	created := store.Post{ID: gocql.UUID{15: 1}, UserID: 1, Content: "new", CreatedAt: time.Now()}
+	mem.CreatePost(ctx, created)
+	index(created)
+
+	if _, err := reindexer.Reindex(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if fake.aliases["posts"] != target {
+		t.Fatalf("expected posts to point at %s, got %v", target, fake.aliases)
+	}
+	if doc, ok := fake.doc(copied[0].ID); !ok || doc.PostContent != "edited" {
+		t.Errorf("expected the edit to survive the swap, got %+v", doc)
+	}
+	if _, ok := fake.doc(copied[1].ID); ok {
+		t.Error("expected the deleted post to stay deleted after the swap")
+	}
+	if _, ok := fake.doc(created.ID); !ok {
+		t.Error("expected the post created during the reindex to be searchable")
+	}
+	if len(fake.indices[target]) != 6 {
+		t.Errorf("expected 6 documents in %s, got %d", target, len(fake.indices[target]))
+	}
+}
+
+func TestHandleSearch(t *testing.T) {
+	fake, es := newFakeES(t)
+	r, handler, mem, cache := newTestRouter(t, 1)
+	handler.Search = search.NewElasticsearch(es, "posts")
+	r.POST("/posts/search", func(c *gin.Context) {
+		handlers.HandleSearch(c, handler, cache)
+	})
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/posts/search", strings.NewReader(body))
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post(`{"query":"nothing"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"results":[]`) || !strings.Contains(w.Body.String(), `"total":0`) {
+		t.Errorf("expected an empty 200 page, got %v: %s", w.Code, w.Body.String())
+	}
+
+	ctx := context.Background()
+	first := store.Post{ID: gocql.TimeUUID(), UserID: 3, Content: "a great film", CreatedAt: time.Now()}
+	second := store.Post{ID: gocql.TimeUUID(), UserID: 3, Content: "another great film", CreatedAt: time.Now()}
+	mem.CreatePost(ctx, first)
+	mem.AddLike(ctx, 1, first.ID, time.Now())
+	for _, p := range []store.Post{first, second} {
+		doc := search.NewDocument(p)
+		doc.Media = []string{"poster.jpg"}
+		fake.hits = append(fake.hits, map[string]interface{}{
+			"_source":   doc,
+			"highlight": map[string][]string{"post_content": {"<em>great</em>"}},
+			"sort":      []interface{}{p.CreatedAt.UnixMilli(), p.ID.String()},
+		})
+	}
+	w = post(`{"query":"great","user_id":3,"created_after":"2020-01-01T00:00:00Z","has_media":false,"sort":"recency","size":2}`)
+	var page handlers.SearchPage
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if w.Code != http.StatusOK || page.Total != 2 || len(page.Results) != 2 || page.NextCursor == "" {
+		t.Fatalf("unexpected search page %v: %s", w.Code, w.Body.String())
+	}
+	hit := page.Results[0]
+	if hit.ID != first.ID || hit.Likes != 1 || len(hit.Media) != 1 || len(hit.Highlights) != 1 {
+		t.Errorf("unexpected first result: %+v", hit)
+	}
+	sent, _ := json.Marshal(fake.searches[1])
+	for _, want := range []string{`{"term":{"user_id":3}}`, `"gte":"2020-01-01T00:00:00Z"`, `"must_not":[{"exists":{"field":"media"}}]`, `"sort":[{"created_at":"desc"},{"post_id":"asc"}]`, `"from":0`} {
+		if !strings.Contains(string(sent), want) {
+			t.Errorf("expected %s in search body %s", want, sent)
+		}
+	}
+
+	cursor := page.NextCursor
+	fake.hits = fake.hits[:1]
+	w = post(`{"query":"great","sort":"recency","size":2,"search_after":"` + cursor + `"}`)
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if w.Code != http.StatusOK || page.NextCursor != "" {
+		t.Errorf("expected a last page, got %v: %s", w.Code, w.Body.String())
+	}
+	sent, _ = json.Marshal(fake.searches[2])
+	if !strings.Contains(string(sent), `"search_after":[`+fmt.Sprint(second.CreatedAt.UnixMilli())) || strings.Contains(string(sent), `"from"`) {
+		t.Errorf("expected search_after instead of from, got %s", sent)
+	}
+
+	for _, body := range []string{`{"sort":"random"}`, `{"size":500}`, `{"search_after":"!"}`, `{"from":10,"search_after":"` + cursor + `"}`} {
+		if w := post(body); w.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %v", body, w.Code)
+		}
+	}
+}
+
+func TestParseEntities(t *testing.T) {
+	content := "Watching #Movies with @Ana and @ana again #movies #a#b mail@example.com"
+	if tags := entities.Hashtags(content); fmt.Sprint(tags) != "[movies a]" {
+		t.Errorf("unexpected hashtags %v", tags)
+	}
+	if mentions := entities.Mentions(content); fmt.Sprint(mentions) != "[ana]" {
+		t.Errorf("unexpected mentions %v", mentions)
+	}
+	doc := search.NewDocument(store.Post{ID: gocql.TimeUUID(), Content: content})
+	if fmt.Sprint(doc.Suggest) != "[#movies #a @ana]" {
+		t.Errorf("unexpected suggest inputs %v", doc.Suggest)
+	}
+}
+
+func TestHandleSuggest(t *testing.T) {
+	fake, es := newFakeES(t)
+	r, handler, _, cache := newTestRouter(t, 1)
+	handler.Search = search.NewElasticsearch(es, "posts")
+	r.GET("/posts/suggest", func(c *gin.Context) {
+		handlers.HandleSuggest(c, handler, cache)
+	})
+	r.GET("/posts/:id", func(c *gin.Context) {
+		c.Status(http.StatusTeapot)
+	})
+	suggest := func(query string) ([]search.Suggestion, int) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/posts/suggest?"+query, nil)
+		r.ServeHTTP(w, req)
+		var suggestions []search.Suggestion
+		json.Unmarshal(w.Body.Bytes(), &suggestions)
+		return suggestions, w.Code
+	}
+
+	fake.completions = []string{"#movies", "#music", "@movielover"}
+	fake.hits = []map[string]interface{}{
+		{"_source": search.Document{PostID: gocql.TimeUUID().String(), PostContent: strings.Repeat("movie night ", 20)}},
+	}
+	suggestions, code := suggest("q=Mov")
+	if code != http.StatusOK || len(suggestions) != 3 {
+		t.Fatalf("unexpected suggestions %v: %+v", code, suggestions)
+	}
+	if suggestions[0].Text != "#movies" || suggestions[1].Type != entities.Mention || suggestions[2].Type != "post" || len(suggestions[2].Text) != 100 {
+		t.Errorf("unexpected suggestions %+v", suggestions)
+	}
+	if sent, _ := json.Marshal(fake.searches[0]); !strings.Contains(string(sent), `"query":"mov"`) {
+		t.Errorf("expected the prefix to be matched against post content, got %s", sent)
+	}
+
+	suggest("q=mov")
+	if len(fake.searches) != 1 {
+		t.Errorf("expected the second lookup to be served from the cache, got %d searches", len(fake.searches))
+	}
+
+	suggestions, _ = suggest("q=%23mu")
+	if len(suggestions) != 1 || suggestions[0].Text != "#music" || fake.searches[1]["size"] != float64(0) {
+		t.Errorf("expected only hashtag completions, got %+v", suggestions)
+	}
+
+	fake.completions = []string{"#a1", "#a2", "#a3", "#a4", "#a5", "#a6", "#a7", "#a8", "#a9", "#a10", "#a11", "#a12"}
+	if suggestions, _ = suggest("q=%23a&limit=50"); len(suggestions) != 10 {
+		t.Errorf("expected suggestions to be capped at 10, got %d", len(suggestions))
+	}
+	if _, code = suggest("q=" + strings.Repeat("a", 51)); code != http.StatusBadRequest {
+		t.Errorf("expected an overlong prefix to be rejected, got %v", code)
+	}
+	if suggestions, code = suggest("q="); code != http.StatusOK || suggestions == nil || len(suggestions) != 0 {
+		t.Errorf("expected no suggestions for an empty prefix, got %v %+v", code, suggestions)
+	}
+
+	// An index created without Mapping has no completion field to suggest from.
+	fake.searchError = `{"error":{"type":"illegal_argument_exception","reason":"no mapping found for field [suggest]"}}`
+	if _, code = suggest("q=unmapped"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected a missing suggest field to be reported, got %v", code)
+	}
+}
+
+func TestEnsureIndex(t *testing.T) {
+	fake, es := newFakeES(t)
+	ctx := context.Background()
+	backend := search.NewElasticsearch(es, "posts")
+	for i := 0; i < 2; i++ {
+		if err := backend.EnsureIndex(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fake.aliases["posts"] != "posts-initial" || len(fake.indices) != 1 {
+		t.Fatalf("expected posts to point at posts-initial, got %v %v", fake.aliases, fake.indices)
+	}
+
+	// Once a reindex has moved the alias on, it is left where it is.
+	fake.indices["posts-20230501120000"] = map[string]search.Document{}
+	fake.aliases["posts"] = "posts-20230501120000"
+	if err := backend.EnsureIndex(ctx); err != nil || fake.aliases["posts"] != "posts-20230501120000" {
+		t.Errorf("expected an existing alias to be kept, got %v (%v)", fake.aliases, err)
+	}
+}
+
+func TestLocalSearch(t *testing.T) {
+	r, handler, mem, cache := newTestRouter(t, 1)
+	local := search.NewLocal()
+	handler.Search = local
+	r.POST("/posts/search", func(c *gin.Context) {
+		handlers.HandleSearch(c, handler, cache)
+	})
+	r.GET("/posts/suggest", func(c *gin.Context) {
+		handlers.HandleSuggest(c, handler, cache)
+	})
+
+	ctx := context.Background()
+	start := time.Now().Add(-time.Hour)
+	contents := []string{
+		"A great film about #movies",
+		"Another film, great and long, with @ana",
+		"Nothing to see here",
+		"The film of the year #movienight",
+		"film film film",
+	}
+	for i, content := range contents {
+		post := store.Post{ID: gocql.TimeUUID(), UserID: 1 + i%2, Content: content, CreatedAt: start.Add(time.Duration(i) * time.Minute)}
+		mem.CreatePost(ctx, post)
+		if i == 3 {
+			mem.AddMedia(ctx, post.ID, 0, "poster.jpg")
+		}
+	}
+	if err := local.Fill(ctx, mem); err != nil {
+		t.Fatal(err)
+	}
+	searchPage := func(body string) handlers.SearchPage {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/posts/search", strings.NewReader(body))
+		r.ServeHTTP(w, req)
+		var page handlers.SearchPage
+		json.Unmarshal(w.Body.Bytes(), &page)
+		if w.Code != http.StatusOK {
+			t.Fatalf("search %s returned %v: %s", body, w.Code, w.Body.String())
+		}
+		return page
+	}
+
+	page := searchPage(`{"query":"flim"}`)
+	if page.Total != 4 || page.Results[0].PostContent != "film film film" {
+		t.Fatalf("expected a fuzzy match ranked by frequency, got %+v", page)
+	}
+	if page.Results[0].Highlights[0] != "<em>film</em> <em>film</em> <em>film</em>" {
+		t.Errorf("unexpected highlight %v", page.Results[0].Highlights)
+	}
+
+	page = searchPage(`{"query":"film","user_id":2,"sort":"recency"}`)
+	if page.Total != 2 || page.Results[0].PostContent != contents[3] || page.Results[1].PostContent != contents[1] {
+		t.Errorf("unexpected filtered results %+v", page)
+	}
+	if page = searchPage(`{"query":"film","has_media":true}`); page.Total != 1 || len(page.Results[0].Media) != 1 {
+		t.Errorf("expected only the post with media, got %+v", page)
+	}
+
+	var seen []string
+	page = searchPage(`{"sort":"recency","size":2}`)
+	for {
+		for _, result := range page.Results {
+			seen = append(seen, result.PostContent)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		page = searchPage(`{"sort":"recency","size":2,"search_after":"` + page.NextCursor + `"}`)
+	}
+	if len(seen) != 5 || seen[0] != contents[4] || seen[4] != contents[0] {
+		t.Errorf("expected every post newest first across pages, got %v", seen)
+	}
+
+	// The last page holds only the oldest post, the one tagged #movies.
+	local.DeletePost(page.Results[0].ID.String())
+	if page = searchPage(`{"query":"great"}`); page.Total != 1 {
+		t.Errorf("expected the deleted post to be gone, got %+v", page)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/posts/suggest?q=mov", nil)
+	r.ServeHTTP(w, req)
+	var suggestions []search.Suggestion
+	json.Unmarshal(w.Body.Bytes(), &suggestions)
+	if len(suggestions) != 2 || suggestions[0].Text != "#movienight" || suggestions[1].Text != contents[3] {
+		t.Errorf("unexpected suggestions %+v", suggestions)
+	}
+}
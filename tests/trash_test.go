@@ -0,0 +1,131 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/events"
+	"github.com/cal1co/movielogv2-postservice/handlers"
+	"github.com/cal1co/movielogv2-postservice/store"
+	"github.com/cal1co/movielogv2-postservice/trash"
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+func TestTrashAndRestorePost(t *testing.T) {
+	r, handler, mem, cache := newTestRouter(t, 1)
+	r.DELETE("/posts/:id", func(c *gin.Context) {
+		handlers.HandlePostDelete(c, handler, cache)
+	})
+	r.GET("/posts/:id", func(c *gin.Context) {
+		handlers.HandlePostGet(c, false, handler, cache)
+	})
+	r.GET("/me/trash", func(c *gin.Context) {
+		handlers.HandleGetTrash(c, handler)
+	})
+	r.POST("/me/trash/:id/restore", func(c *gin.Context) {
+		handlers.HandleRestorePost(c, handler)
+	})
+
+	ctx := context.Background()
+	post := store.Post{ID: gocql.TimeUUID(), UserID: 1, Content: "oops", CreatedAt: time.Now()}
+	comment := store.Comment{ID: gocql.TimeUUID(), UserID: 2, ParentID: post.ID, Content: "saw it", CreatedAt: time.Now()}
+	mem.CreatePost(ctx, post)
+	mem.CreateComment(ctx, comment)
+	mem.AddLike(ctx, 2, post.ID, time.Now())
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(http.MethodDelete, "/posts/"+post.ID.String()); w.Code != http.StatusOK {
+		t.Fatalf("delete returned %v: %s", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodGet, "/posts/"+post.ID.String()); w.Code != http.StatusNotFound {
+		t.Errorf("expected trashed post to be hidden, got %v", w.Code)
+	}
+	if _, err := mem.GetComment(ctx, comment.ID); err != store.ErrNotFound {
+		t.Errorf("expected trashed comment to be hidden, got %v", err)
+	}
+
+	w := do(http.MethodGet, "/me/trash")
+	var trashed []handlers.Post
+	json.Unmarshal(w.Body.Bytes(), &trashed)
+	if len(trashed) != 1 || trashed[0].ID != post.ID || trashed[0].DeletedAt == nil {
+		t.Fatalf("unexpected trash: %s", w.Body.String())
+	}
+
+	if w := do(http.MethodPost, "/me/trash/"+post.ID.String()+"/restore"); w.Code != http.StatusOK {
+		t.Fatalf("restore returned %v: %s", w.Code, w.Body.String())
+	}
+	w = do(http.MethodGet, "/posts/"+post.ID.String())
+	var restored handlers.Post
+	json.Unmarshal(w.Body.Bytes(), &restored)
+	if w.Code != http.StatusOK || restored.Likes != 1 || restored.Comments != 1 {
+		t.Errorf("expected restored post with its counts, got %v: %s", w.Code, w.Body.String())
+	}
+	if _, err := mem.GetComment(ctx, comment.ID); err != nil {
+		t.Errorf("expected comment to be restored, got %v", err)
+	}
+	if w := do(http.MethodPost, "/me/trash/"+post.ID.String()+"/restore"); w.Code != http.StatusNotFound {
+		t.Errorf("expected restoring twice to 404, got %v", w.Code)
+	}
+
+	mem.TrashPost(ctx, post, nil, time.Now().Add(-2*time.Hour))
+	handler.TrashRetention = time.Hour
+	if w := do(http.MethodPost, "/me/trash/"+post.ID.String()+"/restore"); w.Code != http.StatusGone {
+		t.Errorf("expected expired restore to be refused, got %v", w.Code)
+	}
+	if w := do(http.MethodGet, "/me/trash"); w.Body.String() != "[]" {
+		t.Errorf("expected expired posts to be left out of the trash, got %s", w.Body.String())
+	}
+}
+
+func TestPurgeExpiredTrash(t *testing.T) {
+	ctx := context.Background()
+	mem := store.NewMemory()
+	var expired []store.Post
+	for i := 0; i < 5; i++ {
+		post := store.Post{ID: gocql.TimeUUID(), UserID: 1, CreatedAt: time.Now()}
+		mem.CreatePost(ctx, post)
+		mem.AddLike(ctx, 2, post.ID, time.Now())
+		mem.TrashPost(ctx, post, nil, time.Now().Add(-48*time.Hour))
+		expired = append(expired, post)
+	}
+	recent := store.Post{ID: gocql.TimeUUID(), UserID: 1, CreatedAt: time.Now()}
+	mem.CreatePost(ctx, recent)
+	mem.TrashPost(ctx, recent, nil, time.Now())
+
+	purger := trash.NewPurger(mem, 24*time.Hour)
+	purger.BatchSize = 2
+	published := events.NewMemory()
+	purger.Events = published
+	purged, err := purger.Purge(ctx)
+	if err != nil || purged != 5 {
+		t.Fatalf("expected 5 purged posts, got %d (%v)", purged, err)
+	}
+	if announced := published.Events(); len(announced) != 5 || announced[0].Type != events.TypePostPurged {
+		t.Errorf("expected a purge event per post, got %+v", announced)
+	}
+	for _, post := range expired {
+		if _, err := mem.GetTrashedPost(ctx, 1, post.ID); err != store.ErrNotFound {
+			t.Errorf("expected %s to be purged, got %v", post.ID, err)
+		}
+		if likes, _ := mem.LikeCount(ctx, post.ID); likes != 0 {
+			t.Errorf("expected counters of %s to be purged, got %d", post.ID, likes)
+		}
+		if likers, _ := mem.ListLikers(ctx, post.ID); len(likers) != 0 {
+			t.Errorf("expected likes of %s to be purged, got %v", post.ID, likers)
+		}
+	}
+	if _, err := mem.GetTrashedPost(ctx, 1, recent.ID); err != nil {
+		t.Errorf("expected recent post to stay in the trash, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package trash
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"time"
+
+	"github.com/cal1co/movielogv2-postservice/events"
+	"github.com/cal1co/movielogv2-postservice/store"
+)
+
+var purgedTotal = expvar.NewInt("trash_purged_total")
+
+// Purger permanently removes posts that have been in the trash for longer than
+// Retention, together with their comments, likes, counters, media and
+// revisions, and tells Events about each one. When CheckLease is set it is
+// called before every batch.
+type Purger struct {
+	Store      store.TrashStore
+	Retention  time.Duration
+	BatchSize  int
+	Events     events.EventPublisher
+	CheckLease func(ctx context.Context) error
+}
+
+func NewPurger(s store.TrashStore, retention time.Duration) *Purger {
+	return &Purger{
+		Store:     s,
+		Retention: retention,
+		BatchSize: 100,
+	}
+}
+
+func (p *Purger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purged, err := p.Purge(ctx)
+		if err != nil {
+			log.Printf("Error purging trash: %v", err)
+		}
+		log.Printf("Purged %d posts from the trash", purged)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Purge removes every expired post and returns how many were removed.
+func (p *Purger) Purge(ctx context.Context) (int, error) {
+	purged := 0
+	cutoff := time.Now().Add(-p.Retention)
+	for {
+		if p.CheckLease != nil {
+			if err := p.CheckLease(ctx); err != nil {
+				return purged, err
+			}
+		}
+		posts, err := p.Store.ListExpiredTrash(ctx, cutoff, p.BatchSize)
+		if err != nil {
+			return purged, err
+		}
+		for _, post := range posts {
+			if err := p.Store.PurgePost(ctx, post); err != nil {
+				return purged, err
+			}
+			purged++
+			purgedTotal.Add(1)
+			p.publish(ctx, post)
+		}
+		if len(posts) < p.BatchSize {
+			return purged, nil
+		}
+	}
+}
+
+// publish announces a purged post. The post is already gone, so a failure is
+// logged rather than stopping the purge.
+func (p *Purger) publish(ctx context.Context, post store.Post) {
+	if p.Events == nil {
+		return
+	}
+	event, err := events.New(events.PostPurged{PostID: post.ID.String(), AuthorID: post.UserID, PurgedAt: time.Now()}, time.Now())
+	if err == nil {
+		err = p.Events.Publish(ctx, event)
+	}
+	if err != nil {
+		log.Printf("Error publishing purge of post %s: %v", post.ID, err)
+	}
+}